@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/app/unison-fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/sink"
+)
+
+// daemonStartTimeout bounds how long the shim waits for a daemon it started
+// to accept sessions.
+const daemonStartTimeout = 5 * time.Second
+
+// daemonSocket returns the socket of the daemon, which is the per-user
+// default unless one was configured.
+func (cfg config) daemonSocket() string {
+	if cfg.daemon != "" {
+		return cfg.daemon
+	}
+	return unisonfsmonitor.DaemonSocketPath()
+}
+
+// daemonLogFile returns the file the log of a daemon started by the shim is
+// appended to, which is next to the daemon socket unless one was configured.
+func (cfg config) daemonLogFile() string {
+	if cfg.logFile != "" {
+		return cfg.logFile
+	}
+	socket := cfg.daemonSocket()
+	return strings.TrimSuffix(socket, filepath.Ext(socket)) + ".log"
+}
+
+// runDaemon serves protocol sessions on the daemon socket until it is told to
+// shut down.
+func runDaemon(cfg config) int {
+	if cfg.transcriptPath != "" {
+		fmt.Fprintln(os.Stderr, "[ERROR] Unable to record a transcript in the daemon, which does not record its sessions")
+		return 2
+	}
+
+	options, cleanup, err := cfg.options()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	defer cleanup()
+
+	fsm, err := unisonfsmonitor.New(options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	defer fsm.Close()
+	fsm.HandleSignals()
+
+	socket := cfg.daemonSocket()
+	if err := unisonfsmonitor.MakeDaemonDir(socket); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- fsm.Serve(socket)
+	}()
+
+	select {
+	case err := <-served:
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 1
+	case <-fsm.ShutdownChannel:
+		return 0
+	}
+}
+
+// runShim forwards the protocol session between Unison and the daemon,
+// starting the daemon if none is running. Without a daemon the monitor runs
+// in this process as usual, so that Unison keeps working.
+func runShim(cfg config) int {
+	if cfg.ndjson == sink.StdoutPath {
+		fmt.Fprintln(os.Stderr, "[ERROR] Unable to write NDJSON to stdout through the daemon, which has no stdout of its own")
+		return 2
+	}
+	if cfg.transcriptPath != "" {
+		fmt.Fprintln(os.Stderr, "[ERROR] Unable to record a transcript through the daemon, which does not record its sessions")
+		return 2
+	}
+
+	conn, err := dialDaemon(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] %v, monitoring without the daemon\n", err)
+		return runMonitor(cfg)
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		// Unison closing our stdin ends the session, the daemon then closes
+		// the connection.
+		conn.CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+
+	return 0
+}
+
+// dialDaemon connects to the daemon, starting it first if nobody listens on
+// its socket. Only a socket of the current user is connected to.
+func dialDaemon(cfg config) (*net.UnixConn, error) {
+	socket := cfg.daemonSocket()
+	if err := unisonfsmonitor.MakeDaemonDir(socket); err != nil {
+		return nil, err
+	}
+	if err := unisonfsmonitor.CheckDaemonSocket(socket); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err == nil {
+		return conn.(*net.UnixConn), nil
+	}
+
+	if err := startDaemon(cfg); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(daemonStartTimeout)
+	for {
+		if err := unisonfsmonitor.CheckDaemonSocket(socket); err != nil {
+			return nil, err
+		}
+		conn, err = net.Dial("unix", socket)
+		if err == nil {
+			return conn.(*net.UnixConn), nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Unable to connect to the daemon at %s: %v", socket, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// startDaemon starts a daemon with the settings of the shim in a session of
+// its own, so that it outlives the Unison process that started the shim.
+func startDaemon(cfg config) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Unable to find the monitor executable: %v", err)
+	}
+
+	log, err := os.OpenFile(cfg.daemonLogFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open the daemon log: %v", err)
+	}
+	// The daemon has its own copy of the file once it has started.
+	defer log.Close()
+
+	cmd := exec.Command(exe, append(cfg.flags(), "daemon")...)
+	cmd.Dir = "/"
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to start the daemon: %v", err)
+	}
+	return cmd.Process.Release()
+}
+
+// flags turns the settings back into command line flags. The daemon runs in
+// the root directory, so paths are made absolute.
+func (cfg config) flags() []string {
+	flags := []string{"-daemon", absPath(cfg.daemonSocket())}
+
+	add := func(name, value string) {
+		if value != "" {
+			flags = append(flags, "-"+name, value)
+		}
+	}
+	metrics := cfg.metrics
+	if strings.HasPrefix(metrics, "unix:") || strings.Contains(metrics, "/") {
+		metrics = "unix:" + absPath(strings.TrimPrefix(metrics, "unix:"))
+	}
+	add("log-level", cfg.logLevel)
+	add("status-socket", absPath(cfg.statusSocket))
+	add("metrics", metrics)
+	add("snapshot-dir", absPath(cfg.snapshotDir))
+	add("snapshot-interval", cfg.snapshotInterval.String())
+	add("case-folding", cfg.caseFolding)
+	add("watchman-socket", absPath(cfg.watchmanSocket))
+	add("ndjson", absPath(cfg.ndjson))
+	add("webhook", cfg.webhook)
+	add("webhook-queue", absPath(cfg.webhookQueue))
+
+	return flags
+}
+
+// absPath returns the absolute form of a path, leaving an empty path, or one
+// that cannot be made absolute, as it is.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/doctor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// flagEnvs maps the flags to the environment variables they default to.
+var flagEnvs = map[string]string{
+	"log-level":       envLogLevel,
+	"log-file":        envLogFile,
+	"transcript":      envTranscript,
+	"status-socket":   envStatusSocket,
+	"metrics":         envMetrics,
+	"snapshot-dir":    envSnapshotDir,
+	"case-folding":    envCaseFolding,
+	"daemon":          envDaemon,
+	"watchman-socket": envWatchman,
+	"ndjson":          envNDJSON,
+	"webhook":         envWebhook,
+	"webhook-queue":   envWebhookQueue,
+}
+
+// doctorCommand checks whether the monitor can watch the roots given, and
+// those of the profile, on this machine, and prints the settings in effect.
+// It exits with 1 when there are problems that keep the monitor from
+// working.
+func doctorCommand(args []string, cfg config) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	watchFlags := &watchFlags{}
+	flags.StringVar(&watchFlags.profile, "profile", "", "also check the local roots of this Unison profile")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s doctor [flags] [root...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	replicas, profileCaseFolding, err := watchFlags.replicas(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+
+	report := doctor.Inspect(replicas)
+	report.Settings = settings(cfg, profileCaseFolding)
+	if err := report.Print(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	if report.Problems() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// settings returns the settings of the monitor in effect and where they
+// come from.
+func settings(cfg config, profileCaseFolding string) []doctor.Setting {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var settings []doctor.Setting
+	flag.VisitAll(func(f *flag.Flag) {
+		s := doctor.Setting{Name: f.Name, Value: f.Value.String(), Source: "default"}
+		switch {
+		case f.Name == "debug":
+			return
+		case f.Name == "log-level" && set["debug"]:
+			s.Value, s.Source = cfg.logLevel, "flag -debug"
+		case set[f.Name]:
+			s.Source = "flag"
+		case os.Getenv(flagEnvs[f.Name]) != "":
+			s.Source = "environment " + flagEnvs[f.Name]
+		case f.Name == "case-folding" && profileCaseFolding != "":
+			s.Value, s.Source = profileCaseFolding, "profile"
+		case f.Name == "case-folding":
+			s.Value = fsmonitor.CaseFoldingAuto
+		}
+		if s.Value == "" {
+			s.Value = "-"
+		}
+		settings = append(settings, s)
+	})
+
+	secret := doctor.Setting{Name: "webhook secret", Value: "not set", Source: "environment " + envWebhookSecret}
+	if os.Getenv(envWebhookSecret) != "" {
+		secret.Value = "set"
+	}
+	return append(settings, secret)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/gitfsmonitor"
+)
+
+// gitFSMonitorCommand answers a call of git's core.fsmonitor hook, which git
+// makes with the hook version and its last token as arguments. On failure
+// git scans the worktree itself.
+func gitFSMonitorCommand(args []string, socket string) int {
+	if socket == "" {
+		fmt.Fprintf(os.Stderr, "[ERROR] No monitor to ask: set -watchman-socket or %s\n", envWatchman)
+		return 1
+	}
+
+	// Git runs the hook at the top of the worktree.
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] Unable to find the worktree: %v\n", err)
+		return 1
+	}
+
+	if err := gitfsmonitor.Hook(socket, dir, args, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 1
+	}
+	return 0
+}
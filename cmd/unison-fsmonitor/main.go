@@ -1,21 +1,222 @@
-// +build darwin
-
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/app/unison-fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/sink"
+)
+
+// Unison starts the monitor without any arguments, so every setting that
+// matters in normal use can also be given through the environment.
+const (
+	envLogLevel     = "UNISON_FSMONITOR_LOG_LEVEL"
+	envLogFile      = "UNISON_FSMONITOR_LOG_FILE"
+	envTranscript   = "UNISON_FSMONITOR_TRANSCRIPT"
+	envStatusSocket = "UNISON_FSMONITOR_STATUS_SOCKET"
+	envMetrics      = "UNISON_FSMONITOR_METRICS"
+	envSnapshotDir  = "UNISON_FSMONITOR_SNAPSHOT_DIR"
+	envCaseFolding  = "UNISON_FSMONITOR_CASE_FOLDING"
+	envDaemon       = "UNISON_FSMONITOR_DAEMON"
+	envWatchman     = "UNISON_FSMONITOR_WATCHMAN_SOCKET"
+	envNDJSON       = "UNISON_FSMONITOR_NDJSON"
+	envWebhook      = "UNISON_FSMONITOR_WEBHOOK"
+	envWebhookQueue = "UNISON_FSMONITOR_WEBHOOK_QUEUE"
+	// The secret is only taken from the environment, to keep it out of
+	// the process list.
+	envWebhookSecret = "UNISON_FSMONITOR_WEBHOOK_SECRET"
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command]
+
+Without a command, the Unison filesystem monitor protocol is spoken on
+stdin and stdout, or forwarded to the daemon when -daemon is set. Commands:
+
+  daemon          serve the sessions of many Unison processes on the daemon socket
+  doctor          check whether the roots given, or those of a profile, can be
+                  watched on this machine and print the settings in effect
+  git-fsmonitor   answer git's core.fsmonitor hook (version 2) from the
+                  monitor serving the Watchman socket
+  replay          replay a recorded transcript and compare the output
+  run             run a command with the paths that change below some roots
+  selftest        check that the monitor works on this machine by playing a
+                  Unison session against it on a temporary tree
+  status          print the state of running monitors from their status sockets
+  watch           print what happens to each event below a root or the roots
+                  of a profile, and the changes that would be reported
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// config holds the settings of the monitor taken from the flags and the
+// environment.
+type config struct {
+	logLevel         string
+	logFile          string
+	transcriptPath   string
+	statusSocket     string
+	metrics          string
+	snapshotDir      string
+	snapshotInterval time.Duration
+	caseFolding      string
+	daemon           string
+	watchmanSocket   string
+	ndjson           string
+	webhook          string
+	webhookQueue     string
+}
+
 func main() {
-	fsm, err := unisonfsmonitor.New()
+	var cfg config
+
+	flag.StringVar(&cfg.logLevel, "log-level", os.Getenv(envLogLevel), "log level: warn, info or debug (env "+envLogLevel+")")
+	debug := flag.Bool("debug", false, "shorthand for -log-level=debug")
+	flag.StringVar(&cfg.logFile, "log-file", os.Getenv(envLogFile), "append the log of a daemon started by -daemon to this file (env "+envLogFile+", default the daemon socket with the extension .log)")
+	flag.StringVar(&cfg.transcriptPath, "transcript", os.Getenv(envTranscript), "append a transcript of the protocol session to this file (env "+envTranscript+")")
+	flag.StringVar(&cfg.statusSocket, "status-socket", os.Getenv(envStatusSocket), "serve the monitor's state on this Unix socket, or on a socket in this directory (env "+envStatusSocket+")")
+	flag.StringVar(&cfg.metrics, "metrics", os.Getenv(envMetrics), "serve Prometheus metrics at /metrics on this loopback host:port or Unix socket (env "+envMetrics+")")
+	flag.StringVar(&cfg.snapshotDir, "snapshot-dir", os.Getenv(envSnapshotDir), "keep snapshots of the replicas in this directory to report changes made while no monitor ran (env "+envSnapshotDir+")")
+	flag.DurationVar(&cfg.snapshotInterval, "snapshot-interval", unisonfsmonitor.DefaultSnapshotInterval, "how often to save the snapshots, 0 to only save them on shutdown")
+	flag.StringVar(&cfg.caseFolding, "case-folding", os.Getenv(envCaseFolding), "match paths without regard to case: always, never or auto (env "+envCaseFolding+")")
+	flag.StringVar(&cfg.daemon, "daemon", os.Getenv(envDaemon), "forward the protocol to the daemon on this Unix socket, starting it if needed; the socket the daemon command listens on (env "+envDaemon+")")
+	flag.StringVar(&cfg.watchmanSocket, "watchman-socket", os.Getenv(envWatchman), "serve a subset of Watchman's JSON protocol on this Unix socket (env "+envWatchman+")")
+	flag.StringVar(&cfg.ndjson, "ndjson", os.Getenv(envNDJSON), "append each batch of changes as a line of JSON to this file or FIFO, or to stdout if - and not speaking the protocol on it (env "+envNDJSON+")")
+	flag.StringVar(&cfg.webhook, "webhook", os.Getenv(envWebhook), "POST each batch of changes as JSON to this URL, signed with the secret in "+envWebhookSecret+" if set (env "+envWebhook+")")
+	flag.StringVar(&cfg.webhookQueue, "webhook-queue", os.Getenv(envWebhookQueue), "keep the batches not yet delivered to the webhook in this directory (env "+envWebhookQueue+", default in the temporary directory)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *debug {
+		cfg.logLevel = "debug"
+	}
+
+	switch flag.Arg(0) {
+	case "":
+		if cfg.daemon != "" {
+			os.Exit(runShim(cfg))
+		}
+		os.Exit(runMonitor(cfg))
+	case "daemon":
+		os.Exit(runDaemon(cfg))
+	case "doctor":
+		os.Exit(doctorCommand(flag.Args()[1:], cfg))
+	case "git-fsmonitor":
+		os.Exit(gitFSMonitorCommand(flag.Args()[1:], cfg.watchmanSocket))
+	case "replay":
+		os.Exit(replayCommand(flag.Args()[1:]))
+	case "run":
+		os.Exit(runCommand(flag.Args()[1:], cfg))
+	case "selftest":
+		os.Exit(selftestCommand(flag.Args()[1:], cfg))
+	case "status":
+		os.Exit(statusCommand(flag.Args()[1:], cfg.statusSocket))
+	case "watch":
+		os.Exit(watchCommand(flag.Args()[1:], cfg))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+}
+
+// options turns the settings into options for a monitor. The returned
+// function releases what was opened for the options.
+func (cfg config) options() ([]func(*unisonfsmonitor.UnisonFSMonitor) error, func(), error) {
+	options := []func(*unisonfsmonitor.UnisonFSMonitor) error{
+		unisonfsmonitor.WithLogLevel(cfg.logLevel),
+		unisonfsmonitor.WithCaseFolding(cfg.caseFolding),
+	}
+	cleanup := func() {}
+
+	if cfg.transcriptPath != "" {
+		f, err := os.OpenFile(cfg.transcriptPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open transcript: %v", err)
+		}
+		cleanup = func() { f.Close() }
+		options = append(options, unisonfsmonitor.WithTranscript(f))
+	}
+	if cfg.statusSocket != "" {
+		options = append(options, unisonfsmonitor.WithStatusSocket(cfg.statusSocket))
+	}
+	if cfg.metrics != "" {
+		options = append(options, unisonfsmonitor.WithMetrics(cfg.metrics))
+	}
+	if cfg.snapshotDir != "" {
+		options = append(options, unisonfsmonitor.WithSnapshotDir(cfg.snapshotDir, cfg.snapshotInterval))
+	}
+	if cfg.watchmanSocket != "" {
+		options = append(options, unisonfsmonitor.WithWatchmanSocket(cfg.watchmanSocket))
+	}
+	if cfg.ndjson != "" {
+		s, err := sink.OpenNDJSON(cfg.ndjson)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		// The monitor closes the sink, but not if it failed to start.
+		closeRest := cleanup
+		cleanup = func() {
+			s.Close()
+			closeRest()
+		}
+		options = append(options, unisonfsmonitor.WithSink(s))
+	}
+	if cfg.webhook != "" {
+		queue := cfg.webhookQueue
+		if queue == "" {
+			queue = filepath.Join(os.TempDir(), fmt.Sprintf("unison-fsmonitor-%d", os.Getuid()), "webhook")
+		}
+		var webhookOptions []sink.WebhookOption
+		if secret := os.Getenv(envWebhookSecret); secret != "" {
+			webhookOptions = append(webhookOptions, sink.WithSecret([]byte(secret)))
+		}
+		s, err := sink.NewWebhook(cfg.webhook, queue, webhookOptions...)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		closeRest := cleanup
+		cleanup = func() {
+			s.Close()
+			closeRest()
+		}
+		options = append(options, unisonfsmonitor.WithSink(s))
+	}
+
+	return options, cleanup, nil
+}
+
+func runMonitor(cfg config) int {
+	if cfg.ndjson == sink.StdoutPath {
+		fmt.Fprintln(os.Stderr, "[ERROR] Unable to write NDJSON to stdout, which carries the protocol")
+		return 2
+	}
+
+	options, cleanup, err := cfg.options()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	defer cleanup()
+
+	fsm, err := unisonfsmonitor.New(options...)
 	if err != nil {
-		fsm.SendErr("Unexpected error: %v", err)
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
 	}
+	defer fsm.Close()
+	fsm.HandleSignals()
 
 	go fsm.Run()
 	<-fsm.ShutdownChannel
 
-	os.Exit(1)
+	return 1
 }
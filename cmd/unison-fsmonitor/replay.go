@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/app/unison-fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/transcript"
+)
+
+// replayCommand replays every session in a transcript and prints a diff for
+// the sessions whose output differs from the recording. The exit code is 0
+// when all sessions match, 1 when any differ and 2 on usage errors.
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print the full diff context for matching sessions too")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [-v] transcript\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	entries, err := transcript.Read(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] Unable to read transcript: %v\n", err)
+		return 2
+	}
+
+	status := 0
+	for i, session := range transcript.Sessions(entries) {
+		actual, err := unisonfsmonitor.Replay(session)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] Unable to replay session %d: %v\n", i+1, err)
+			return 2
+		}
+
+		expected := transcript.Lines(session, transcript.Sent)
+		diff := transcript.Diff(expected, actual)
+		if diff == nil {
+			fmt.Printf("session %d (%s): output matches\n", i+1, session[0].Time.Format("2006-01-02 15:04:05"))
+			if *verbose {
+				for _, line := range expected {
+					fmt.Println(" " + line)
+				}
+			}
+			continue
+		}
+
+		status = 1
+		fmt.Printf("session %d (%s): output differs\n", i+1, session[0].Time.Format("2006-01-02 15:04:05"))
+		fmt.Println("--- recorded")
+		fmt.Println("+++ replayed")
+		for _, line := range diff {
+			fmt.Println(line)
+		}
+	}
+
+	return status
+}
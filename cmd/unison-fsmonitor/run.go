@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/onchange"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// splitCommand splits the arguments left after the flags into the roots
+// and the command that follows "--". The flags parser drops a "--" that
+// directly follows the flags, so args are checked for it too.
+func splitCommand(args, rest []string) ([]string, []string, bool) {
+	for i, arg := range rest {
+		if arg == "--" {
+			return rest[:i], rest[i+1:], len(rest) > i+1
+		}
+	}
+	if n := len(args) - len(rest); n > 0 && args[n-1] == "--" && len(rest) > 0 {
+		return nil, rest, true
+	}
+	return nil, nil, false
+}
+
+// runCommand watches the roots given before "--", and those of the profile,
+// and runs the command given after it with the paths that change. It runs
+// until it is interrupted and then exits with the status of the last run of
+// the command, or 2 on usage errors.
+func runCommand(args []string, cfg config) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	watchFlags := addWatchFlags(flags)
+	debounce := flags.Duration("debounce", onchange.DefaultDebounce, "how long the changes have to settle before the command runs")
+	stdin := flags.Bool("stdin", false, "pass the changed paths on the standard input, one per line, instead of as arguments")
+	restart := flags.Bool("restart", false, "run the command right away and restart it on every change, for commands that keep running")
+	killPrevious := flags.Bool("kill-previous", false, "stop the command if it still runs for earlier changes instead of waiting for it")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s run [flags] [root...] -- command [args...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	roots, command, ok := splitCommand(args, flags.Args())
+	if !ok || len(roots) == 0 && watchFlags.profile == "" {
+		flags.Usage()
+		return 2
+	}
+	replicas, profileCaseFolding, err := watchFlags.replicas(roots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+
+	options := []onchange.Option{onchange.WithDebounce(*debounce), onchange.WithLog(os.Stderr)}
+	if *stdin {
+		options = append(options, onchange.WithStdin())
+	}
+	if *restart {
+		options = append(options, onchange.WithRestart())
+	}
+	if *killPrevious {
+		options = append(options, onchange.WithKillPrevious())
+	}
+	runner, err := onchange.New(command, options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+
+	caseFolding := cfg.caseFolding
+	if caseFolding == "" {
+		caseFolding = profileCaseFolding
+	}
+	m, ctx, stop, err := watch(replicas, fsmonitor.WithCaseFolding(caseFolding))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	defer stop()
+
+	s := m.Subscribe()
+	defer s.Close()
+	status, err := runner.Run(ctx, s.C)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+	}
+	return status
+}
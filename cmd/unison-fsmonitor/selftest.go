@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/app/unison-fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// selftestCommand plays a Unison session against a monitor watching a
+// temporary tree and prints the outcome and latency of each step. It exits
+// with 1 when a step fails.
+func selftestCommand(args []string, cfg config) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	dir := flags.String("dir", os.TempDir(), "create the temporary tree in this directory, to test the filesystem holding it")
+	timeout := flags.Duration("timeout", unisonfsmonitor.DefaultSelfTestTimeout, "how long each step waits for the monitor")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s selftest [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	backend := "none"
+	if b := fsmonitor.DefaultBackend(); b != nil {
+		backend = b.Name()
+	}
+	fmt.Printf("Backend: %s\n", backend)
+
+	// The steps are printed as they are done.
+	report := func(s unisonfsmonitor.SelfTestStep) {
+		if s.Err != nil {
+			fmt.Printf("FAIL  %-10s %v\n", s.Name, s.Err)
+		} else {
+			fmt.Printf("ok    %-10s %s\n", s.Name, s.Latency.Round(time.Microsecond))
+		}
+	}
+	err := unisonfsmonitor.SelfTest(*dir, *timeout, report,
+		unisonfsmonitor.WithLogLevel(cfg.logLevel),
+		unisonfsmonitor.WithCaseFolding(cfg.caseFolding),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 1
+	}
+	return 0
+}
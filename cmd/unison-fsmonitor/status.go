@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/app/unison-fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/profile"
+)
+
+// statusCommand prints the state of the monitors listening on the given
+// sockets. A directory stands for every monitor socket in it. With a profile
+// only the replicas of its local roots are shown. The exit code is 0 when
+// every monitor answered, 1 when any did not and 2 on usage errors.
+func statusCommand(args []string, defaultSocket string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the raw JSON status")
+	profileName := flags.String("profile", "", "only show the replicas of the local roots of this Unison profile")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s status [-json] [-profile name] [socket or directory...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var roots map[string]bool
+	if *profileName != "" {
+		var err error
+		if roots, err = profileRoots(*profileName); err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+			return 2
+		}
+	}
+
+	targets := flags.Args()
+	if len(targets) == 0 {
+		if defaultSocket == "" {
+			fmt.Fprintf(os.Stderr, "[ERROR] No status socket given and %s is not set\n", envStatusSocket)
+			flags.Usage()
+			return 2
+		}
+		targets = []string{defaultSocket}
+	}
+
+	var sockets []string
+	for _, target := range targets {
+		if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+			matches, _ := filepath.Glob(filepath.Join(target, "unison-fsmonitor-*.sock"))
+			sockets = append(sockets, matches...)
+			continue
+		}
+		sockets = append(sockets, target)
+	}
+	if len(sockets) == 0 {
+		fmt.Fprintf(os.Stderr, "[ERROR] No monitors found in %s\n", strings.Join(targets, ", "))
+		return 1
+	}
+
+	status, shown := 0, 0
+	for _, socket := range sockets {
+		s, err := unisonfsmonitor.ReadStatus(socket)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %s: %v\n", socket, err)
+			status = 1
+			continue
+		}
+
+		if roots != nil {
+			var replicas []unisonfsmonitor.ReplicaStatus
+			for _, r := range s.Replicas {
+				if roots[filepath.Clean(r.Root)] {
+					replicas = append(replicas, r)
+				}
+			}
+			if len(replicas) == 0 {
+				continue
+			}
+			s.Replicas = replicas
+		}
+		shown++
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(s)
+			continue
+		}
+		printStatus(os.Stdout, socket, s)
+	}
+
+	if shown == 0 && status == 0 {
+		fmt.Fprintf(os.Stderr, "[ERROR] No monitor watches the roots of profile %s\n", *profileName)
+		return 1
+	}
+	return status
+}
+
+// profileRoots returns the local roots of the named profile, both as written
+// and with symlinks resolved, since either may be what Unison sent.
+func profileRoots(name string) (map[string]bool, error) {
+	p, err := profile.Load(profile.Dir(), name)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := p.Replicas()
+	if err != nil {
+		return nil, err
+	}
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("Profile %s has no local roots", p.Name)
+	}
+
+	roots := make(map[string]bool)
+	for _, r := range replicas {
+		roots[r.Root] = true
+		if real, err := filepath.EvalSymlinks(r.Root); err == nil {
+			roots[real] = true
+		}
+	}
+	return roots, nil
+}
+
+// printStatus writes a human readable form of a monitor's status to w.
+func printStatus(w io.Writer, socket string, s unisonfsmonitor.Status) {
+	now := time.Now()
+
+	fmt.Fprintf(w, "monitor pid %d (%s)\n", s.PID, socket)
+	fmt.Fprintf(w, "  started:   %s (%s ago)\n", s.Started.Format(time.RFC3339), now.Sub(s.Started).Round(time.Second))
+	fmt.Fprintf(w, "  log level: %s\n", s.LogLevel)
+	fmt.Fprintf(w, "  sessions:  %d\n", s.Sessions)
+	if len(s.Replicas) == 0 {
+		fmt.Fprintf(w, "  no replicas\n")
+	}
+
+	for _, r := range s.Replicas {
+		lastEvent := "never"
+		if r.LastEvent != nil {
+			lastEvent = fmt.Sprintf("%s (%s ago)", r.LastEvent.Format(time.RFC3339), now.Sub(*r.LastEvent).Round(time.Millisecond))
+		}
+
+		fmt.Fprintf(w, "\n  replica %s\n", r.Name)
+		tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(tw, "    root:\t%s\n", r.Root)
+		fmt.Fprintf(tw, "    backend:\t%s\n", r.Backend)
+		if r.Watch != r.Root {
+			fmt.Fprintf(tw, "    shared watch:\t%s\n", r.Watch)
+		}
+		fmt.Fprintf(tw, "    paths:\t%s\n", quoteList(r.Paths))
+		fmt.Fprintf(tw, "    dirs:\t%d\n", len(r.Dirs))
+		fmt.Fprintf(tw, "    waiting:\t%t\n", r.Waiting)
+		fmt.Fprintf(tw, "    reported:\t%t\n", r.Reported)
+		fmt.Fprintf(tw, "    pending:\t%d\n", r.PendingChanges)
+		fmt.Fprintf(tw, "    last event:\t%s\n", lastEvent)
+		fmt.Fprintf(tw, "    cursor:\t%s\n", r.Cursor)
+		tw.Flush()
+	}
+}
+
+// quoteList quotes each of the paths so that the root ("") stays visible.
+func quoteList(paths []string) string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = fmt.Sprintf("%q", p)
+	}
+	return strings.Join(quoted, " ")
+}
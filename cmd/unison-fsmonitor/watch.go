@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/watchlog"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// watchCommand watches a root and paths below it, or the roots of a profile,
+// as Unison would have them watched, and prints what happens to every event
+// and the changes that would be reported. It runs until it is interrupted,
+// or until the first changes with -once.
+func watchCommand(args []string, cfg config) int {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	watchFlags := addWatchFlags(flags)
+	jsonOutput := flags.Bool("json", false, "print a line of JSON for each event and report")
+	once := flags.Bool("once", false, "exit after the first changes are reported")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch [flags] [root [path...]]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 && watchFlags.profile == "" {
+		flags.Usage()
+		return 2
+	}
+	var roots, paths []string
+	if flags.NArg() > 0 {
+		roots, paths = flags.Args()[:1], flags.Args()[1:]
+	}
+	replicas, profileCaseFolding, err := watchFlags.replicas(roots, paths...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+
+	var options []watchlog.Option
+	if *jsonOutput {
+		options = append(options, watchlog.WithJSON())
+	}
+	l, err := watchlog.New(os.Stdout, options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+
+	caseFolding := cfg.caseFolding
+	if caseFolding == "" {
+		caseFolding = profileCaseFolding
+	}
+	m, ctx, stop, err := watch(replicas, fsmonitor.WithCaseFolding(caseFolding), fsmonitor.WithTrace(l.Trace()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 2
+	}
+	defer stop()
+
+	s := m.Subscribe()
+	defer s.Close()
+	for {
+		select {
+		case b, ok := <-s.C:
+			if !ok {
+				return 0
+			}
+			if err := l.Report(b); err != nil {
+				fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+				return 1
+			}
+			if *once {
+				return 0
+			}
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
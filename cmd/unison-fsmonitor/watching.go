@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/profile"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// stringList is a flag that can be given many times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// watchFlags are the flags of the commands that watch roots of their own.
+type watchFlags struct {
+	profile    string
+	ignores    stringList
+	ignoreNots stringList
+}
+
+// addWatchFlags defines the flags for what to watch on flags.
+func addWatchFlags(flags *flag.FlagSet) *watchFlags {
+	w := &watchFlags{}
+	flags.StringVar(&w.profile, "profile", "", "also watch the local roots of this Unison profile with its path, ignore and ignorenot preferences")
+	flags.Var(&w.ignores, "ignore", "ignore the changes of paths matching a rule of Unison's ignore preference, such as 'Name *.o'; may be repeated")
+	flags.Var(&w.ignoreNots, "ignorenot", "do not ignore the paths matching a rule, as Unison's ignorenot preference; may be repeated")
+	return w
+}
+
+// replicas returns what to watch for the roots and the profile, if any, and
+// the case folding mode the profile asks for. The paths below the roots are
+// watched, or the whole roots without paths.
+func (w *watchFlags) replicas(roots []string, paths ...string) ([]profile.Replica, string, error) {
+	ignores, err := parseIgnoreRules(w.ignores)
+	if err != nil {
+		return nil, "", err
+	}
+	ignoreNots, err := parseIgnoreRules(w.ignoreNots)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var replicas []profile.Replica
+	caseFolding := ""
+	if w.profile != "" {
+		p, err := profile.Load(profile.Dir(), w.profile)
+		if err != nil {
+			return nil, "", err
+		}
+		if replicas, err = p.Replicas(); err != nil {
+			return nil, "", err
+		}
+		if len(replicas) == 0 {
+			return nil, "", fmt.Errorf("Profile %s has no local roots", p.Name)
+		}
+		caseFolding = p.CaseFolding()
+	}
+	rootPaths := []string{""}
+	if len(paths) > 0 {
+		rootPaths = nil
+		for _, p := range paths {
+			rootPaths = append(rootPaths, strings.Trim(p, "/"))
+		}
+	}
+	for _, root := range roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		replicas = append(replicas, profile.Replica{Root: root, Paths: rootPaths})
+	}
+
+	for i := range replicas {
+		r := &replicas[i]
+		r.Ignores = append(r.Ignores, ignores...)
+		r.IgnoreNots = append(r.IgnoreNots, ignoreNots...)
+	}
+	return replicas, caseFolding, nil
+}
+
+// parseIgnoreRules parses the rules given with a flag.
+func parseIgnoreRules(specs []string) ([]fsmonitor.IgnoreRule, error) {
+	var rules []fsmonitor.IgnoreRule
+	for _, spec := range specs {
+		rule, err := fsmonitor.ParseIgnoreRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// watch runs a monitor of the replicas until the returned context is done,
+// which is when the returned function is called or the process is
+// interrupted. The function returns once the monitor has stopped.
+func watch(replicas []profile.Replica, options ...fsmonitor.Option) (*fsmonitor.Monitor, context.Context, func(), error) {
+	m, err := fsmonitor.New(options...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stop := func() {
+		signal.Stop(signals)
+		cancel()
+		<-done
+	}
+
+	for _, r := range replicas {
+		// Events are reported for the real path of the root.
+		if real, err := filepath.EvalSymlinks(r.Root); err == nil {
+			r.Root = real
+		}
+		if _, err := r.Watch(m); err != nil {
+			stop()
+			return nil, nil, nil, fmt.Errorf("Unable to watch %s: %v", r.Root, err)
+		}
+	}
+	return m, ctx, stop, nil
+}
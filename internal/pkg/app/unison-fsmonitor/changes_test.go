@@ -0,0 +1,27 @@
+package unisonfsmonitor
+
+import (
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+// Asking for the changes of one replica used to drop the pending changes of
+// every other replica as well.
+func TestChangesKeepsOtherReplicas(t *testing.T) {
+	t.Parallel()
+
+	c := newUnisonClient(t)
+	defer c.Close()
+
+	c.Handshake()
+	for replica, path := range map[string]string{"one": "a.txt", "two": "b.txt"} {
+		changes := set.New()
+		changes.Add(path)
+		c.fsm.replicaChanges.Store(replica, changes)
+	}
+
+	c.ExpectChanges("one", "a.txt")
+	c.ExpectChanges("two", "b.txt")
+	c.ExpectChanges("one")
+}
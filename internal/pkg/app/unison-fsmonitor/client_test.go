@@ -0,0 +1,317 @@
+package unisonfsmonitor
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/quote"
+)
+
+// defaultClientTimeout bounds how long a unisonClient waits for a line from
+// the monitor. FSEvents are delivered with half a second of latency, so this
+// leaves plenty of headroom on a loaded machine.
+const defaultClientTimeout = 10 * time.Second
+
+// unisonClient plays the part of Unison in tests. It owns a monitor, talks
+// the fsmonitor protocol to it over pipes and fails the test when the
+// monitor does not answer with exactly the expected lines. Each test creates
+// its own client, so tests using it can run in parallel.
+type unisonClient struct {
+	t       *testing.T
+	fsm     *UnisonFSMonitor
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	stderr  *syncBuffer
+	lines   chan string
+	eof     chan empty
+	done    chan empty
+	timeout time.Duration
+}
+
+// newUnisonClient creates a monitor with the given options and runs it.
+// Close must be called when the test is done with the client.
+func newUnisonClient(t *testing.T, options ...func(*UnisonFSMonitor) error) *unisonClient {
+	t.Helper()
+
+	stdin, stdinWriter := io.Pipe()
+	stdoutReader, stdout := io.Pipe()
+	c := newClient(t, stdinWriter, stdoutReader)
+
+	options = append([]func(*UnisonFSMonitor) error{
+		withStdin(stdin),
+		withStdout(stdout),
+		withStderr(c.stderr),
+	}, options...)
+	fsm, err := New(options...)
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+	c.fsm = fsm
+
+	go func() {
+		fsm.Run()
+		close(c.done)
+	}()
+
+	return c
+}
+
+// newClient creates a client that writes commands to stdin and reads the
+// answers of the monitor from stdout.
+func newClient(t *testing.T, stdin io.WriteCloser, stdout io.ReadCloser) *unisonClient {
+	c := &unisonClient{
+		t:       t,
+		stdin:   stdin,
+		stdout:  stdout,
+		stderr:  &syncBuffer{},
+		lines:   make(chan string, 100),
+		eof:     make(chan empty),
+		done:    make(chan empty),
+		timeout: defaultClientTimeout,
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+		close(c.lines)
+		close(c.eof)
+	}()
+
+	return c
+}
+
+// halfCloser closes only the sending side of a connection, the way Unison
+// closes the monitor's stdin while still reading its output.
+type halfCloser struct {
+	*net.UnixConn
+}
+
+func (h halfCloser) Close() error {
+	return h.CloseWrite()
+}
+
+// dialClient connects a client to the monitor listening for sessions at
+// path.
+func dialClient(t *testing.T, path string) *unisonClient {
+	t.Helper()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Unable to connect to the monitor: %v", err)
+	}
+	c := newClient(t, halfCloser{conn.(*net.UnixConn)}, conn)
+	// The monitor closes the connection once the session has ended.
+	c.done = c.eof
+
+	return c
+}
+
+// Close ends the session the way Unison does, by closing stdin, and waits
+// for the monitor to shut down. A monitor created by newUnisonClient is then
+// closed as well. Any output the test did not consume is an error.
+func (c *unisonClient) Close() {
+	c.t.Helper()
+
+	c.stdin.Close()
+	select {
+	case <-c.done:
+	case <-time.After(c.timeout):
+		c.t.Errorf("Timed out waiting for the monitor to shut down")
+	}
+	if c.fsm != nil {
+		if err := c.fsm.Close(); err != nil {
+			c.t.Errorf("Unable to close the monitor: %v", err)
+		}
+	}
+	c.stdout.Close()
+
+	for line := range c.lines {
+		c.t.Errorf("Unexpected output from the monitor: %q", line)
+	}
+	if c.t.Failed() {
+		c.t.Logf("Monitor stderr:\n%s", c.stderr.String())
+	}
+}
+
+// Send writes a command with its arguments quoted the way Unison quotes
+// them.
+func (c *unisonClient) Send(cmd string, args ...string) {
+	c.t.Helper()
+
+	c.SendRaw(quote.Format(cmd, args...))
+}
+
+// SendRaw writes a line to the monitor exactly as given.
+func (c *unisonClient) SendRaw(line string) {
+	c.t.Helper()
+
+	// Writes to the pipe block until the monitor reads them, which it never
+	// does after it has stopped on an error.
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(c.stdin, line+"\n")
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			c.t.Fatalf("Unable to send %q: %v", line, err)
+		}
+	case <-time.After(c.timeout):
+		c.t.Fatalf("Timed out sending %q to the monitor", line)
+	}
+}
+
+// ReadLine returns the next line sent by the monitor. The test fails if no
+// line arrives before the client's timeout.
+func (c *unisonClient) ReadLine() string {
+	c.t.Helper()
+
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			c.t.Fatalf("The monitor closed its output")
+		}
+		return line
+	case <-time.After(c.timeout):
+		c.t.Fatalf("Timed out waiting for output from the monitor")
+	}
+	return ""
+}
+
+// Expect reads the next line and fails the test if it differs from the
+// expected line.
+func (c *unisonClient) Expect(expected string) {
+	c.t.Helper()
+
+	if line := c.ReadLine(); line != expected {
+		c.t.Fatalf("Expecting: %q, got: %q", expected, line)
+	}
+}
+
+// ExpectNoOutput fails the test if the monitor sends anything during the
+// given period.
+func (c *unisonClient) ExpectNoOutput(d time.Duration) {
+	c.t.Helper()
+
+	select {
+	case line, ok := <-c.lines:
+		if ok {
+			c.t.Fatalf("Unexpected output from the monitor: %q", line)
+		}
+	case <-time.After(d):
+	}
+}
+
+// Handshake exchanges protocol versions with the monitor.
+func (c *unisonClient) Handshake() {
+	c.t.Helper()
+
+	c.Expect("VERSION 1")
+	c.Send("VERSION", "1")
+}
+
+// Start tells the monitor to watch path below root for the replica. The
+// directories Unison found below path are announced with DIR.
+func (c *unisonClient) Start(replica, root, path string, dirs ...string) {
+	c.t.Helper()
+
+	if path == "" {
+		c.Send("START", replica, root)
+	} else {
+		c.Send("START", replica, root, path)
+	}
+	c.Expect("OK")
+	for _, dir := range dirs {
+		c.Send("DIR", dir)
+		c.Expect("OK")
+	}
+	c.Send("DONE")
+}
+
+// Wait asks the monitor to notify the client about changes to the replicas.
+func (c *unisonClient) Wait(replicas ...string) {
+	c.t.Helper()
+
+	for _, replica := range replicas {
+		c.Send("WAIT", replica)
+	}
+}
+
+// ExpectNotification waits for the monitor to report that the replica has
+// changes.
+func (c *unisonClient) ExpectNotification(replica string) {
+	c.t.Helper()
+
+	c.Expect("CHANGES " + quote.Quote(replica))
+}
+
+// ExpectChanges asks the monitor for the changes of the replica and fails
+// the test unless exactly the given paths are reported.
+func (c *unisonClient) ExpectChanges(replica string, paths ...string) {
+	c.t.Helper()
+
+	c.Send("CHANGES", replica)
+
+	// The monitor reports the paths in sorted order.
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+
+	expected := make([]string, 0, len(sorted)+1)
+	for _, path := range sorted {
+		expected = append(expected, "RECURSIVE "+quote.Quote(path))
+	}
+	expected = append(expected, "DONE")
+
+	for _, e := range expected {
+		c.Expect(e)
+	}
+}
+
+// Reset tells the monitor to stop watching the replica.
+func (c *unisonClient) Reset(replica string) {
+	c.t.Helper()
+
+	c.Send("RESET", replica)
+}
+
+// ExpectEventualChanges collects the changes of the replica until all of the
+// given paths have been reported, waiting for further notifications in
+// between. Filesystem events can be delivered in several batches, so a single
+// CHANGES may only report some of them. Reporting any other path fails the
+// test.
+func (c *unisonClient) ExpectEventualChanges(replica string, paths ...string) {
+	c.t.Helper()
+
+	missing := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		missing["RECURSIVE "+quote.Quote(path)] = true
+	}
+	seen := make(map[string]bool, len(paths))
+
+	for {
+		c.Send("CHANGES", replica)
+		for line := c.ReadLine(); line != "DONE"; line = c.ReadLine() {
+			switch {
+			case missing[line]:
+				delete(missing, line)
+				seen[line] = true
+			case !seen[line]:
+				c.t.Fatalf("Unexpected change: %q", line)
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+
+		c.Wait(replica)
+		c.ExpectNotification(replica)
+	}
+}
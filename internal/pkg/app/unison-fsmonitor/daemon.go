@@ -0,0 +1,78 @@
+package unisonfsmonitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DaemonSocketPath returns the socket a daemon of the current user listens
+// on unless told otherwise. It lies in $XDG_RUNTIME_DIR if set, and else in
+// a directory of the user in the temporary directory, which on macOS is
+// private to the user already.
+func DaemonSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "unison-fsmonitor.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("unison-fsmonitor-%d", os.Getuid()), "daemon.sock")
+}
+
+// MakeDaemonDir creates the directory of the daemon socket at path, readable
+// only by the current user, unless it exists. An existing directory must
+// belong to the user, or to root with the sticky bit set like /tmp, so that
+// nobody else can replace the socket.
+func MakeDaemonDir(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Unable to create the daemon socket directory: %v", err)
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("Unable to check the daemon socket directory: %v", err)
+	}
+	owner := fileOwner(fi)
+	if !fi.IsDir() || owner != os.Getuid() && (owner != 0 || fi.Mode()&os.ModeSticky == 0) {
+		return fmt.Errorf("Daemon socket directory %s does not belong to the current user", dir)
+	}
+	return nil
+}
+
+// CheckDaemonSocket returns an error unless the daemon socket at path is a
+// socket of the current user, so that the sessions of Unison are not handed
+// to a daemon of somebody else. A missing socket is fine.
+func CheckDaemonSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to check the daemon socket: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Daemon socket %s is not a socket", path)
+	}
+	if owner := fileOwner(fi); owner != os.Getuid() {
+		return fmt.Errorf("Daemon socket %s belongs to uid %d, not to the current user", path, owner)
+	}
+	return nil
+}
+
+// fileOwner returns the uid of the owner of a file.
+func fileOwner(fi os.FileInfo) int {
+	return int(fi.Sys().(*syscall.Stat_t).Uid)
+}
+
+// Serve runs the monitor as a daemon: it listens on the Unix domain socket at
+// path and speaks the protocol with every Unison process that connects. The
+// replicas, their watches and their pending changes are shared by all of the
+// sessions and kept when a session ends, so that a restarted Unison picks up
+// where the previous one left off. Serve returns once the monitor is closed.
+func (fsm *UnisonFSMonitor) Serve(path string) error {
+	l, err := fsm.listen(path, fsm.replicaSet)
+	if err != nil {
+		return err
+	}
+	return l.Serve()
+}
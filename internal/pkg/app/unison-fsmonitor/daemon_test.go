@@ -0,0 +1,241 @@
+package unisonfsmonitor
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// newDaemon starts a monitor serving sessions on a socket in a temporary
+// directory and returns it together with the path of the socket.
+func newDaemon(t *testing.T, options ...func(*UnisonFSMonitor) error) (*UnisonFSMonitor, string) {
+	t.Helper()
+
+	dir := makeTempDir(t)
+	path := filepath.Join(dir, "daemon.sock")
+
+	options = append([]func(*UnisonFSMonitor) error{withStderr(&syncBuffer{})}, options...)
+	fsm, err := New(options...)
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- fsm.Serve(path)
+		os.RemoveAll(dir)
+	}()
+	waitFor(t, "the daemon socket", func() bool {
+		select {
+		case err := <-served:
+			t.Fatalf("Serve: %v", err)
+		default:
+		}
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+
+	return fsm, path
+}
+
+func TestDaemonKeepsChangesAcrossSessions(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	fsm, path := newDaemon(t, withBackend(b))
+	defer fsm.Close()
+
+	c := dialClient(t, path)
+	c.Handshake()
+	c.Start("one", "/r", "")
+	c.Wait("one")
+	c.Close()
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+
+	c = dialClient(t, path)
+	defer c.Close()
+	c.Handshake()
+	c.Start("one", "/r", "")
+	c.Wait("one")
+	c.ExpectNotification("one")
+	c.ExpectChanges("one", "a.txt")
+
+	if n := b.Watches(); n != 1 {
+		t.Errorf("Expecting the watch to be kept, got %d watches", n)
+	}
+}
+
+func TestDaemonConcurrentSessions(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	fsm, path := newDaemon(t, withBackend(b))
+	defer fsm.Close()
+
+	one := dialClient(t, path)
+	defer one.Close()
+	two := dialClient(t, path)
+	defer two.Close()
+
+	one.Handshake()
+	two.Handshake()
+	one.Start("one", "/r", "foo")
+	two.Start("two", "/r", "bar")
+	one.Wait("one")
+	two.Wait("two")
+
+	if n := b.Watches(); n != 1 {
+		t.Fatalf("Expecting 1 watch, got: %d", n)
+	}
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/bar/b.txt", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+
+	one.ExpectNotification("one")
+	one.ExpectChanges("one", "foo/a.txt")
+	two.ExpectNotification("two")
+	two.ExpectChanges("two", "bar/b.txt")
+
+	if s := fsm.status(); s.Sessions != 2 {
+		t.Errorf("Expecting 2 sessions, got: %d", s.Sessions)
+	}
+}
+
+func TestDaemonClose(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	fsm, path := newDaemon(t, withBackend(b))
+
+	c := dialClient(t, path)
+	c.Handshake()
+	c.Start("one", "/r", "")
+
+	if err := fsm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case <-c.eof:
+	case <-time.After(defaultClientTimeout):
+		t.Fatalf("Timed out waiting for the daemon to end the session")
+	}
+	c.Close()
+
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Errorf("The daemon still accepts sessions after Close")
+	}
+	if n := b.Active(); n != 0 {
+		t.Errorf("Expecting no active watches, got: %d", n)
+	}
+}
+
+func TestDaemonStalledSession(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	fsm, err := New(withStderr(&syncBuffer{}), withBackend(b))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+	defer fsm.Close()
+	rs := fsm.newReplicaSet(true)
+
+	// The stalled peer waits for the replica and then stops reading.
+	server, stalled := net.Pipe()
+	defer stalled.Close()
+	s := fsm.newSession(rs, server)
+	go s.Run()
+	r := bufio.NewReader(stalled)
+	r.ReadString('\n')
+	fmt.Fprintln(stalled, "VERSION 1")
+	fmt.Fprintln(stalled, "START replica /r")
+	r.ReadString('\n')
+	fmt.Fprintln(stalled, "DONE")
+	fmt.Fprintln(stalled, "WAIT replica")
+	waitFor(t, "the stalled peer to wait", func() bool {
+		return s.fsm.replicaWaiting.Has("replica")
+	})
+
+	server, client := net.Pipe()
+	c := newClient(t, client, client)
+	defer c.Close()
+	go func() {
+		fsm.newSession(rs, server).Run()
+		close(c.done)
+	}()
+	c.Handshake()
+	c.Start("replica", "/r", "")
+	c.Wait("replica")
+
+	// The other session is still told about changes.
+	for _, name := range []string{"a.txt", "b.txt"} {
+		b.Inject(t, "/r", fsmonitor.Event{Path: "/r/" + name, Flags: fsmonitor.EventCreated})
+		b.Sync(t, "/r")
+		c.ExpectNotification("replica")
+		c.ExpectChanges("replica", name)
+		c.Wait("replica")
+	}
+}
+
+func TestDaemonSocketChecks(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "daemon", "daemon.sock")
+
+	if err := MakeDaemonDir(path); err != nil {
+		t.Fatalf("MakeDaemonDir: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Dir(path)); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("Expecting a directory only the user can access, got %v %v", fi, err)
+	}
+	if err := CheckDaemonSocket(path); err != nil {
+		t.Errorf("Expecting a missing socket to be fine, got %v", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer ln.Close()
+	if err := CheckDaemonSocket(path); err != nil {
+		t.Errorf("Expecting the socket of the user to be fine, got %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0600)
+	if err := CheckDaemonSocket(file); err == nil {
+		t.Errorf("Expecting a file that is not a socket to be rejected")
+	}
+
+	// Only root can hand files to somebody else.
+	if os.Getuid() != 0 {
+		return
+	}
+	os.Lchown(path, 65534, 65534)
+	if err := CheckDaemonSocket(path); err == nil {
+		t.Errorf("Expecting the socket of another user to be rejected")
+	}
+	os.Chown(filepath.Dir(path), 65534, 65534)
+	if err := MakeDaemonDir(path); err == nil {
+		t.Errorf("Expecting the directory of another user to be rejected")
+	}
+}
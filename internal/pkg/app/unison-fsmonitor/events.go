@@ -1,100 +1,206 @@
-// +build darwin
-
 package unisonfsmonitor
 
 import (
-	"path/filepath"
-	"strings"
+	"context"
+	"sort"
+	"time"
 
-	"github.com/fsnotify/fsevents"
 	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
 )
 
-func (fsm *UnisonFSMonitor) eventHandler(replica string) {
-	var (
-		es    *fsevents.EventStream
-		end   chan empty
-		root  string
-		paths *set.Set
-		err   error
+// startMonitor creates the fsmonitor.Monitor that watches the replicas and
+// runs it until Close.
+func (fsm *UnisonFSMonitor) startMonitor() error {
+	m, err := fsmonitor.New(
+		fsmonitor.WithBackend(fsm.backend),
+		fsmonitor.WithCaseFolding(fsm.caseFolding),
+		fsmonitor.WithTrace(fsm.trace()),
+		fsmonitor.WithHandler(fsm.handleBatch),
 	)
+	if err != nil {
+		return err
+	}
 
-	if t, ok := fsm.replicaEventStream.Load(replica); ok {
-		es = t.(*fsevents.EventStream)
-	} else {
-		fsm.SendErr("Unable to find event stream for replica %s", replica)
+	ctx, cancel := context.WithCancel(context.Background())
+	fsm.monitor = m
+	fsm.stopMonitor = cancel
+	fsm.monitorDone = make(chan empty)
+	go func() {
+		defer close(fsm.monitorDone)
+		m.Run(ctx)
+	}()
+
+	return nil
+}
+
+// trace logs what the fsmonitor.Monitor does and keeps the metrics about it.
+func (fsm *UnisonFSMonitor) trace() fsmonitor.Trace {
+	return fsmonitor.Trace{
+		WatchStarted: func(root string, restarted bool) {
+			if restarted {
+				fsm.metrics.backendRestarts.Inc()
+			}
+			if fsm.debugEnabled() {
+				fsm.debug("Created %s watcher at path: %s", fsm.backend.Name(), root)
+			}
+		},
+		WatchShared: func(root string, r *fsmonitor.Replica) {
+			if fsm.debugEnabled() {
+				fsm.debug("Sharing the watcher at path %s with replica %s", root, r.Name())
+			}
+		},
+		WatchStopped: func(root string) {
+			if fsm.debugEnabled() {
+				fsm.debug("Stopped watcher at path: %s", root)
+			}
+		},
+		Events: func(root string, events []fsmonitor.Event) {
+			fsm.metrics.eventsReceived.Add(float64(len(events)))
+		},
+		Event: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			if fsm.debugEnabled() {
+				fsm.debug("Got FS event for %s (%s)", e.Path, e.Flags)
+			}
+		},
+		Rescan: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			// Nothing is known about what changed, so every watched path
+			// has to be rescanned by Unison.
+			fsm.warn("Rescanning replica %s after %s event for %s", r.Name(), e.Flags, e.Path)
+			if e.Flags&fsmonitor.EventOverflow != 0 {
+				fsm.metrics.overflows.Inc()
+			}
+		},
+		Filtered: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			fsm.metrics.eventsFiltered.With(filterOutsidePaths).Inc()
+		},
+		Ignored: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			fsm.metrics.eventsFiltered.With(filterIgnoreRules).Inc()
+		},
 	}
+}
 
-	if t, ok := fsm.replicaEndMonitoringChannel.Load(replica); ok {
-		end = t.(chan empty)
-	} else {
-		fsm.SendErr("Unable to find end monitoring channel for replica %s", replica)
+// handleBatch records the changes the fsmonitor.Monitor found for a replica
+// and notifies Unison if it is waiting for them.
+func (fsm *UnisonFSMonitor) handleBatch(b fsmonitor.Batch) {
+	if r, ok := fsm.watched.Load(b.Replica); ok {
+		fsm.addChanges(r.(*replica), b.Paths)
 	}
+}
 
-	if t, ok := fsm.replicaRoot.Load(replica); ok {
-		root = t.(string)
-	} else {
-		fsm.SendErr("Unable to find root for replica %s", replica)
+// addChanges records changed paths for the replica and notifies Unison if it
+// is waiting for them. Changes for a replica that has been reset are dropped;
+// its watch may deliver a few more events while it is torn down.
+func (fsm *UnisonFSMonitor) addChanges(r *replica, paths []string) {
+	fsm.changesMutex.Lock()
+	defer fsm.changesMutex.Unlock()
+
+	if r.removed {
+		return
 	}
 
-	if t, ok := fsm.replicaPaths.Load(replica); ok {
-		paths = t.(*set.Set)
+	// The replica may belong to the set of another session sharing the
+	// watch.
+	rs := r.owner
+
+	var changes *set.Set
+	if t, ok := rs.replicaChanges.Load(r.name); ok {
+		changes = t.(*set.Set)
 	} else {
-		fsm.SendErr("Unable to find paths for replica %s", replica)
+		changes = set.New()
+		rs.replicaChanges.Store(r.name, changes)
+		rs.replicaChangesSince.Store(r.name, time.Now())
+	}
+
+	for _, p := range paths {
+		changes.Add(p)
+	}
+	rs.notifyChangesLocked(r.name)
+}
+
+// takeChanges removes the pending changes of the replica and returns them
+// coalesced and in sorted order. Unison rescans the whole subtree of a path
+// reported with RECURSIVE, so reporting the descendants as well only adds
+// work.
+func (fsm *UnisonFSMonitor) takeChanges(replica string) []string {
+	fsm.changesMutex.Lock()
+	defer fsm.changesMutex.Unlock()
+
+	var changes []string
+	if c, ok := fsm.replicaChanges.Load(replica); ok {
+		raw := c.(*set.Set).StringSlice()
+		changes = fsmonitor.Coalesce(raw)
+		fsm.metrics.rollups.Add(float64(len(raw) - len(changes)))
+	}
+	if since, ok := fsm.replicaChangesSince.Load(replica); ok {
+		fsm.metrics.reportLatency.Observe(time.Since(since.(time.Time)).Seconds())
+	}
+	fsm.replicaChanges.Delete(replica)
+	fsm.replicaChangesSince.Delete(replica)
+	for s := range fsm.sessions {
+		s.replicaReportedChanges.Remove(replica)
+		s.notifications.Remove(replica)
+	}
+
+	return changes
+}
+
+// notifyChanges tells Unison that the replica has changes if the session is
+// waiting for them and has not been told yet. Both the main loop and the
+// event handlers notify, so the check happens under a lock to notify only
+// once. The notification is sent outside of it, as Unison may be slow to
+// read it.
+func (fsm *UnisonFSMonitor) notifyChanges(replica string) {
+	fsm.changesMutex.Lock()
+	_, pending := fsm.replicaChanges.Load(replica)
+	notify := pending && fsm.replicaWaiting.Has(replica) && !fsm.replicaReportedChanges.Has(replica)
+	if notify {
+		fsm.replicaReportedChanges.Add(replica)
+	}
+	fsm.changesMutex.Unlock()
+
+	if notify {
+		fsm.sendCmd("CHANGES", replica)
+	}
+}
+
+// notifyChangesLocked has the notifier of every session using the replica
+// set tell Unison that the replica has changes, if it is waiting for them and
+// has not been told yet. A session whose peer does not read holds up only
+// its own notifier. It must be called with the changes mutex held.
+func (rs *replicaSet) notifyChangesLocked(replica string) {
+	if _, ok := rs.replicaChanges.Load(replica); !ok {
+		return
+	}
+	for s := range rs.sessions {
+		if s.replicaWaiting.Has(replica) && !s.replicaReportedChanges.Has(replica) {
+			s.replicaReportedChanges.Add(replica)
+			s.notifications.Add(replica)
+			select {
+			case s.notify <- empty{}:
+			default:
+			}
+		}
 	}
+}
 
+// notifier sends the notifications of the session until it ends.
+func (fsm *UnisonFSMonitor) notifier() {
 	for {
 		select {
-		case events := <-es.Events:
-			var changes *set.Set
-			var relPath string
-			var fullPath string
-			var foundPath string
-
-			for _, event := range events {
-				if fsm.debugEnabled {
-					fsm.debug("Got FS event for %s\n", event.Path)
-				}
-
-				found := false
-				for _, bp := range paths.StringSlice() {
-					fullPath = filepath.Join(root, bp)
-					relPath, err = filepath.Rel(fullPath, event.Path)
-					if err != nil {
-						continue
-					}
-					if strings.HasPrefix(relPath, "../") {
-						continue
-					}
-					// We have found a match so join the base path and relative path
-					foundPath = filepath.Join(bp, relPath)
-					found = true
-					break
-				}
-				if !found {
-					continue
-				}
-
-				if t, ok := fsm.replicaChanges.Load(replica); ok {
-					changes = t.(*set.Set)
-				} else {
-					changes = set.New()
-					fsm.replicaChanges.Store(replica, changes)
-				}
-
-				changes.Add(foundPath)
-				if fsm.replicaWaiting.Has(replica) {
-					if !fsm.replicaReportedChanges.Has(replica) {
-						fsm.sendCmd("CHANGES", replica)
-						fsm.replicaReportedChanges.Add(replica)
-					}
-				}
-			}
-		case <-end:
-			if fsm.debugEnabled {
-				fsm.debug("Ending eventHandler for replica %s", replica)
-			}
+		case <-fsm.notify:
+		case <-fsm.sessionDone:
 			return
 		}
+
+		fsm.changesMutex.Lock()
+		replicas := fsm.notifications.StringSlice()
+		fsm.notifications.Clear()
+		fsm.changesMutex.Unlock()
+
+		sort.Strings(replicas)
+		for _, replica := range replicas {
+			fsm.sendCmd("CHANGES", replica)
+		}
 	}
 }
@@ -0,0 +1,201 @@
+package unisonfsmonitor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+func TestEventFiltering(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo")
+	c.Start("replica", "/r", "bar")
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/baz/b.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/bar", Flags: fsmonitor.EventModified | fsmonitor.EventIsDir},
+		fsmonitor.Event{Path: "/r", Flags: fsmonitor.EventModified | fsmonitor.EventIsDir},
+		fsmonitor.Event{Path: "/r/foobar", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+
+	c.ExpectChanges("replica", "bar", "foo/a.txt")
+	c.ExpectChanges("replica")
+}
+
+func TestEventCoalescing(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo")
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a/b.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/foo/a/b.txt", Flags: fsmonitor.EventModified},
+	)
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a", Flags: fsmonitor.EventModified | fsmonitor.EventIsDir},
+		fsmonitor.Event{Path: "/r/foo/c.txt", Flags: fsmonitor.EventRemoved},
+	)
+	b.Sync(t, "/r")
+
+	c.ExpectChanges("replica", "foo/a", "foo/c.txt")
+}
+
+func TestEventOverflow(t *testing.T) {
+	t.Parallel()
+
+	tables := []fsmonitor.EventFlags{fsmonitor.EventOverflow | fsmonitor.EventMustScanSubDirs, fsmonitor.EventRootChanged}
+
+	for _, flags := range tables {
+		b := fsmonitortest.NewBackend()
+		c := newUnisonClient(t, withBackend(b))
+
+		c.Handshake()
+		c.Start("replica", "/r", "foo")
+		c.Start("replica", "/r", "bar")
+
+		// The path of an overflow says nothing about what changed.
+		b.Inject(t, "/r",
+			fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated},
+			fsmonitor.Event{Path: "/", Flags: flags},
+		)
+		b.Sync(t, "/r")
+
+		c.ExpectChanges("replica", "bar", "foo")
+		c.Close()
+	}
+}
+
+func TestMustScanSubDirs(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo")
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a/b.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/foo/a", Flags: fsmonitor.EventMustScanSubDirs},
+	)
+	b.Sync(t, "/r")
+
+	c.ExpectChanges("replica", "foo/a")
+}
+
+func TestWaitNotification(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo")
+	c.Wait("replica")
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated})
+	c.ExpectNotification("replica")
+
+	// Unison is only told once until it asks for the changes.
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/foo/b.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+	c.ExpectNoOutput(100 * time.Millisecond)
+
+	c.ExpectChanges("replica", "foo/a.txt", "foo/b.txt")
+
+	c.Wait("replica")
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/foo/c.txt", Flags: fsmonitor.EventCreated})
+	c.ExpectNotification("replica")
+	c.ExpectChanges("replica", "foo/c.txt")
+}
+
+func TestWaitWithPendingChanges(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo")
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+
+	c.Wait("replica")
+	c.ExpectNotification("replica")
+	c.ExpectChanges("replica", "foo/a.txt")
+}
+
+func TestWaitCancelledByOtherCommand(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo")
+	c.Wait("replica")
+	c.ExpectChanges("replica")
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+	c.ExpectNoOutput(100 * time.Millisecond)
+	c.ExpectChanges("replica", "foo/a.txt")
+}
+
+func TestChangesPerReplica(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("one", "/r1", "")
+	c.Start("two", "/r2", "")
+
+	b.Inject(t, "/r1", fsmonitor.Event{Path: "/r1/a.txt", Flags: fsmonitor.EventCreated})
+	b.Inject(t, "/r2", fsmonitor.Event{Path: "/r2/b.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r1")
+	b.Sync(t, "/r2")
+
+	c.Wait("one", "two")
+	c.ExpectNotification("one")
+	c.ExpectNotification("two")
+
+	c.ExpectChanges("one", "a.txt")
+	c.ExpectChanges("two", "b.txt")
+}
+
+func TestStartBackendFailure(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	b.Fail(errors.New("out of watches"))
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Send("START", "replica", "/r", "foo")
+	c.Expect("ERROR Unable%20to%20watch%20/r:%20out%20of%20watches")
+}
@@ -0,0 +1,218 @@
+// +build go1.18
+
+package unisonfsmonitor
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/transcript"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// maxFuzzLines bounds the length of a fuzzed session to keep every run fast.
+const maxFuzzLines = 64
+
+// errorLine stands for any ERROR line in the output of the protocolModel.
+// The model does not predict the wording of error messages.
+const errorLine = "ERROR"
+
+// protocolModel is a reference model of the fsmonitor protocol as spoken by
+// the monitor when no filesystem events happen. Given the lines sent by
+// Unison, it predicts the lines the monitor sends back.
+type protocolModel struct {
+	handshaken bool
+	starting   bool
+	stopped    bool
+	replicas   map[string]bool
+}
+
+func newProtocolModel() *protocolModel {
+	return &protocolModel{replicas: make(map[string]bool)}
+}
+
+// greeting returns what the monitor sends before reading any input.
+func (m *protocolModel) greeting() []string {
+	return []string{"VERSION 1"}
+}
+
+// step returns the lines the monitor sends in response to a line.
+func (m *protocolModel) step(line string) []string {
+	if m.stopped {
+		return nil
+	}
+
+	cmd, args, err := parseCmd(line)
+	if err != nil {
+		return m.fail()
+	}
+
+	switch {
+	case !m.handshaken:
+		if cmd != "VERSION" || len(args) != 1 {
+			return m.fail()
+		}
+		if _, err := strconv.ParseFloat(args[0], 64); err != nil {
+			return m.fail()
+		}
+		m.handshaken = true
+		return nil
+	case m.starting:
+		switch cmd {
+		case "DIR":
+			return []string{"OK"}
+		case "DONE":
+			m.starting = false
+			return nil
+		default:
+			// LINK is not supported and anything else is unknown.
+			return m.fail()
+		}
+	}
+
+	switch cmd {
+	case "DEBUG", "QUIT":
+		return nil
+	case "START":
+		if len(args) != 2 && len(args) != 3 {
+			return m.fail()
+		}
+		m.replicas[args[0]] = true
+		m.starting = true
+		return []string{"OK"}
+	case "WAIT":
+		if len(args) != 1 || !m.replicas[args[0]] {
+			return m.fail()
+		}
+		return nil
+	case "CHANGES":
+		if len(args) != 1 {
+			return m.fail()
+		}
+		return []string{"DONE"}
+	case "RESET":
+		if len(args) != 1 || !m.replicas[args[0]] {
+			return m.fail()
+		}
+		delete(m.replicas, args[0])
+		return nil
+	default:
+		return m.fail()
+	}
+}
+
+func (m *protocolModel) fail() []string {
+	m.stopped = true
+	return []string{errorLine}
+}
+
+// matchOutput compares the output of the monitor against the prediction of
+// the model.
+func matchOutput(expected, actual []string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if expected[i] == errorLine {
+			if !strings.HasPrefix(actual[i], "ERROR ") {
+				return false
+			}
+			continue
+		}
+		if expected[i] != actual[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzParseCmd(f *testing.F) {
+	for _, seed := range []string{
+		"VERSION 1\n",
+		"START replica /tmp/root%20dir sub%2Fdir\n",
+		"DIR  double%20space\n",
+		"WAIT %\n",
+		"RECURSIVE %E2%82%AC%FF\n",
+		"\t\n",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		cmd, args, err := parseCmd(line)
+		if err != nil {
+			return
+		}
+
+		// Quoting the parsed command again must give back the same command.
+		formatted := formatCmd(cmd, args...)
+		cmd2, args2, err := parseCmd(formatted)
+		if err != nil {
+			t.Fatalf("parseCmd(%q) of formatted %q: %v", line, formatted, err)
+		}
+		if cmd != cmd2 || !reflect.DeepEqual(args, args2) {
+			t.Fatalf("Round trip of %q through %q: expecting: %q %q, got: %q %q", line, formatted, cmd, args, cmd2, args2)
+		}
+		if strings.Contains(formatted, "\n") != strings.Contains(cmd, "\n") {
+			t.Fatalf("Formatted %q contains a newline from an argument", formatted)
+		}
+	})
+}
+
+func FuzzSession(f *testing.F) {
+	for _, seed := range []string{
+		"VERSION 1\nSTART a /r foo\nDIR bar\nDONE\nWAIT a\nCHANGES a\nRESET a",
+		"VERSION 1\nSTART a /r\nDONE\nRESET a\nRESET a",
+		"VERSION 1\nSTART a /r foo bar baz\nWAIT a",
+		"VERSION 1\nWAIT\nCHANGES a",
+		"VERSION 1\nSTART a /r\nLINK x\nDONE",
+		"VERSION 2\nSTART a%20b /r%2Fs\nDONE\nWAIT a%20b\nQUIT\nDEBUG",
+		"VERSION x",
+		"VERSION\n",
+		"VERSION 1\nCHANGES %zz",
+		"VERSION 1\n\n",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		lines := strings.Split(input, "\n")
+		if len(lines) > maxFuzzLines {
+			lines = lines[:maxFuzzLines]
+		}
+
+		model := newProtocolModel()
+		expected := model.greeting()
+		session := make([]transcript.Entry, len(lines))
+		for i, line := range lines {
+			session[i] = transcript.Entry{Direction: transcript.Received, Line: line}
+			expected = append(expected, model.step(line)...)
+		}
+
+		type result struct {
+			output []string
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			output, err := Replay(session, withBackend(fsmonitortest.NewBackend()), withStderr(ioutil.Discard))
+			done <- result{output, err}
+		}()
+
+		select {
+		case r := <-done:
+			if r.err != nil {
+				t.Fatalf("Replay(): %v", r.err)
+			}
+			if !matchOutput(expected, r.output) {
+				t.Fatalf("Session %q:\nexpecting: %q\ngot:       %q", lines, expected, r.output)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Session %q did not finish", lines)
+		}
+	})
+}
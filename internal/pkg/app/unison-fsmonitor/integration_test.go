@@ -4,14 +4,32 @@
 package unisonfsmonitor
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"testing"
-	"time"
 )
 
+// syncReplica writes a marker file below the watched path and waits until the
+// monitor reports it. Once it has been reported, every event that happened
+// before it has been processed as well, so the test can start from a clean
+// slate without sleeping.
+func syncReplica(c *unisonClient, replica, dir, watched string) {
+	c.t.Helper()
+
+	marker := path.Join(watched, ".sync")
+	if err := ioutil.WriteFile(path.Join(dir, marker), nil, 0600); err != nil {
+		c.t.Fatalf("Unable to write marker file: %v", err)
+	}
+	c.Wait(replica)
+	c.ExpectNotification(replica)
+
+	// Drain whatever was pending, including the marker itself.
+	c.Send("CHANGES", replica)
+	for c.ReadLine() != "DONE" {
+	}
+}
+
 func TestIntegration(t *testing.T) {
 	dir := makeTempDir(t)
 	defer os.RemoveAll(dir)
@@ -20,62 +38,42 @@ func TestIntegration(t *testing.T) {
 	os.Mkdir(path.Join(dir, "foo", "foo2"), 0700)
 	os.Mkdir(path.Join(dir, "bar"), 0700)
 	os.Mkdir(path.Join(dir, "baz"), 0700)
-	// The granularity of the FSEvents is .5 seconds so this should be enough
-	// to ensure we don't see these events below.
-	time.Sleep(1 * time.Second)
-
-	fsm, err := makeUnisonFSMonitor(setStdinPipe)
-	if err != nil {
-		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
-	}
 
-	go fsm.Run()
+	c := newUnisonClient(t)
+	defer c.Close()
 
-	stdinWriter.Write([]byte("VERSION 1\n"))
+	c.Handshake()
 
-	// Creat a replica based on our test directoy.
-	stdinWriter.Write([]byte("DEBUG\n"))
-	stdinWriter.Write([]byte(fmt.Sprintf("START test_replica %s %s\n", dir, "foo")))
-	stdinWriter.Write([]byte("DIR foo2\n"))
-	stdinWriter.Write([]byte("DONE\n"))
-	stdinWriter.Write([]byte(fmt.Sprintf("START test_replica %s %s\n", dir, "bar")))
-	stdinWriter.Write([]byte("DONE\n"))
-	stdinWriter.Write([]byte("WAIT test_replica\n"))
+	// Create a replica based on our test directory.
+	c.Start("test_replica", dir, "foo", "foo2")
+	c.Start("test_replica", dir, "bar")
+	syncReplica(c, "test_replica", dir, "foo")
 
+	c.Wait("test_replica")
 	ioutil.WriteFile(path.Join(dir, "foo", "foo.txt"), nil, 0600)
 	ioutil.WriteFile(path.Join(dir, "foo", "foo2", "foo2.txt"), nil, 0600)
 	ioutil.WriteFile(path.Join(dir, "bar", "bar.txt"), nil, 0600)
 	// We should not see a change for baz.txt
 	ioutil.WriteFile(path.Join(dir, "baz", "baz.txt"), nil, 0600)
+	c.ExpectNotification("test_replica")
 
-	// Ensure the FSEvents are processed before continuing.
-	time.Sleep(1 * time.Second)
-
-	stdinWriter.Write([]byte("CHANGES test_replica\n"))
+	c.ExpectEventualChanges("test_replica", "bar/bar.txt", "foo/foo.txt", "foo/foo2/foo2.txt")
 	// There should no longer be changes
-	stdinWriter.Write([]byte("CHANGES test_replica\n"))
+	c.ExpectChanges("test_replica")
 
 	// Reset the replica and create another one.
-	stdinWriter.Write([]byte("RESET test_replica\n"))
-	stdinWriter.Write([]byte(fmt.Sprintf("START test_replica %s %s\n", dir, "foo")))
-	stdinWriter.Write([]byte("DIR foo2\n"))
-	stdinWriter.Write([]byte("DONE\n"))
-	stdinWriter.Write([]byte(fmt.Sprintf("START test_replica %s %s\n", dir, "bar")))
-	stdinWriter.Write([]byte("DONE\n"))
-
-	stdinWriter.Write([]byte(fmt.Sprintf("START test_replica2 %s %s\n", dir, "baz")))
-	stdinWriter.Write([]byte("DONE\n"))
-
-	ioutil.WriteFile(path.Join(dir, "foo", "foo.txt"), nil, 0600)
-	ioutil.WriteFile(path.Join(dir, "bar", "bar.txt"), nil, 0600)
-	ioutil.WriteFile(path.Join(dir, "baz", "baz.txt"), nil, 0600)
-
-	// Ensure the FSEvents are processed before continuing.
-	time.Sleep(1 * time.Second)
-
-	stdinWriter.Write([]byte("CHANGES test_replica\n"))
-	// We should not see these changes because of the reset
-	stdinWriter.Write([]byte("CHANGES test_replica2\n"))
-
-	stdinWriter.Write([]byte("QUIT\n"))
+	c.Reset("test_replica")
+	c.Start("test_replica", dir, "foo", "foo2")
+	c.Start("test_replica", dir, "bar")
+	c.Start("test_replica2", dir, "baz")
+	syncReplica(c, "test_replica", dir, "foo")
+	syncReplica(c, "test_replica2", dir, "baz")
+
+	c.Wait("test_replica2")
+	ioutil.WriteFile(path.Join(dir, "baz", "baz.txt"), []byte("baz"), 0600)
+	c.ExpectNotification("test_replica2")
+
+	// Changes are tracked per replica.
+	c.ExpectChanges("test_replica")
+	c.ExpectEventualChanges("test_replica2", "baz/baz.txt")
 }
@@ -0,0 +1,143 @@
+package unisonfsmonitor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Listener accepts protocol sessions on a Unix domain socket and runs them
+// concurrently.
+type Listener struct {
+	fsm *UnisonFSMonitor
+	ln  net.Listener
+	// shared is the replica set all sessions use, if they do not get
+	// their own.
+	shared   *replicaSet
+	sessions *sync.WaitGroup
+}
+
+// Listen listens for sessions on the Unix domain socket at path. Every session
+// has its own replicas, as if it had a monitor of its own, but the watches are
+// shared.
+func (fsm *UnisonFSMonitor) Listen(path string) (*Listener, error) {
+	return fsm.listen(path, nil)
+}
+
+func (fsm *UnisonFSMonitor) listen(path string, shared *replicaSet) (*Listener, error) {
+	// Like the status socket, only take over a socket nobody answers on.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("Session socket %s is in use by another monitor", path)
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on session socket: %v", err)
+	}
+	// The sessions can watch anything the monitor can read, so keep other
+	// users out.
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("Unable to set the permissions of the session socket: %v", err)
+	}
+
+	l := &Listener{
+		fsm:      fsm,
+		ln:       ln,
+		shared:   shared,
+		sessions: &sync.WaitGroup{},
+	}
+
+	fsm.changesMutex.Lock()
+	fsm.listeners[l] = empty{}
+	fsm.changesMutex.Unlock()
+
+	// The monitor may have been closed while the listener was set up.
+	if fsm.isClosed() {
+		l.Close()
+	}
+
+	return l, nil
+}
+
+// Addr returns the address of the socket.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Serve accepts sessions until the listener or the monitor is closed, and
+// then waits for the sessions it started to end.
+func (l *Listener) Serve() error {
+	l.fsm.info("Listening for sessions on %s", l.Addr())
+	defer l.sessions.Wait()
+
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return nil
+			}
+			return fmt.Errorf("Unable to accept a session: %v", err)
+		}
+
+		rs := l.shared
+		if rs == nil {
+			rs = l.fsm.newReplicaSet(false)
+		}
+		s := l.fsm.newSession(rs, conn)
+
+		l.sessions.Add(1)
+		go func() {
+			defer l.sessions.Done()
+			s.Run()
+		}()
+	}
+}
+
+// isClosed tells whether the listener or its monitor was closed.
+func (l *Listener) isClosed() bool {
+	l.fsm.changesMutex.Lock()
+	defer l.fsm.changesMutex.Unlock()
+
+	_, ok := l.fsm.listeners[l]
+	return !ok
+}
+
+// Close stops accepting sessions. The sessions already running go on.
+// Closing a Unix listener also removes its socket file.
+func (l *Listener) Close() error {
+	l.fsm.changesMutex.Lock()
+	delete(l.fsm.listeners, l)
+	l.fsm.changesMutex.Unlock()
+
+	return l.ln.Close()
+}
+
+// closeListeners closes every listener of the monitor.
+func (st *state) closeListeners() {
+	st.changesMutex.Lock()
+	listeners := make([]*Listener, 0, len(st.listeners))
+	for l := range st.listeners {
+		listeners = append(listeners, l)
+	}
+	st.changesMutex.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// endSessions shuts down every session of the monitor.
+func (st *state) endSessions() {
+	st.changesMutex.Lock()
+	defer st.changesMutex.Unlock()
+
+	for rs := range st.replicaSets {
+		for s := range rs.sessions {
+			s.shutdown()
+		}
+	}
+}
@@ -1,12 +1,74 @@
-// +build darwin
-
 package unisonfsmonitor
 
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
+)
+
+type logLevel int32
+
+// Log levels in increasing order of verbosity. A message is output when its
+// level is less than or equal to the current level of the monitor.
+const (
+	levelWarn logLevel = iota
+	levelInfo
+	levelDebug
 )
 
+var logLevelNames = map[logLevel]string{
+	levelWarn:  "warn",
+	levelInfo:  "info",
+	levelDebug: "debug",
+}
+
+func (l logLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for level, name := range logLevelNames {
+		if s == name {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("Unknown log level: %q (expected warn, info or debug)", s)
+}
+
+func (fsm *UnisonFSMonitor) getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&fsm.logLevel))
+}
+
+func (fsm *UnisonFSMonitor) setLogLevel(l logLevel) {
+	atomic.StoreInt32(&fsm.logLevel, int32(l))
+}
+
+// adjustLogLevel raises or lowers the log level by delta, clamping the result
+// to the known levels, and returns the new level.
+func (fsm *UnisonFSMonitor) adjustLogLevel(delta int32) logLevel {
+	for {
+		old := atomic.LoadInt32(&fsm.logLevel)
+		l := old + delta
+		if l < int32(levelWarn) {
+			l = int32(levelWarn)
+		}
+		if l > int32(levelDebug) {
+			l = int32(levelDebug)
+		}
+		if atomic.CompareAndSwapInt32(&fsm.logLevel, old, l) {
+			return logLevel(l)
+		}
+	}
+}
+
+func (fsm *UnisonFSMonitor) debugEnabled() bool {
+	return fsm.getLogLevel() >= levelDebug
+}
+
 func (fsm *UnisonFSMonitor) logger(level, format string, a ...interface{}) {
 	var msg string
 
@@ -19,7 +81,9 @@ func (fsm *UnisonFSMonitor) logger(level, format string, a ...interface{}) {
 }
 
 func (fsm *UnisonFSMonitor) info(format string, a ...interface{}) {
-	fsm.logger("INFO", format, a...)
+	if fsm.getLogLevel() >= levelInfo {
+		fsm.logger("INFO", format, a...)
+	}
 }
 
 func (fsm *UnisonFSMonitor) warn(format string, a ...interface{}) {
@@ -27,5 +91,7 @@ func (fsm *UnisonFSMonitor) warn(format string, a ...interface{}) {
 }
 
 func (fsm *UnisonFSMonitor) debug(format string, a ...interface{}) {
-	fsm.logger("DEBUG", format, a...)
+	if fsm.debugEnabled() {
+		fsm.logger("DEBUG", format, a...)
+	}
 }
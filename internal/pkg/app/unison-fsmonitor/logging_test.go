@@ -1,9 +1,9 @@
-// +build darwin
-
 package unisonfsmonitor
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"testing"
 )
 
@@ -41,48 +41,149 @@ func makeLoggerTestTable(level string) []testLoggerBaseTables {
 }
 
 func loggerTest(t *testing.T, level string) {
-	fsm, err := makeUnisonFSMonitor(setStderrBuffer)
+	var stderr bytes.Buffer
+
+	fsm, err := makeUnisonFSMonitor(withStderr(&stderr), WithLogLevel("debug"))
 	if err != nil {
 		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
 	}
 
-	table := makeLoggerTestTable("INFO")
+	log := map[string]func(string, ...interface{}){
+		"INFO":  fsm.info,
+		"WARN":  fsm.warn,
+		"DEBUG": fsm.debug,
+	}[level]
+
+	table := makeLoggerTestTable(level)
 	for _, row := range table {
 		args := make([]interface{}, len(row.args))
 		for i, v := range row.args {
 			args[i] = v
 		}
 
-		fsm.info(row.format, args...)
-		flushStderrBuffer(fsm)
-		strout := stringifyStderrBuffer()
+		log(row.format, args...)
+		strout := stderr.String()
 		if strout != row.expected {
 			t.Errorf("Expecting: %s, got: %s", row.expected, strout)
 		}
-		resetStderrBuffer()
+		stderr.Reset()
 	}
 }
 
 func TestInfo(t *testing.T) {
+	t.Parallel()
+
 	loggerTest(t, "INFO")
 }
 
 func TestWarn(t *testing.T) {
+	t.Parallel()
+
 	loggerTest(t, "WARN")
 }
 
 func TestDebug(t *testing.T) {
+	t.Parallel()
+
 	loggerTest(t, "DEBUG")
 }
 
 func BenchmarkLogger(b *testing.B) {
-	fsm, err := makeUnisonFSMonitor(setStderrBuffer)
+	fsm, err := makeUnisonFSMonitor(withStderr(ioutil.Discard))
 	if err != nil {
 		b.Fatalf("Failure creating UnisonFSMonitor: %v", err)
 	}
 
 	for n := 0; n < b.N; n++ {
-		fsm.logger("Log with arguments: %s %s", "argument1", "argument2")
-		resetStderrBuffer()
+		fsm.logger("INFO", "Log with arguments: %s %s", "argument1", "argument2")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		level    string
+		expected logLevel
+		err      bool
+	}{
+		{level: "warn", expected: levelWarn},
+		{level: "INFO", expected: levelInfo},
+		{level: " debug ", expected: levelDebug},
+		{level: "verbose", expected: levelInfo, err: true},
+	}
+
+	for _, table := range tables {
+		l, err := parseLogLevel(table.level)
+		if (err != nil) != table.err {
+			t.Errorf("parseLogLevel(%q): unexpected error state: %v", table.level, err)
+		}
+		if l != table.expected {
+			t.Errorf("parseLogLevel(%q): expecting: %s, got: %s", table.level, table.expected, l)
+		}
+	}
+}
+
+func TestAdjustLogLevel(t *testing.T) {
+	t.Parallel()
+
+	fsm, err := makeUnisonFSMonitor(WithLogLevel("warn"))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+
+	steps := []struct {
+		delta    int32
+		expected logLevel
+	}{
+		{delta: -1, expected: levelWarn},
+		{delta: 1, expected: levelInfo},
+		{delta: 1, expected: levelDebug},
+		{delta: 1, expected: levelDebug},
+		{delta: -1, expected: levelInfo},
+	}
+
+	for _, step := range steps {
+		if l := fsm.adjustLogLevel(step.delta); l != step.expected {
+			t.Errorf("Expecting: %s, got: %s", step.expected, l)
+		}
+	}
+}
+
+func TestLogLevelFiltering(t *testing.T) {
+	t.Parallel()
+
+	var stderr bytes.Buffer
+
+	fsm, err := makeUnisonFSMonitor(withStderr(&stderr), WithLogLevel("warn"))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+
+	fsm.debug("hidden debug")
+	fsm.info("hidden info")
+	fsm.warn("shown warn")
+	fsm.setLogLevel(levelDebug)
+	fsm.debug("shown debug")
+
+	expected := "[WARN] shown warn\n[DEBUG] shown debug\n"
+	if strout := stderr.String(); strout != expected {
+		t.Errorf("Expecting: %q, got: %q", expected, strout)
+	}
+}
+
+func TestWithLogLevel(t *testing.T) {
+	t.Parallel()
+
+	if _, err := makeUnisonFSMonitor(WithLogLevel("loud")); err == nil {
+		t.Errorf("Expected an error for an unknown log level")
+	}
+
+	fsm, err := makeUnisonFSMonitor(WithLogLevel(""))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+	if l := fsm.getLogLevel(); l != levelInfo {
+		t.Errorf("Expecting default level: %s, got: %s", levelInfo, l)
 	}
 }
@@ -0,0 +1,134 @@
+package unisonfsmonitor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/metrics"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+// metricsPrefix starts the name of every metric of the monitor.
+const metricsPrefix = "unison_fsmonitor_"
+
+// The rules events are filtered by, as used in the rule label of the
+// events_filtered_total metric.
+const (
+	filterOutsidePaths = "outside_paths"
+	filterIgnoreRules  = "ignore_rules"
+)
+
+func newMonitorMetrics(fsm *UnisonFSMonitor) *monitorMetrics {
+	r := metrics.NewRegistry()
+
+	m := &monitorMetrics{
+		registry:        r,
+		eventsReceived:  r.NewCounter(metricsPrefix+"events_received_total", "Filesystem events received from the backend."),
+		eventsFiltered:  r.NewCounterVec(metricsPrefix+"events_filtered_total", "Filesystem events dropped, by the rule that dropped them.", "rule"),
+		overflows:       r.NewCounter(metricsPrefix+"overflows_total", "Events telling that the backend dropped events, forcing a rescan."),
+		changesReported: r.NewCounter(metricsPrefix+"changes_reported_total", "Paths reported to Unison with RECURSIVE."),
+		changesRequests: r.NewCounter(metricsPrefix+"changes_requests_total", "CHANGES round trips with Unison."),
+		rollups:         r.NewCounter(metricsPrefix+"rollups_total", "Changed paths not reported because an ancestor was reported instead."),
+		commandsSent:    r.NewCounterVec(metricsPrefix+"commands_sent_total", "Protocol commands sent to Unison, by command.", "command"),
+		backendRestarts: r.NewCounter(metricsPrefix+"backend_restarts_total", "Backend watches started again for a root that was watched before."),
+		reportLatency:   r.NewHistogram(metricsPrefix+"report_latency_seconds", "Time from the first event of a change set to reporting it to Unison.", nil),
+	}
+
+	r.NewGaugeFunc(metricsPrefix+"replicas", "Replicas being monitored.", func() float64 {
+		n := 0
+		fsm.rangeReplicas(func(r *replica) bool {
+			n++
+			return true
+		})
+		return float64(n)
+	})
+	r.NewGaugeFunc(metricsPrefix+"pending_changes", "Changed paths not yet reported to Unison.", func() float64 {
+		sets := fsm.allReplicaSets()
+
+		fsm.changesMutex.Lock()
+		defer fsm.changesMutex.Unlock()
+
+		n := 0
+		for _, rs := range sets {
+			rs.replicaChanges.Range(func(k, v interface{}) bool {
+				n += v.(*set.Set).Size()
+				return true
+			})
+		}
+		return float64(n)
+	})
+
+	return m
+}
+
+// parseMetricsAddress returns the network and address to serve the metrics
+// on. The address is either a loopback host:port or the path of a Unix domain
+// socket, optionally prefixed with "unix:". The metrics describe the paths
+// being watched, so they are never served on other interfaces.
+func parseMetricsAddress(address string) (string, string, error) {
+	if strings.HasPrefix(address, "unix:") || strings.Contains(address, "/") {
+		return "unix", strings.TrimPrefix(address, "unix:"), nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid metrics address %s: %v", address, err)
+	}
+	if !isLoopback(host) {
+		return "", "", fmt.Errorf("Metrics address %s is not a loopback address", address)
+	}
+	return "tcp", address, nil
+}
+
+// listenMetrics serves the metrics in the Prometheus text format on address.
+// When it is a directory, every monitor gets its own socket in it.
+func (fsm *UnisonFSMonitor) listenMetrics(address string) error {
+	network, address, err := parseMetricsAddress(address)
+	if err != nil {
+		return err
+	}
+
+	if network == "unix" {
+		address = socketPath(address, ".metrics")
+
+		// Like the status socket, only take over a socket nobody answers
+		// on.
+		if conn, err := net.Dial("unix", address); err == nil {
+			conn.Close()
+			return fmt.Errorf("Metrics socket %s is in use by another monitor", address)
+		}
+		os.Remove(address)
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for metrics: %v", err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			ln.Close()
+			return fmt.Errorf("Unable to set the permissions of the metrics socket: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", fsm.metrics.registry)
+	fsm.metricsServer = &http.Server{Handler: mux}
+	go fsm.metricsServer.Serve(ln)
+
+	if fsm.debugEnabled() {
+		fsm.debug("Serving metrics on %s", ln.Addr())
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,164 @@
+package unisonfsmonitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// scrape fetches the metrics served on a Unix domain socket.
+func scrape(t *testing.T, socket string) string {
+	t.Helper()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://monitor/metrics")
+	if err != nil {
+		t.Fatalf("Unable to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status scraping metrics: %s", resp.Status)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	return buf.String()
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "metrics.sock")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithMetrics("unix:"+socket))
+	defer c.Close()
+	defer c.fsm.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo")
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a", Flags: fsmonitor.EventModified | fsmonitor.EventIsDir},
+		fsmonitor.Event{Path: "/r/foo/a/b.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/bar/c.txt", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+	c.Wait("replica")
+	c.ExpectNotification("replica")
+
+	out := scrape(t, socket)
+	for _, expected := range []string{
+		"unison_fsmonitor_replicas 1\n",
+		"unison_fsmonitor_pending_changes 2\n",
+		"unison_fsmonitor_events_received_total 3\n",
+		`unison_fsmonitor_events_filtered_total{rule="outside_paths"} 1` + "\n",
+		`unison_fsmonitor_commands_sent_total{command="CHANGES"} 1` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the metrics:\n%s", expected, out)
+		}
+	}
+
+	c.ExpectChanges("replica", "foo/a")
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r", Flags: fsmonitor.EventOverflow})
+	b.Sync(t, "/r")
+	c.ExpectChanges("replica", "foo")
+
+	out = scrape(t, socket)
+	for _, expected := range []string{
+		"unison_fsmonitor_pending_changes 0\n",
+		"unison_fsmonitor_overflows_total 1\n",
+		"unison_fsmonitor_changes_requests_total 2\n",
+		"unison_fsmonitor_changes_reported_total 2\n",
+		"unison_fsmonitor_rollups_total 1\n",
+		"unison_fsmonitor_report_latency_seconds_count 2\n",
+		`unison_fsmonitor_commands_sent_total{command="RECURSIVE"} 2` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the metrics:\n%s", expected, out)
+		}
+	}
+}
+
+func TestMetricsSocketDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	fsm, err := makeUnisonFSMonitor(WithMetrics(dir))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+
+	socket := filepath.Join(dir, fmt.Sprintf("unison-fsmonitor-%d.metrics", os.Getpid()))
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Expected a socket only its owner can access, got: %v, %v", fi, err)
+	}
+	scrape(t, socket)
+
+	// A second monitor neither takes over the socket in use nor fails.
+	stderr := &syncBuffer{}
+	other, err := makeUnisonFSMonitor(withStderr(stderr), WithMetrics(dir))
+	if err != nil {
+		t.Fatalf("Expected a monitor without metrics, got: %v", err)
+	}
+	other.Close()
+	if !strings.Contains(stderr.String(), "in use by another monitor") {
+		t.Errorf("Expected a warning about the socket in use, got: %q", stderr.String())
+	}
+	scrape(t, socket)
+
+	if err := fsm.Close(); err != nil {
+		t.Errorf("Unable to close the monitor: %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got: %v", err)
+	}
+}
+
+func TestMetricsAddress(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		address string
+		err     bool
+	}{
+		{address: "127.0.0.1:0"},
+		{address: "localhost:0"},
+		{address: "[::1]:0"},
+		{address: "0.0.0.0:9547", err: true},
+		{address: ":9547", err: true},
+		{address: "example.com:9547", err: true},
+		{address: "no-port", err: true},
+	}
+
+	for _, table := range tables {
+		fsm, err := makeUnisonFSMonitor(WithMetrics(table.address))
+		if (err != nil) != table.err {
+			t.Errorf("WithMetrics(%q): unexpected error state: %v", table.address, err)
+		}
+		if err == nil {
+			fsm.Close()
+		}
+	}
+}
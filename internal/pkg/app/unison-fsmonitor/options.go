@@ -0,0 +1,113 @@
+package unisonfsmonitor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/sink"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/transcript"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// WithLogLevel sets the initial log level of the monitor. Valid levels are
+// "warn", "info" and "debug". An empty string leaves the default in place.
+func WithLogLevel(level string) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		if level == "" {
+			return nil
+		}
+		l, err := parseLogLevel(level)
+		if err != nil {
+			return err
+		}
+		fsm.setLogLevel(l)
+		return nil
+	}
+}
+
+// WithTranscript records every line received from and sent to Unison, with
+// a timestamp and its direction, to w.
+func WithTranscript(w io.Writer) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		fsm.transcript = transcript.NewRecorder(w)
+		return nil
+	}
+}
+
+// WithStatusSocket serves a JSON snapshot of the monitor's state on a Unix
+// domain socket at path. When path is a directory, the socket is created in
+// it and named after the process ID. The socket is removed by Close.
+func WithStatusSocket(path string) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		return fsm.listenStatus(path)
+	}
+}
+
+// WithMetrics serves metrics in the Prometheus text format at /metrics on
+// address. The address is either a loopback host:port, such as
+// "127.0.0.1:9547", or the path of a Unix domain socket. When the path is a
+// directory, every monitor gets its own socket in it. Failing to listen only
+// logs a warning, so that Unison keeps its monitor.
+func WithMetrics(address string) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		if _, _, err := parseMetricsAddress(address); err != nil {
+			return err
+		}
+		fsm.metricsAddress = address
+		return nil
+	}
+}
+
+// WithSnapshotDir keeps a snapshot of the state of every replica's tree in
+// dir. The snapshots are saved by Close and every interval, unless interval
+// is zero. When a replica is started, whatever changed since its snapshot
+// was saved is reported to Unison as pending changes.
+func WithSnapshotDir(dir string, interval time.Duration) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("Unable to create snapshot dir: %v", err)
+		}
+		fsm.snapshotDir = dir
+		fsm.snapshotInterval = interval
+		return nil
+	}
+}
+
+// WithWatchmanSocket serves a subset of Watchman's JSON protocol on a Unix
+// domain socket at path, for tools that query Watchman for the files changed
+// since a clock. The roots they watch share the watches of the monitor. The
+// socket is removed by Close.
+func WithWatchmanSocket(path string) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		fsm.watchmanSocket = path
+		return nil
+	}
+}
+
+// WithSink hands the coalesced changes of the replicas of Unison to s, as
+// well as telling Unison about them. Each sink gets the changes on its own,
+// so a slow sink does not hold up the others. The sink is closed by Close.
+func WithSink(s sink.Sink) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		fsm.sinks = append(fsm.sinks, s)
+		return nil
+	}
+}
+
+// WithCaseFolding sets whether paths are matched without regard to case:
+// "always", "never" or "auto", which checks whether the volume of each
+// replica root is case-insensitive.
+func WithCaseFolding(mode string) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		switch mode {
+		case "":
+		case fsmonitor.CaseFoldingAuto, fsmonitor.CaseFoldingAlways, fsmonitor.CaseFoldingNever:
+			fsm.caseFolding = mode
+		default:
+			return fmt.Errorf("Unknown case folding mode: %s", mode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package unisonfsmonitor
+
+import (
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// The same names, composed (NFC) and decomposed (NFD).
+const (
+	resumeNFC = "R\u00e9sum\u00e9.txt"
+	resumeNFD = "Re\u0301sume\u0301.txt"
+	cafeNFC   = "Caf\u00e9"
+	cafeNFD   = "Cafe\u0301"
+)
+
+func TestUnicodeEvents(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithCaseFolding("always"))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", cafeNFC, cafeNFC+"/Docs")
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/" + cafeNFD + "/docs/" + resumeNFD, Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: "/r/CAFÉ/new.txt", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+
+	c.ExpectChanges("replica", cafeNFC+"/Docs/"+resumeNFD, cafeNFC+"/new.txt")
+}
+
+func TestWithCaseFolding(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{"", "auto", "always", "never"} {
+		if _, err := makeUnisonFSMonitor(WithCaseFolding(mode)); err != nil {
+			t.Errorf("WithCaseFolding(%q): unexpected error: %v", mode, err)
+		}
+	}
+	if _, err := makeUnisonFSMonitor(WithCaseFolding("sometimes")); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,72 @@
+package unisonfsmonitor
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/transcript"
+)
+
+// Replay feeds the lines a monitor received in a recorded session into a
+// fresh monitor and returns the lines the new monitor sent back. Lines that
+// were sent in response to filesystem activity will only be reproduced if
+// the same activity happens while replaying.
+func Replay(session []transcript.Entry, options ...func(*UnisonFSMonitor) error) ([]string, error) {
+	stdin, stdinWriter := io.Pipe()
+	stdoutReader, stdout := io.Pipe()
+
+	options = append([]func(*UnisonFSMonitor) error{
+		func(fsm *UnisonFSMonitor) error {
+			fsm.stdin = stdin
+			fsm.stdout = stdout
+			fsm.stderr = ioutil.Discard
+			return nil
+		},
+	}, options...)
+
+	fsm, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+	defer fsm.Close()
+
+	var (
+		wg     sync.WaitGroup
+		output []string
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		scanner := bufio.NewScanner(stdoutReader)
+		for scanner.Scan() {
+			output = append(output, strings.TrimRight(scanner.Text(), "\r"))
+		}
+	}()
+
+	go func() {
+		for _, line := range transcript.Lines(session, transcript.Received) {
+			if _, err := io.WriteString(stdinWriter, line+"\n"); err != nil {
+				return
+			}
+		}
+		stdinWriter.Close()
+	}()
+
+	go fsm.Run()
+	<-fsm.ShutdownChannel
+
+	// The monitor may have stopped before consuming all of its input, so
+	// unblock the writer before collecting the output.
+	stdin.Close()
+	fsm.outputMutex.Lock()
+	stdout.Close()
+	fsm.outputMutex.Unlock()
+	wg.Wait()
+
+	return output, nil
+}
@@ -0,0 +1,69 @@
+package unisonfsmonitor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/transcript"
+)
+
+func TestReplay(t *testing.T) {
+	session := []transcript.Entry{
+		{Direction: transcript.Sent, Line: "VERSION 1"},
+		{Direction: transcript.Received, Line: "VERSION 1"},
+		{Direction: transcript.Received, Line: "BOGUS"},
+		{Direction: transcript.Sent, Line: "ERROR Unknown%20command:%20BOGUS"},
+	}
+
+	actual, err := Replay(session)
+	if err != nil {
+		t.Fatalf("Replay(): %v", err)
+	}
+
+	expected := transcript.Lines(session, transcript.Sent)
+	if diff := transcript.Diff(expected, actual); diff != nil {
+		t.Errorf("Unexpected replay output:\n%s", strings.Join(diff, "\n"))
+	}
+}
+
+func TestReplayEndOfInput(t *testing.T) {
+	session := []transcript.Entry{
+		{Direction: transcript.Sent, Line: "VERSION 1"},
+		{Direction: transcript.Received, Line: "VERSION 1"},
+	}
+
+	actual, err := Replay(session)
+	if err != nil {
+		t.Fatalf("Replay(): %v", err)
+	}
+	if strings.Join(actual, "|") != "VERSION 1" {
+		t.Errorf("Expected only the version handshake, got: %v", actual)
+	}
+}
+
+func TestTranscriptRecording(t *testing.T) {
+	var buf bytes.Buffer
+
+	session := []transcript.Entry{
+		{Direction: transcript.Received, Line: "VERSION 1"},
+		{Direction: transcript.Received, Line: "BOGUS"},
+	}
+	if _, err := Replay(session, WithTranscript(&buf)); err != nil {
+		t.Fatalf("Replay(): %v", err)
+	}
+
+	entries, err := transcript.Read(&buf)
+	if err != nil {
+		t.Fatalf("Unable to read the transcript: %v", err)
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, string(entry.Direction)+" "+entry.Line)
+	}
+	expected := "send VERSION 1|recv VERSION 1|recv BOGUS|send ERROR Unknown%20command:%20BOGUS"
+	if strings.Join(lines, "|") != expected {
+		t.Errorf("Expecting: %s, got: %s", expected, strings.Join(lines, "|"))
+	}
+}
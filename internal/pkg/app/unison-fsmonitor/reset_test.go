@@ -0,0 +1,157 @@
+package unisonfsmonitor
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// waitFor polls the condition until it holds, failing the test if it does
+// not within the client timeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(defaultClientTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResetReleasesWatch(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "")
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+
+	c.Reset("replica")
+	waitFor(t, "the watch to stop", func() bool { return b.Active() == 0 })
+
+	// A reset replica is gone along with its changes.
+	c.Start("replica", "/r", "")
+	c.ExpectChanges("replica")
+	if n := b.Watches(); n != 2 {
+		t.Errorf("Expecting a new watch, got %d watches", n)
+	}
+}
+
+func TestResetTwice(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "")
+	c.Reset("replica")
+	c.Reset("replica")
+	c.Expect("ERROR Unknown%20replica:%20replica")
+}
+
+func TestResetDoesNotWaitForBackend(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	release := b.HoldStops()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+	defer release()
+
+	c.Handshake()
+	c.Start("one", "/r", "")
+	c.Start("two", "/s", "")
+	c.Reset("one")
+
+	// The session carries on while the watch of /r is still stopping.
+	b.Inject(t, "/s", fsmonitor.Event{Path: "/s/a.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/s")
+	c.ExpectChanges("two", "a.txt")
+	if n := b.Active(); n != 2 {
+		t.Errorf("Expecting the stopping watch to still be active, got %d active", n)
+	}
+}
+
+func TestResetDropsLateEvents(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", "/r", "")
+	r, _ := c.fsm.replicas.Load("replica")
+
+	c.Reset("replica")
+	waitFor(t, "the reset", func() bool {
+		_, ok := c.fsm.replicas.Load("replica")
+		return !ok
+	})
+
+	// Events the watch delivers while being torn down must not resurrect
+	// the replica's changes.
+	c.fsm.addChanges(r.(*replica), []string{"a.txt"})
+	if _, ok := c.fsm.replicaChanges.Load("replica"); ok {
+		t.Errorf("Expected no changes for a reset replica")
+	}
+}
+
+// TestResetLeaks runs many START/RESET cycles and checks that neither
+// watches nor goroutines are left behind. It does not run in parallel, so
+// that the goroutines of other tests do not interfere.
+func TestResetLeaks(t *testing.T) {
+	cycles := 2000
+	if testing.Short() {
+		cycles = 200
+	}
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	c.Handshake()
+
+	// Let the goroutines of the client and monitor settle.
+	c.Start("warmup", "/warmup", "")
+	c.Reset("warmup")
+	waitFor(t, "the warmup watch to stop", func() bool { return b.Active() == 0 })
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < cycles; i++ {
+		root := fmt.Sprintf("/r%d", i%10)
+		c.Start("replica", root, "")
+		c.Start("shared", root, "foo")
+		c.Reset("replica")
+		c.Reset("shared")
+	}
+
+	waitFor(t, "the watches to stop", func() bool { return b.Active() == 0 })
+	if n := b.Watches(); n != cycles+1 {
+		t.Errorf("Expecting %d watches, got: %d", cycles+1, n)
+	}
+
+	var n int
+	for i := 0; i < 100; i++ {
+		if n = runtime.NumGoroutine(); n <= baseline {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n > baseline {
+		buf := make([]byte, 1<<20)
+		t.Errorf("Leaked %d goroutines:\n%s", n-baseline, buf[:runtime.Stack(buf, true)])
+	}
+
+	c.Close()
+}
@@ -3,70 +3,283 @@ package unisonfsmonitor
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/fsnotify/fsevents"
 	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
 )
 
 // New creates a new UnisonFSMonitor struct and initializes the maps and
 // channels necessary for operation.
 func New(options ...func(*UnisonFSMonitor) error) (*UnisonFSMonitor, error) {
-	fsm := &UnisonFSMonitor{
-		stdin:                       os.Stdin,
-		stdout:                      os.Stdout,
-		stderr:                      os.Stderr,
-		debugEnabled:                false,
-		ShutdownChannel:             make(chan empty, 2), // Make it a buffered channel so we don't block when shutting down.
-		eventsChannelSize:           defaultEventsChannelSize,
-		pendingEventsChannelSize:    defaultPendingEventsChannelSize,
-		replicaRoot:                 &sync.Map{},
-		replicaPaths:                &sync.Map{},
-		replicaEventStream:          &sync.Map{},
-		replicaEndMonitoringChannel: &sync.Map{},
-		replicaWaiting:              set.New(),
-		replicaChanges:              &sync.Map{},
-		replicaReportedChanges:      set.New(),
+	st := &state{
+		stderr:        os.Stderr,
+		changesMutex:  &sync.Mutex{},
+		logLevel:      int32(levelInfo),
+		caseFolding:   fsmonitor.CaseFoldingAuto,
+		started:       time.Now(),
+		saveMutex:     &sync.Mutex{},
+		snapshotMutex: &sync.Mutex{},
+		snapshotStop:  make(chan empty),
+		restores:      make(map[string]chan empty),
+		watched:       &sync.Map{},
+		replicaSets:   make(map[*replicaSet]empty),
+		listeners:     make(map[*Listener]empty),
+		sinksDone:     &sync.WaitGroup{},
 	}
+	fsm := st.newMonitor(st.newReplicaSet(true), os.Stdin, os.Stdout)
+	fsm.metrics = newMonitorMetrics(fsm)
 
 	for _, option := range options {
 		err := option(fsm)
 		if err != nil {
+			// Earlier options may already have started listening.
+			fsm.Close()
 			return nil, fmt.Errorf("Error setting UnisonFSMonitor options: %v", err)
 		}
 	}
 
+	// The metrics are only there to be looked at, so Unison keeps its
+	// monitor without them.
+	if fsm.metricsAddress != "" {
+		if err := fsm.listenMetrics(fsm.metricsAddress); err != nil {
+			fsm.warn("%v, serving no metrics", err)
+		}
+	}
+
+	if fsm.backend == nil {
+		fsm.backend = fsmonitor.DefaultBackend()
+	}
+	// Without a backend the protocol can still be spoken, but starting a
+	// replica fails.
+	if fsm.backend != nil {
+		if err := fsm.startMonitor(); err != nil {
+			fsm.Close()
+			return nil, err
+		}
+	}
+	if len(fsm.sinks) > 0 {
+		if err := fsm.startSinks(); err != nil {
+			fsm.Close()
+			return nil, err
+		}
+	}
+	if fsm.watchmanSocket != "" {
+		if err := fsm.serveWatchman(); err != nil {
+			fsm.Close()
+			return nil, err
+		}
+	}
+
+	if fsm.snapshotDir != "" && fsm.snapshotInterval > 0 {
+		go fsm.snapshotLoop()
+	}
+
 	// Set up a buffered IO reader based on stdin
 	fsm.reader = bufio.NewReader(fsm.stdin)
 
 	return fsm, nil
 }
 
+// newReplicaSet creates an empty replica set. The replicas of a set that is
+// kept stay watched when its sessions end.
+func (st *state) newReplicaSet(keep bool) *replicaSet {
+	rs := &replicaSet{
+		replicas:            &sync.Map{},
+		replicaChanges:      &sync.Map{},
+		replicaChangesSince: &sync.Map{},
+		keep:                keep,
+		sessions:            make(map[*UnisonFSMonitor]empty),
+	}
+
+	st.changesMutex.Lock()
+	st.replicaSets[rs] = empty{}
+	st.changesMutex.Unlock()
+
+	return rs
+}
+
+// newMonitor creates a monitor for a protocol session with the replicas of
+// rs that talks to Unison through r and w.
+func (st *state) newMonitor(rs *replicaSet, r io.Reader, w io.Writer) *UnisonFSMonitor {
+	return &UnisonFSMonitor{
+		state:                  st,
+		replicaSet:             rs,
+		stdin:                  r,
+		stdout:                 w,
+		reader:                 bufio.NewReader(r),
+		outputMutex:            &sync.Mutex{},
+		ShutdownChannel:        make(chan empty, 2), // Make it a buffered channel so we don't block when shutting down.
+		replicaWaiting:         set.New(),
+		replicaReportedChanges: set.New(),
+		notifications:          set.New(),
+		notify:                 make(chan empty, 1),
+		sessionDone:            make(chan empty),
+	}
+}
+
+// beginSession makes the session one of those notified about changes to the
+// replicas of its set.
+func (fsm *UnisonFSMonitor) beginSession() {
+	fsm.changesMutex.Lock()
+	fsm.sessions[fsm] = empty{}
+	fsm.changesMutex.Unlock()
+
+	go fsm.notifier()
+}
+
+// endSession removes the session from its replica set. Unless the set is
+// kept, its replicas are reset once no session uses them anymore.
+func (fsm *UnisonFSMonitor) endSession() {
+	var orphans []*replica
+
+	close(fsm.sessionDone)
+
+	fsm.changesMutex.Lock()
+	delete(fsm.sessions, fsm)
+	if !fsm.keep && len(fsm.sessions) == 0 {
+		delete(fsm.replicaSets, fsm.replicaSet)
+		fsm.replicas.Range(func(k, v interface{}) bool {
+			orphans = append(orphans, v.(*replica))
+			return true
+		})
+	}
+	fsm.changesMutex.Unlock()
+
+	for _, r := range orphans {
+		fsm.resetReplica(r)
+	}
+}
+
+// allReplicaSets returns every replica set of the monitor.
+func (st *state) allReplicaSets() []*replicaSet {
+	st.changesMutex.Lock()
+	defer st.changesMutex.Unlock()
+
+	sets := make([]*replicaSet, 0, len(st.replicaSets))
+	for rs := range st.replicaSets {
+		sets = append(sets, rs)
+	}
+	return sets
+}
+
+// rangeReplicas calls f for every replica of the monitor, in all of its
+// replica sets, until f returns false.
+func (st *state) rangeReplicas(f func(r *replica) bool) {
+	for _, rs := range st.allReplicaSets() {
+		more := true
+		rs.replicas.Range(func(k, v interface{}) bool {
+			more = f(v.(*replica))
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// Close releases the resources held by the monitor outside of the protocol
+// session, such as the status socket and the metrics listener, and saves the
+// snapshots of the replicas. Listeners stop accepting sessions and the
+// sessions still running are ended. Only the first call has an effect.
+func (fsm *UnisonFSMonitor) Close() error {
+	var err error
+
+	if !atomic.CompareAndSwapInt32(&fsm.closed, 0, 1) {
+		return nil
+	}
+
+	fsm.closeListeners()
+	fsm.endSessions()
+
+	if fsm.snapshotDir != "" {
+		close(fsm.snapshotStop)
+		fsm.saveSnapshots()
+	}
+
+	if fsm.watchman != nil {
+		if e := fsm.watchman.Close(); err == nil {
+			err = e
+		}
+	}
+
+	// Stopping the monitor waits for the replicas being reset and then
+	// stops every watch.
+	if fsm.monitor != nil {
+		fsm.stopMonitor()
+		<-fsm.monitorDone
+	}
+	// The subscriptions of the sinks end with the monitor.
+	fsm.sinksDone.Wait()
+	for _, s := range fsm.sinks {
+		if e := s.Close(); err == nil {
+			err = e
+		}
+	}
+
+	// Closing a Unix listener also removes its socket file.
+	if fsm.statusListener != nil {
+		if e := fsm.statusListener.Close(); err == nil {
+			err = e
+		}
+	}
+	if fsm.metricsServer != nil {
+		if e := fsm.metricsServer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (st *state) isClosed() bool {
+	return atomic.LoadInt32(&st.closed) != 0
+}
+
 // Run is the main event loop for the filesystem monitor. On error, a log
 // message is sent to stderr and the code exits with a non-zero exit code.
 func (fsm *UnisonFSMonitor) Run() {
 	var (
-		cmd     string
-		args    []string
-		replica string
-		err     error
+		cmd  string
+		args []string
+		name string
+		err  error
 	)
 
+	fsm.beginSession()
+	defer fsm.endSession()
+	if fsm.isClosed() {
+		// The monitor was closed before the session got going.
+		fsm.shutdown()
+		return
+	}
+
 	fsm.versionHandshake()
 
 	for {
 		// If we have an error, stop trying to read input
-		if fsm.shuttingDown {
+		if fsm.isShuttingDown() {
 			break
 		}
 
 		cmd, args, err = fsm.receiveCmd()
+		if err == io.EOF {
+			// Unison has gone away, there is nobody left to report to.
+			fsm.shutdown()
+			break
+		}
+		if err != nil && fsm.isShuttingDown() {
+			// The session was closed from our side.
+			break
+		}
 		if err != nil {
 			fsm.SendErr("Unexpected error: %v", err)
+			break
 		}
 
 		// If the command is anything other than a WAIT, cancel all of the
@@ -79,147 +292,172 @@ func (fsm *UnisonFSMonitor) Run() {
 		case "DEBUG":
 			// This command is not part of the protocol, but was created to
 			// aid in debugging.
-			fsm.debugEnabled = true
+			fsm.setLogLevel(levelDebug)
 		case "START":
 			var fspath, path string
 
 			switch len(args) {
 			case 2:
-				replica = args[0]
+				name = args[0]
 				fspath = args[1]
 			case 3:
-				replica = args[0]
+				name = args[0]
 				fspath = args[1]
 				path = args[2]
 			default:
 				fsm.SendErr("Incorrect number of arguments for START: %v", args)
+				continue
 			}
 
-			fsm.startReplicaMonitor(replica, fspath, path)
+			fsm.startReplicaMonitor(name, fspath, path)
 		case "WAIT":
-			fsm.checkSingleArgument(cmd, args)
-			replica = args[0]
+			if !fsm.checkSingleArgument(cmd, args) {
+				continue
+			}
+			name = args[0]
 
-			if _, ok := fsm.replicaEventStream.Load(replica); !ok {
-				fsm.SendErr("Unknown replica: %s", replica)
+			if _, ok := fsm.replicas.Load(name); !ok {
+				fsm.SendErr("Unknown replica: %s", name)
+				continue
 			}
 
-			fsm.replicaWaiting.Add(replica)
+			fsm.replicaWaiting.Add(name)
 			// If there already changes pending for the replica, send
 			// notification to Unison.
-			if _, ok := fsm.replicaChanges.Load(replica); ok {
-				fsm.sendCmd("CHANGES", replica)
-				fsm.replicaReportedChanges.Add(replica)
-			}
+			fsm.notifyChanges(name)
 		case "CHANGES":
-			var changes []string
-
-			fsm.checkSingleArgument(cmd, args)
-			replica = args[0]
-
-			if c, ok := fsm.replicaChanges.Load(replica); ok {
-				changes = c.(*set.Set).StringSlice()
-				sort.Strings(changes)
+			if !fsm.checkSingleArgument(cmd, args) {
+				continue
 			}
+			name = args[0]
 
-			for _, c := range changes {
+			fsm.metrics.changesRequests.Inc()
+			for _, c := range fsm.takeChanges(name) {
 				fsm.sendCmd("RECURSIVE", c)
+				fsm.metrics.changesReported.Inc()
 			}
 			fsm.sendCmd("DONE")
-
-			fsm.replicaReportedChanges.Clear()
-			fsm.replicaChanges = &sync.Map{}
 		case "RESET":
-			fsm.checkSingleArgument(cmd, args)
-			replica := args[0]
-
-			if end, ok := fsm.replicaEndMonitoringChannel.Load(replica); ok {
-				end.(chan empty) <- empty{}
-			} else {
-				fsm.SendErr("end monitoring channel for replica %s: %v", replica)
+			if !fsm.checkSingleArgument(cmd, args) {
+				continue
 			}
+			name = args[0]
 
-			fsm.replicaWaiting.Remove(replica)
-			fsm.replicaEventStream.Delete(replica)
-			fsm.replicaReportedChanges.Remove(replica)
-			fsm.replicaChanges.Delete(replica)
+			r, ok := fsm.replicas.Load(name)
+			if !ok {
+				fsm.SendErr("Unknown replica: %s", name)
+				continue
+			}
+			fsm.resetReplica(r.(*replica))
 		case "QUIT":
 			// This command is not part of the protocol, but was created for
 			// testing purposes so that we don't have an error when closing
 			// the stdin file handle.
 			break
 		default:
-			if !fsm.shuttingDown {
-				fsm.SendErr("Unknown command: %s", cmd)
-			}
+			fsm.SendErr("Unknown command: %s", cmd)
 		}
 	}
 }
 
-func (fsm *UnisonFSMonitor) startReplicaMonitor(replica, fspath, path string) error {
-	var es *fsevents.EventStream
+// resetReplica forgets everything about the replica. Its watch is released in
+// the background, so that a slow backend does not hold up the session.
+func (fsm *UnisonFSMonitor) resetReplica(r *replica) {
+	fsm.changesMutex.Lock()
+	r.removed = true
+	fsm.replicas.Delete(r.name)
+	for s := range fsm.sessions {
+		s.replicaWaiting.Remove(r.name)
+		s.replicaReportedChanges.Remove(r.name)
+		s.notifications.Remove(r.name)
+	}
+	fsm.replicaChanges.Delete(r.name)
+	fsm.replicaChangesSince.Delete(r.name)
+	fsm.changesMutex.Unlock()
+
+	fsm.watched.Delete(r.watched)
+	fsm.monitor.RemoveReplica(r.watched)
+}
+
+func (fsm *UnisonFSMonitor) startReplicaMonitor(name, fspath, path string) error {
+	var r *replica
 
 	fullPath := filepath.Join(fspath, path)
 
-	// If the EventStream does not exist for the replica, create it. Start the
-	// EventStream and kick off the event handler.
-	if t, ok := fsm.replicaEventStream.Load(replica); ok {
-		es = t.(*fsevents.EventStream)
+	// If the replica does not exist, subscribe it to a watch of its root.
+	if t, ok := fsm.replicas.Load(name); ok {
+		r = t.(*replica)
 	} else {
-		fsm.replicaRoot.Store(replica, fspath)
-		fsm.replicaPaths.Store(replica, set.New())
-
-		if fsm.debugEnabled {
-			fsm.debug("Creating EventStream at path: %s", fullPath)
+		if fsm.monitor == nil {
+			fsm.SendErr("No filesystem event backend is available on this platform")
+			return nil
 		}
 
-		es = &fsevents.EventStream{
-			Paths:   []string{fspath},
-			Latency: defaultLatency,
-			Events:  make(chan []fsevents.Event, fsm.eventsChannelSize),
-			Flags:   fsevents.FileEvents | fsevents.WatchRoot,
+		// The replica is watched without any paths until it is known, so
+		// that no changes are reported for it before.
+		watched, err := fsm.monitor.AddReplica(name, fspath)
+		if err != nil {
+			fsm.SendErr("Unable to watch %s: %v", fspath, err)
+			return nil
 		}
-		es.Start()
-
-		fsm.replicaEventStream.Store(replica, es)
-		fsm.replicaEndMonitoringChannel.Store(replica, make(chan empty, 0))
-
-		if fsm.debugEnabled {
-			fsm.debug("Monitoring replica %s at path %s", replica, fullPath)
+		r = &replica{
+			owner:   fsm.replicaSet,
+			name:    name,
+			root:    fspath,
+			backend: fsm.backend.Name(),
+			watched: watched,
 		}
+		fsm.watched.Store(watched, r)
+		fsm.replicas.Store(name, r)
 
-		go fsm.eventHandler(replica)
+		if fsm.debugEnabled() {
+			fsm.debug("Monitoring replica %s at path %s", name, fullPath)
+		}
 	}
 
 	// Add the basepath for the replicas to watch for changes
-	if t, ok := fsm.replicaPaths.Load(replica); ok {
-		t.(*set.Set).Add(path)
+	r.watched.AddPath(path)
+
+	if fsm.snapshotDir != "" {
+		if done, ok := fsm.beginRestore(fspath, path); ok {
+			go fsm.restoreSnapshot(r, path, done)
+		}
 	}
 
 	fsm.sendOk()
 
 	for {
 		// If we have an error, stop trying to read input
-		if fsm.shuttingDown {
+		if fsm.isShuttingDown() {
 			break
 		}
 
-		cmd, _, err := fsm.receiveCmd()
+		cmd, args, err := fsm.receiveCmd()
+		if err == io.EOF {
+			fsm.shutdown()
+			break
+		}
+		if err != nil && fsm.isShuttingDown() {
+			// The session was closed from our side.
+			break
+		}
 		if err != nil {
 			fsm.SendErr("Unexpected error: %v", err)
+			break
 		}
 
 		switch cmd {
 		case "DIR":
+			for _, dir := range args {
+				r.watched.AddDir(dir)
+			}
 			fsm.sendOk()
 		case "LINK":
 			fsm.SendErr("Link following is not currently supported with unison-fsmonitor. Disable this option with '-links'.")
 		case "DONE":
 			return nil
 		default:
-			if !fsm.shuttingDown {
-				fsm.SendErr("Unknown command in START mode: %s", cmd)
-			}
+			fsm.SendErr("Unknown command in START mode: %s", cmd)
 		}
 
 	}
@@ -232,14 +470,21 @@ func (fsm *UnisonFSMonitor) versionHandshake() {
 	fsm.sendVersion(1)
 	cmd, args, err := fsm.receiveCmd()
 
+	if err == io.EOF {
+		fsm.shutdown()
+		return
+	}
 	if err != nil {
-		fsm.SendErr(err.Error())
+		fsm.SendErr("%v", err)
+		return
 	}
 	if cmd != "VERSION" {
 		fsm.SendErr("Expected VERSION command: %s", cmd)
+		return
 	}
 	if len(args) != 1 {
 		fsm.SendErr("Unexpected arguments for VERSION command: %v", args)
+		return
 	}
 	if args[0] != "1" {
 		fsm.warn("Unexpected version number: %s", args[0])
@@ -13,35 +13,62 @@ func Test_New(t *testing.T) {
 }
 
 func TestVersionHandshake(t *testing.T) {
+	t.Parallel()
+
 	tables := []struct {
 		version  string
 		expected float64
 	}{
 		{
-			version:  "VERSION 1\n",
+			version:  "VERSION 1",
 			expected: 1.0,
 		},
 		{
-			version:  "VERSION 2\n",
+			version:  "VERSION 2",
 			expected: 2.0,
 		},
 	}
 
-	fsm, err := makeUnisonFSMonitor(setStdinPipe, setStdoutBuffer)
-	if err != nil {
-		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
-	}
-
-	lock := make(chan struct{}, 0)
 	for _, table := range tables {
-		go func() {
-			fsm.versionHandshake()
-			lock <- struct{}{}
-		}()
-		stdinWriter.Write([]byte(table.version))
-		<-lock
-		if fsm.protocolVersion != table.expected {
-			t.Errorf("Expecting: %v, got: %v", table.expected, fsm.protocolVersion)
+		c := newUnisonClient(t)
+		c.Expect("VERSION 1")
+		c.SendRaw(table.version)
+		c.Close()
+
+		if c.fsm.protocolVersion != table.expected {
+			t.Errorf("Expecting: %v, got: %v", table.expected, c.fsm.protocolVersion)
 		}
 	}
 }
+
+func TestVersionHandshakeFailure(t *testing.T) {
+	t.Parallel()
+
+	c := newUnisonClient(t)
+	defer c.Close()
+
+	c.Expect("VERSION 1")
+	c.SendRaw("VERSION")
+	c.Expect("ERROR Unexpected%20arguments%20for%20VERSION%20command:%20[]")
+}
+
+func TestUnknownCommand(t *testing.T) {
+	t.Parallel()
+
+	c := newUnisonClient(t)
+	defer c.Close()
+
+	c.Handshake()
+	c.Send("BOGUS")
+	c.Expect("ERROR Unknown%20command:%20BOGUS")
+}
+
+func TestChangesWithoutReplica(t *testing.T) {
+	t.Parallel()
+
+	c := newUnisonClient(t)
+	defer c.Close()
+
+	c.Handshake()
+	c.ExpectChanges("unknown")
+}
@@ -0,0 +1,289 @@
+package unisonfsmonitor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/quote"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// selfTestReplica is the name of the replica of a self test.
+const selfTestReplica = "selftest"
+
+// SelfTest checks that a monitor created with options works on this machine.
+// It creates a tree in a temporary directory below dir and plays a Unison
+// client against the monitor: the version handshake, START with a DIR, then
+// WAIT and CHANGES around creating, modifying, renaming and removing files,
+// checking that they are reported with RECURSIVE, and finally RESET. Each
+// step waits up to timeout for the monitor and is handed to report once
+// done. The error of the first step that fails is returned.
+func SelfTest(dir string, timeout time.Duration, report func(SelfTestStep), options ...func(*UnisonFSMonitor) error) error {
+	tmp, err := ioutil.TempDir(dir, "unison-fsmonitor-selftest")
+	if err != nil {
+		return fmt.Errorf("Unable to create the tree: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	// Events are reported for the real path of the tree.
+	root, err := filepath.EvalSymlinks(tmp)
+	if err != nil {
+		return fmt.Errorf("Unable to create the tree: %v", err)
+	}
+	for _, p := range []string{"sub/old.txt", "keep.txt", "gone.txt"} {
+		path := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("Unable to create the tree: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(p+"\n"), 0600); err != nil {
+			return fmt.Errorf("Unable to create the tree: %v", err)
+		}
+	}
+
+	stdin, stdinWriter := io.Pipe()
+	stdoutReader, stdout := io.Pipe()
+	options = append([]func(*UnisonFSMonitor) error{
+		func(fsm *UnisonFSMonitor) error {
+			fsm.stdin = stdin
+			fsm.stdout = stdout
+			return nil
+		},
+	}, options...)
+	fsm, err := New(options...)
+	if err != nil {
+		return err
+	}
+
+	c := &selfTestClient{w: stdinWriter, lines: make(chan string, 100)}
+	go func() {
+		scanner := bufio.NewScanner(stdoutReader)
+		for scanner.Scan() {
+			c.lines <- strings.TrimRight(scanner.Text(), "\r")
+		}
+		close(c.lines)
+	}()
+	done := make(chan empty)
+	go func() {
+		fsm.Run()
+		// Nothing reads what the client sends anymore.
+		stdin.Close()
+		close(done)
+	}()
+	defer func() {
+		stdinWriter.Close()
+		stdoutReader.Close()
+		<-done
+		fsm.Close()
+	}()
+
+	write := func(p, content string) func() error {
+		return func() error {
+			return ioutil.WriteFile(filepath.Join(root, p), []byte(content), 0600)
+		}
+	}
+	steps := []struct {
+		name string
+		run  func() (time.Duration, error)
+	}{
+		{"handshake", c.timed(func() error {
+			if err := c.expect("VERSION", "1"); err != nil {
+				return err
+			}
+			return c.send("VERSION", "1")
+		})},
+		{"start", c.timed(func() error {
+			if err := c.send("START", selfTestReplica, root); err != nil {
+				return err
+			}
+			if err := c.expect("OK"); err != nil {
+				return err
+			}
+			if err := c.send("DIR", "sub"); err != nil {
+				return err
+			}
+			if err := c.expect("OK"); err != nil {
+				return err
+			}
+			return c.send("DONE")
+		})},
+		{"create", c.change(write("new.txt", "new\n"), "new.txt")},
+		{"modify", c.change(write("keep.txt", "modified\n"), "keep.txt")},
+		{"rename", c.change(func() error {
+			return os.Rename(filepath.Join(root, "sub", "old.txt"), filepath.Join(root, "sub", "new.txt"))
+		}, "sub/old.txt", "sub/new.txt")},
+		{"delete", c.change(func() error {
+			return os.Remove(filepath.Join(root, "gone.txt"))
+		}, "gone.txt")},
+		{"reset", func() (time.Duration, error) {
+			return c.reset(write("after-reset.txt", "late\n"))
+		}},
+	}
+
+	for _, step := range steps {
+		c.deadline = time.Now().Add(timeout)
+		latency, err := step.run()
+		report(SelfTestStep{Name: step.name, Latency: latency, Err: err})
+		if err != nil {
+			return fmt.Errorf("Self test failed at %s: %v", step.name, err)
+		}
+	}
+	return nil
+}
+
+// timed returns a step that runs f and takes how long it ran.
+func (c *selfTestClient) timed(f func() error) func() (time.Duration, error) {
+	return func() (time.Duration, error) {
+		start := time.Now()
+		err := f()
+		return time.Since(start), err
+	}
+}
+
+// change returns a step that waits for changes, makes one with op and
+// collects the changes reported until paths are covered, which takes as
+// long as the step's latency.
+func (c *selfTestClient) change(op func() error, paths ...string) func() (time.Duration, error) {
+	return func() (time.Duration, error) {
+		if err := c.send("WAIT", selfTestReplica); err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		if err := op(); err != nil {
+			return 0, err
+		}
+
+		missing := make(map[string]bool)
+		for _, p := range paths {
+			missing[p] = true
+		}
+		for {
+			if err := c.expect("CHANGES", selfTestReplica); err != nil {
+				return 0, fmt.Errorf("%v, missing %s", err, strings.Join(sortedKeys(missing), ", "))
+			}
+			reported, err := c.changes()
+			if err != nil {
+				return 0, err
+			}
+			for _, r := range reported {
+				for p := range missing {
+					// RECURSIVE covers everything below the path.
+					if r == "" || p == r || strings.HasPrefix(p, r+"/") {
+						delete(missing, p)
+					}
+				}
+			}
+			if len(missing) == 0 {
+				return time.Since(start), nil
+			}
+			if err := c.send("WAIT", selfTestReplica); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// reset resets the replica and checks that no changes are reported for it
+// after op has changed the tree. Its latency is that of the CHANGES
+// command.
+func (c *selfTestClient) reset(op func() error) (time.Duration, error) {
+	if err := c.send("RESET", selfTestReplica); err != nil {
+		return 0, err
+	}
+	if err := op(); err != nil {
+		return 0, err
+	}
+	// Give the backend time to deliver the events of op.
+	time.Sleep(2 * fsmonitor.DefaultLatency)
+
+	start := time.Now()
+	reported, err := c.changes()
+	if err != nil {
+		return 0, err
+	}
+	if len(reported) > 0 {
+		return 0, fmt.Errorf("Changes reported after RESET: %s", strings.Join(reported, ", "))
+	}
+	return time.Since(start), nil
+}
+
+// changes asks for the changes of the replica and returns the paths
+// reported.
+func (c *selfTestClient) changes() ([]string, error) {
+	if err := c.send("CHANGES", selfTestReplica); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for {
+		cmd, args, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case cmd == "DONE":
+			return paths, nil
+		case cmd == "RECURSIVE" && len(args) == 1:
+			paths = append(paths, args[0])
+		default:
+			return nil, fmt.Errorf("Expecting RECURSIVE or DONE, got %s", quote.Format(cmd, args...))
+		}
+	}
+}
+
+// send writes a command to the monitor.
+func (c *selfTestClient) send(cmd string, args ...string) error {
+	_, err := io.WriteString(c.w, quote.Format(cmd, args...)+"\n")
+	if err != nil {
+		return fmt.Errorf("Unable to send %s: %v", cmd, err)
+	}
+	return nil
+}
+
+// expect reads the next command and fails unless it is cmd with args.
+func (c *selfTestClient) expect(cmd string, args ...string) error {
+	got, gotArgs, err := c.read()
+	if err != nil {
+		return err
+	}
+	if line, expected := quote.Format(got, gotArgs...), quote.Format(cmd, args...); line != expected {
+		return fmt.Errorf("Expecting %s, got %s", expected, line)
+	}
+	return nil
+}
+
+// read reads the next command from the monitor before the deadline. An
+// ERROR from the monitor is returned as an error.
+func (c *selfTestClient) read() (string, []string, error) {
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			return "", nil, errors.New("The monitor closed its output")
+		}
+		cmd, args, err := quote.Parse(line)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid line from the monitor %q: %v", line, err)
+		}
+		if cmd == "ERROR" {
+			return "", nil, fmt.Errorf("The monitor failed: %s", strings.Join(args, " "))
+		}
+		return cmd, args, nil
+	case <-time.After(time.Until(c.deadline)):
+		return "", nil, errors.New("Timed out waiting for the monitor")
+	}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,140 @@
+package unisonfsmonitor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// pollBackend reports the changes to the files below a root by comparing
+// the tree every few milliseconds, so that the self test can run on any
+// platform.
+type pollBackend struct{}
+
+type pollWatcher struct {
+	events chan []fsmonitor.Event
+	stop   chan empty
+	done   chan empty
+}
+
+func (pollBackend) Name() string {
+	return "poll"
+}
+
+func (pollBackend) Watch(root string) (fsmonitor.Watcher, error) {
+	w := &pollWatcher{
+		events: make(chan []fsmonitor.Event),
+		stop:   make(chan empty),
+		done:   make(chan empty),
+	}
+	go w.poll(root)
+	return w, nil
+}
+
+func (w *pollWatcher) Events() <-chan []fsmonitor.Event {
+	return w.events
+}
+
+func (w *pollWatcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *pollWatcher) poll(root string) {
+	defer close(w.done)
+
+	scan := func() map[string]os.FileInfo {
+		tree := make(map[string]os.FileInfo)
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err == nil {
+				tree[path] = fi
+			}
+			return nil
+		})
+		return tree
+	}
+
+	old := scan()
+	for {
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-w.stop:
+			return
+		}
+
+		tree := scan()
+		var events []fsmonitor.Event
+		for path, fi := range tree {
+			if was, ok := old[path]; !ok {
+				events = append(events, fsmonitor.Event{Path: path, Flags: fsmonitor.EventCreated})
+			} else if !fi.IsDir() && (fi.ModTime() != was.ModTime() || fi.Size() != was.Size()) {
+				events = append(events, fsmonitor.Event{Path: path, Flags: fsmonitor.EventModified})
+			}
+		}
+		for path := range old {
+			if _, ok := tree[path]; !ok {
+				events = append(events, fsmonitor.Event{Path: path, Flags: fsmonitor.EventRemoved})
+			}
+		}
+		old = tree
+
+		if len(events) > 0 {
+			select {
+			case w.events <- events:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	var steps []SelfTestStep
+	stderr := &syncBuffer{}
+	err := SelfTest(dir, defaultClientTimeout, func(s SelfTestStep) { steps = append(steps, s) }, withBackend(pollBackend{}), withStderr(stderr))
+	if err != nil {
+		t.Fatalf("SelfTest failed: %v\n%s", err, stderr.String())
+	}
+
+	var names []string
+	for _, s := range steps {
+		names = append(names, s.Name)
+		if s.Err != nil || s.Latency <= 0 {
+			t.Errorf("Unexpected step %+v", s)
+		}
+	}
+	if expected := "handshake start create modify rename delete reset"; strings.Join(names, " ") != expected {
+		t.Errorf("Expecting the steps %s, got %s", expected, strings.Join(names, " "))
+	}
+	// The tree is removed.
+	if entries, _ := filepath.Glob(filepath.Join(dir, "*")); len(entries) != 0 {
+		t.Errorf("Expecting the tree to be removed, got %v", entries)
+	}
+}
+
+func TestSelfTestFailure(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// The fake backend reports nothing by itself.
+	var steps []SelfTestStep
+	err := SelfTest(dir, 100*time.Millisecond, func(s SelfTestStep) { steps = append(steps, s) }, withBackend(fsmonitortest.NewBackend()), withStderr(&syncBuffer{}))
+	if err == nil || !strings.Contains(err.Error(), "failed at create") {
+		t.Errorf("Expecting the self test to fail at create, got %v", err)
+	}
+	if len(steps) != 3 || steps[2].Err == nil || !strings.Contains(steps[2].Err.Error(), "missing new.txt") {
+		t.Errorf("Unexpected steps %+v", steps)
+	}
+}
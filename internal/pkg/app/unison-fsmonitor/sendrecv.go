@@ -1,35 +1,56 @@
-// +build darwin
-
 package unisonfsmonitor
 
 import (
 	"fmt"
-	"net/url"
+	"io"
 	"strconv"
-	"strings"
+	"sync/atomic"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/quote"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/transcript"
 )
 
 // SendErr outputs an ERROR command that is consumed by Unison. A format
 // string and a variable number of arguments are passed and the command is
-// output to STDOUT.
+// output to STDOUT. Unison restarts the monitor after an error, so only the
+// first error is sent; later ones are only logged.
 func (fsm *UnisonFSMonitor) SendErr(format string, a ...interface{}) {
 	msg := fmt.Sprintf(format, a...)
+	if fsm.isShuttingDown() {
+		fsm.warn("Error after shutdown: %s", msg)
+		return
+	}
 	fsm.sendCmd("ERROR", msg)
-	fsm.shuttingDown = true
-	fsm.ShutdownChannel <- empty{}
+	fsm.shutdown()
 }
 
-func (fsm *UnisonFSMonitor) sendCmd(cmd string, args ...string) {
-	var buildCmd = make([]string, len(args)+1)
-	buildCmd[0] = cmd
-	for i, arg := range args {
-		buildCmd[i+1] = url.PathEscape(arg)
+// shutdown stops the monitor from reading further commands and notifies the
+// owner of the monitor through the ShutdownChannel. Only the first call has
+// an effect.
+func (fsm *UnisonFSMonitor) shutdown() {
+	if atomic.CompareAndSwapInt32(&fsm.shuttingDown, 0, 1) {
+		fsm.ShutdownChannel <- empty{}
 	}
-	rawCmd := strings.Join(buildCmd, " ")
-	if fsm.debugEnabled {
-		fsm.debug(fmt.Sprintln("sendCmd: ", rawCmd))
+}
+
+func (fsm *UnisonFSMonitor) isShuttingDown() bool {
+	return atomic.LoadInt32(&fsm.shuttingDown) != 0
+}
+
+func (fsm *UnisonFSMonitor) sendCmd(cmd string, args ...string) {
+	rawCmd := formatCmd(cmd, args...)
+	if fsm.debugEnabled() {
+		fsm.debug("sendCmd: %s", rawCmd)
 	}
+
+	// Commands are sent both from the main loop and the event handlers so
+	// serialize the writes to keep lines intact and the transcript in order.
+	fsm.outputMutex.Lock()
 	fmt.Fprintln(fsm.stdout, rawCmd)
+	fsm.record(transcript.Sent, rawCmd)
+	fsm.outputMutex.Unlock()
+
+	fsm.metrics.commandsSent.With(cmd).Inc()
 }
 
 func (fsm *UnisonFSMonitor) sendVersion(v int) {
@@ -44,41 +65,63 @@ func (fsm *UnisonFSMonitor) sendDone() {
 	fsm.sendCmd("DONE")
 }
 
+// receiveCmd reads the next command from Unison. io.EOF is returned as is
+// when Unison has closed its end of the pipe.
 func (fsm *UnisonFSMonitor) receiveCmd() (string, []string, error) {
 	in, err := fsm.reader.ReadString('\n')
-	if err != nil {
+	if err == io.EOF && in == "" {
+		return "", nil, err
+	}
+	if err != nil && err != io.EOF {
 		err = fmt.Errorf("Unable to read stdin: %v", err)
 		return "", nil, err
 	}
-	if fsm.debugEnabled {
+	if fsm.debugEnabled() {
 		fsm.debug("receiveCmd got: %s", in)
 	}
+	fsm.outputMutex.Lock()
+	fsm.record(transcript.Received, in)
+	fsm.outputMutex.Unlock()
 
-	tokens := strings.Split(strings.TrimSpace(in), " ")
-	switch len(tokens) {
-	case 0:
-		return "", []string{}, nil
-	case 1:
-		return tokens[0], []string{}, nil
-	default:
-		args := make([]string, len(tokens)-1)
-		for i, arg := range tokens[1:] {
-			a, err := url.PathUnescape(arg)
-			if err != nil {
-				err = fmt.Errorf("Unable to decode command argument: %v", err)
-				return "", nil, err
-			}
-			args[i] = a
-		}
-		return tokens[0], args, nil
+	return parseCmd(in)
+}
+
+// formatCmd builds a protocol line from a command and its arguments, quoted
+// the way Unison quotes them.
+func formatCmd(cmd string, args ...string) string {
+	return quote.Format(cmd, args...)
+}
+
+// parseCmd splits a protocol line into the command and its unquoted
+// arguments.
+func parseCmd(line string) (string, []string, error) {
+	cmd, args, err := quote.Parse(line)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to decode command argument: %v", err)
+	}
+	return cmd, args, nil
+}
+
+// record appends a line to the protocol transcript, if one is being kept.
+// The caller must hold the outputMutex.
+func (fsm *UnisonFSMonitor) record(dir transcript.Direction, line string) {
+	if fsm.transcript == nil {
+		return
+	}
+	if err := fsm.transcript.Record(dir, line); err != nil {
+		fsm.warn("Unable to write to the transcript, disabling it: %v", err)
+		fsm.transcript = nil
 	}
 }
 
-func (fsm *UnisonFSMonitor) checkSingleArgument(cmd string, args []string) {
+// checkSingleArgument sends an error and returns false unless exactly one
+// argument was given.
+func (fsm *UnisonFSMonitor) checkSingleArgument(cmd string, args []string) bool {
 	switch len(args) {
 	case 1:
-		break
+		return true
 	default:
 		fsm.SendErr("Incorrect number of arguments for %s: %v", cmd, args)
+		return false
 	}
 }
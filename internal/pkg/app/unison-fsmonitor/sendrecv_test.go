@@ -1,16 +1,13 @@
-// +build darwin
-
 package unisonfsmonitor
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
 func TestSendErr(t *testing.T) {
-	fsm, err := makeUnisonFSMonitor(setStdoutBuffer)
-	if err != nil {
-		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
-	}
+	t.Parallel()
 
 	tables := []struct {
 		format   string
@@ -30,23 +27,87 @@ func TestSendErr(t *testing.T) {
 	}
 
 	for _, table := range tables {
+		var stdout bytes.Buffer
+
+		// A monitor only ever sends one error, so use a new one each time.
+		fsm, err := makeUnisonFSMonitor(withStdout(&stdout))
+		if err != nil {
+			t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+		}
+
 		args := make([]interface{}, len(table.args))
 		for i, v := range table.args {
 			args[i] = v
 		}
 
 		fsm.SendErr(table.format, args...)
-		flushStdoutBuffer(fsm)
-		strout := stringifyStdoutBuffer()
+		strout := stdout.String()
 		if strout != table.expected {
 			t.Errorf("Expecting: %s, got: %s", table.expected, strout)
 		}
-		resetStdoutBuffer()
+	}
+}
+
+func TestSendErrOnlyOnce(t *testing.T) {
+	t.Parallel()
+
+	var stdout, stderr bytes.Buffer
+
+	fsm, err := makeUnisonFSMonitor(withStdout(&stdout), withStderr(&stderr))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+
+	// None of these may block, even though nobody reads the ShutdownChannel.
+	fsm.SendErr("first")
+	fsm.SendErr("second")
+	fsm.SendErr("third")
+
+	if strout := stdout.String(); strout != "ERROR first\n" {
+		t.Errorf("Expecting: %q, got: %q", "ERROR first\n", strout)
+	}
+	if !fsm.isShuttingDown() {
+		t.Errorf("Expected the monitor to be shutting down")
+	}
+	if len(fsm.ShutdownChannel) != 1 {
+		t.Errorf("Expected one shutdown notification, got: %d", len(fsm.ShutdownChannel))
+	}
+}
+
+func TestParseCmd(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		line string
+		cmd  string
+		args []string
+		err  bool
+	}{
+		{line: "OK\n", cmd: "OK", args: []string{}},
+		{line: "", cmd: "", args: []string{}},
+		{line: "START replica /tmp/root%20dir sub%2Fdir\n", cmd: "START", args: []string{"replica", "/tmp/root dir", "sub/dir"}},
+		{line: "  WAIT replica  \r\n", cmd: "WAIT", args: []string{"replica"}},
+		{line: "DIR %zz", err: true},
+	}
+
+	for _, table := range tables {
+		cmd, args, err := parseCmd(table.line)
+		if (err != nil) != table.err {
+			t.Errorf("parseCmd(%q): unexpected error state: %v", table.line, err)
+			continue
+		}
+		if cmd != table.cmd || strings.Join(args, "|") != strings.Join(table.args, "|") || len(args) != len(table.args) {
+			t.Errorf("parseCmd(%q): expecting: %s %q, got: %s %q", table.line, table.cmd, table.args, cmd, args)
+		}
 	}
 }
 
 func TestSendCmd(t *testing.T) {
-	fsm, err := makeUnisonFSMonitor(setStdoutBuffer)
+	t.Parallel()
+
+	var stdout bytes.Buffer
+
+	fsm, err := makeUnisonFSMonitor(withStdout(&stdout))
 	if err != nil {
 		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
 	}
@@ -70,18 +131,20 @@ func TestSendCmd(t *testing.T) {
 
 	for _, table := range tables {
 		fsm.sendCmd(table.cmd, table.args...)
-		flushStdoutBuffer(fsm)
-
-		strout := stringifyStdoutBuffer()
+		strout := stdout.String()
 		if strout != table.expected {
 			t.Errorf("Expecting: %s, got: %s", table.expected, strout)
 		}
-		resetStdoutBuffer()
+		stdout.Reset()
 	}
 }
 
 func TestSendVersion(t *testing.T) {
-	fsm, err := makeUnisonFSMonitor(setStdoutBuffer)
+	t.Parallel()
+
+	var stdout bytes.Buffer
+
+	fsm, err := makeUnisonFSMonitor(withStdout(&stdout))
 	if err != nil {
 		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
 	}
@@ -102,46 +165,46 @@ func TestSendVersion(t *testing.T) {
 
 	for _, table := range tables {
 		fsm.sendVersion(table.version)
-		flushStdoutBuffer(fsm)
-
-		strout := stringifyStdoutBuffer()
+		strout := stdout.String()
 		if strout != table.expected {
 			t.Errorf("Expecting: %s, got: %s", table.expected, strout)
 		}
-		resetStdoutBuffer()
+		stdout.Reset()
 	}
 }
 
 func TestSendOk(t *testing.T) {
+	t.Parallel()
+
 	expected := "OK\n"
 
-	fsm, err := makeUnisonFSMonitor(setStdoutBuffer)
+	var stdout bytes.Buffer
+
+	fsm, err := makeUnisonFSMonitor(withStdout(&stdout))
 	if err != nil {
 		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
 	}
 	fsm.sendOk()
-	flushStdoutBuffer(fsm)
-
-	strout := stringifyStdoutBuffer()
+	strout := stdout.String()
 	if strout != expected {
 		t.Errorf("Expecting: %s, got: %s", expected, strout)
 	}
-	resetStdoutBuffer()
 }
 
 func TestSendDone(t *testing.T) {
+	t.Parallel()
+
 	expected := "DONE\n"
 
-	fsm, err := makeUnisonFSMonitor(setStdoutBuffer)
+	var stdout bytes.Buffer
+
+	fsm, err := makeUnisonFSMonitor(withStdout(&stdout))
 	if err != nil {
 		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
 	}
 	fsm.sendDone()
-	flushStdoutBuffer(fsm)
-
-	strout := stringifyStdoutBuffer()
+	strout := stdout.String()
 	if strout != expected {
 		t.Errorf("Expecting: %s, got: %s", expected, strout)
 	}
-	resetStdoutBuffer()
 }
@@ -0,0 +1,48 @@
+package unisonfsmonitor
+
+import (
+	"io"
+)
+
+// Session is a protocol session with a single Unison process over a
+// connection, such as a pipe or a socket.
+type Session struct {
+	fsm  *UnisonFSMonitor
+	conn io.ReadWriteCloser
+}
+
+// NewSession creates a session speaking the protocol over conn. The session
+// has replicas of its own, which are reset when it ends, but their watches
+// are shared with the other sessions of the monitor.
+func (fsm *UnisonFSMonitor) NewSession(conn io.ReadWriteCloser) *Session {
+	return fsm.newSession(fsm.newReplicaSet(false), conn)
+}
+
+func (fsm *UnisonFSMonitor) newSession(rs *replicaSet, conn io.ReadWriteCloser) *Session {
+	return &Session{
+		fsm:  fsm.newMonitor(rs, conn, conn),
+		conn: conn,
+	}
+}
+
+// Run speaks the protocol until either side ends the session and then closes
+// the connection.
+func (s *Session) Run() error {
+	done := make(chan empty)
+	go func() {
+		s.fsm.Run()
+		close(done)
+	}()
+
+	<-s.fsm.ShutdownChannel
+	// Closing the connection stops the read the session may be blocked in.
+	err := s.conn.Close()
+	<-done
+
+	return err
+}
+
+// Close ends the session.
+func (s *Session) Close() {
+	s.fsm.shutdown()
+}
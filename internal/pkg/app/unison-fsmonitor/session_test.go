@@ -0,0 +1,166 @@
+package unisonfsmonitor
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// newSessionClient runs a session of the monitor over an in-memory pipe
+// and returns the client on the other end.
+func newSessionClient(t *testing.T, fsm *UnisonFSMonitor) *unisonClient {
+	t.Helper()
+
+	server, client := net.Pipe()
+	c := newClient(t, client, client)
+
+	s := fsm.NewSession(server)
+	go func() {
+		s.Run()
+		close(c.done)
+	}()
+
+	return c
+}
+
+func TestSessionsSideBySide(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	fsm, err := New(withStderr(&syncBuffer{}), withBackend(b))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+	defer fsm.Close()
+
+	one := newSessionClient(t, fsm)
+	defer one.Close()
+	two := newSessionClient(t, fsm)
+	defer two.Close()
+
+	// The sessions use the same replica name for different roots.
+	one.Handshake()
+	two.Handshake()
+	one.Start("replica", "/one", "")
+	two.Start("replica", "/two", "")
+	one.Wait("replica")
+	two.Wait("replica")
+
+	b.Inject(t, "/one", fsmonitor.Event{Path: "/one/a.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/one")
+	one.ExpectNotification("replica")
+	one.ExpectChanges("replica", "a.txt")
+	two.ExpectNoOutput(100 * time.Millisecond)
+
+	b.Inject(t, "/two", fsmonitor.Event{Path: "/two/b.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/two")
+	two.ExpectNotification("replica")
+	two.ExpectChanges("replica", "b.txt")
+	one.ExpectNoOutput(100 * time.Millisecond)
+}
+
+func TestSessionsShareWatches(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	fsm, err := New(withStderr(&syncBuffer{}), withBackend(b))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+	defer fsm.Close()
+
+	one := newSessionClient(t, fsm)
+	two := newSessionClient(t, fsm)
+
+	one.Handshake()
+	two.Handshake()
+	one.Start("replica", "/r", "foo")
+	two.Start("replica", "/r", "bar")
+
+	if n := b.Watches(); n != 1 {
+		t.Fatalf("Expecting 1 watch, got: %d", n)
+	}
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/bar/b.txt", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+	one.ExpectChanges("replica", "foo/a.txt")
+	two.ExpectChanges("replica", "bar/b.txt")
+
+	// The replicas of a session are reset when it ends, which releases the
+	// watch once the other session ends too.
+	one.Close()
+	if n := b.Active(); n != 1 {
+		t.Errorf("Expecting the watch to stay active, got %d active", n)
+	}
+	two.Close()
+	waitFor(t, "the watch to be released", func() bool { return b.Active() == 0 })
+}
+
+func TestListener(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	fsm, err := New(withStderr(&syncBuffer{}), withBackend(b))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+	defer fsm.Close()
+
+	path := filepath.Join(makeTempDir(t), "sessions.sock")
+	l, err := fsm.Listen(path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- l.Serve()
+	}()
+
+	one := dialClient(t, path)
+	two := dialClient(t, path)
+	one.Handshake()
+	two.Handshake()
+	one.Start("replica", "/one", "")
+	two.Start("replica", "/two", "")
+	one.Wait("replica")
+	two.Wait("replica")
+
+	b.Inject(t, "/two", fsmonitor.Event{Path: "/two/b.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/two")
+	two.ExpectNotification("replica")
+	two.ExpectChanges("replica", "b.txt")
+	one.ExpectNoOutput(100 * time.Millisecond)
+
+	if s := fsm.status(); s.Sessions != 2 || len(s.Replicas) != 2 {
+		t.Errorf("Expecting 2 sessions with a replica each, got: %+v", s)
+	}
+
+	// Closing the listener lets the running sessions go on.
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Errorf("The listener still accepts sessions after Close")
+	}
+	two.Send("CHANGES", "replica")
+	two.Expect("DONE")
+
+	one.Close()
+	two.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	case <-time.After(defaultClientTimeout):
+		t.Fatalf("Timed out waiting for Serve to return")
+	}
+	waitFor(t, "the watches to be released", func() bool { return b.Active() == 0 })
+}
@@ -0,0 +1,37 @@
+// +build !windows
+
+package unisonfsmonitor
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals installs handlers that change the log level of a running
+// monitor: SIGUSR1 raises the verbosity by one level and SIGUSR2 lowers it.
+// SIGINT and SIGTERM shut the monitor down, so that its owner gets to Close
+// it.
+func (fsm *UnisonFSMonitor) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			var l logLevel
+
+			switch sig {
+			case syscall.SIGUSR1:
+				l = fsm.adjustLogLevel(1)
+			case syscall.SIGUSR2:
+				l = fsm.adjustLogLevel(-1)
+			default:
+				fsm.info("Shutting down on %s", sig)
+				fsm.shutdown()
+				continue
+			}
+			// Always report the change, even if the new level would hide it.
+			fsm.logger("INFO", "Log level set to %s", l)
+		}
+	}()
+}
@@ -0,0 +1,45 @@
+package unisonfsmonitor
+
+import (
+	"errors"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/sink"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// startSinks subscribes each sink to the changes of the monitor until Close.
+func (fsm *UnisonFSMonitor) startSinks() error {
+	if fsm.monitor == nil {
+		return errors.New("Unable to send changes to sinks: no filesystem event backend is available on this platform")
+	}
+
+	for _, s := range fsm.sinks {
+		fsm.sinksDone.Add(1)
+		go fsm.pumpSink(s, fsm.monitor.Subscribe())
+	}
+	return nil
+}
+
+// pumpSink hands the changes of the replicas of Unison to s until the
+// subscription ends. The monitor also watches the roots of Watchman clients,
+// whose changes are left out.
+func (fsm *UnisonFSMonitor) pumpSink(s sink.Sink, sub *fsmonitor.Subscription) {
+	defer fsm.sinksDone.Done()
+
+	for b := range sub.C {
+		if _, ok := fsm.watched.Load(b.Replica); !ok {
+			continue
+		}
+
+		err := s.Send(sink.NewRecord(b, time.Now()))
+		switch {
+		case err == sink.ErrNoReader:
+			if fsm.debugEnabled() {
+				fsm.debug("Dropped the changes of replica %s: %v", b.Replica.Name(), err)
+			}
+		case err != nil:
+			fsm.warn("Unable to send the changes of replica %s: %v", b.Replica.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package unisonfsmonitor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/sink"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// recordingSink keeps the records it is sent.
+type recordingSink struct {
+	records chan sink.Record
+	closed  chan empty
+}
+
+func (s *recordingSink) Send(r sink.Record) error {
+	s.records <- r
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := fsmonitortest.NewBackend()
+	s := &recordingSink{records: make(chan sink.Record, 10), closed: make(chan empty)}
+	var buf syncBuffer
+	ndjson := sink.NewNDJSON(&buf)
+	c := newUnisonClient(t, withBackend(b), WithSink(s), WithSink(ndjson))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", dir, "sub")
+	c.Wait("replica")
+
+	b.Inject(t, dir,
+		fsmonitor.Event{Path: filepath.Join(dir, "sub/a.txt"), Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: filepath.Join(dir, "sub/b.txt"), Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: filepath.Join(dir, "other.txt"), Flags: fsmonitor.EventModified},
+	)
+	b.Sync(t, dir)
+
+	// The session goes on as usual.
+	c.ExpectNotification("replica")
+	c.ExpectChanges("replica", "sub/a.txt", "sub/b.txt")
+
+	var r sink.Record
+	select {
+	case r = <-s.records:
+	case <-time.After(fsmonitortest.Timeout):
+		t.Fatalf("Timed out waiting for a record")
+	}
+	if r.Replica != "replica" || r.Root != dir || strings.Join(r.Paths, ",") != "sub/a.txt,sub/b.txt" ||
+		strings.Join(r.Events, ",") != "created,modified" || r.Seq != 1 || r.Time.IsZero() {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+
+	c.fsm.Close()
+	select {
+	case <-s.closed:
+	default:
+		t.Errorf("Expecting Close to close the sinks")
+	}
+
+	var line sink.Record
+	if err := json.Unmarshal([]byte(buf.String()), &line); err != nil || line.Seq != 1 {
+		t.Errorf("Expecting a line for the batch, got %q (%v)", buf.String(), err)
+	}
+}
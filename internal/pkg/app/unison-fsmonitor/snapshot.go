@@ -0,0 +1,173 @@
+package unisonfsmonitor
+
+import (
+	"sort"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/snapshot"
+)
+
+// beginRestore tells whether path of root still has to be restored from its
+// snapshot. Each path is restored once per monitor, since a later START for
+// it finds its changes already being tracked. When it returns true, the
+// returned channel is to be closed once the restore is done, and a path is
+// not saved before then so that the changes in its old snapshot are never
+// lost.
+func (fsm *UnisonFSMonitor) beginRestore(root, path string) (chan empty, bool) {
+	fsm.snapshotMutex.Lock()
+	defer fsm.snapshotMutex.Unlock()
+
+	key := restoreKey(root, path)
+	if _, ok := fsm.restores[key]; ok {
+		return nil, false
+	}
+	done := make(chan empty)
+	fsm.restores[key] = done
+	return done, true
+}
+
+// restored returns the channel closed once path of root has been restored,
+// or false if it never started to be.
+func (fsm *UnisonFSMonitor) restored(root, path string) (chan empty, bool) {
+	fsm.snapshotMutex.Lock()
+	defer fsm.snapshotMutex.Unlock()
+
+	done, ok := fsm.restores[restoreKey(root, path)]
+	return done, ok
+}
+
+// restoreSnapshot reports the changes made to path of the replica while no
+// monitor was running: the changes that were still pending when the snapshot
+// was saved and everything that differs between the snapshot and the tree.
+// It closes done, as returned by beginRestore, when it is finished.
+func (fsm *UnisonFSMonitor) restoreSnapshot(r *replica, path string, done chan empty) {
+	defer close(done)
+
+	s, err := snapshot.Load(fsm.snapshotDir, r.root)
+	if err != nil {
+		fsm.warn("%v", err)
+		return
+	}
+	if s == nil {
+		return
+	}
+
+	var changes []string
+	for _, p := range s.Pending {
+		if snapshot.Under(p, path) {
+			changes = append(changes, p)
+		}
+	}
+	if s.Covers(path) {
+		start := time.Now()
+		current, err := snapshot.Scan(r.root, path)
+		if err != nil {
+			fsm.warn("Unable to scan %s for changes since the last snapshot: %v", r.root, err)
+		} else {
+			changes = append(changes, s.Diff(path, current)...)
+		}
+		if fsm.debugEnabled() {
+			fsm.debug("Scanned %d entries of %s/%s in %s", len(current), r.root, path, time.Since(start))
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	fsm.info("Reporting %d changes to replica %s since the snapshot of %s", len(changes), r.name, s.Saved.Format(time.RFC3339))
+	for i, p := range changes {
+		changes[i] = r.watched.Respell(p)
+	}
+	fsm.addChanges(r, changes)
+}
+
+// saveSnapshots saves a snapshot of the watched paths of every root, along
+// with the changes not yet reported to Unison. A path still being restored
+// is waited for before it is saved.
+func (fsm *UnisonFSMonitor) saveSnapshots() {
+	fsm.saveMutex.Lock()
+	defer fsm.saveMutex.Unlock()
+
+	roots := make(map[string][]*replica)
+	fsm.rangeReplicas(func(r *replica) bool {
+		roots[r.root] = append(roots[r.root], r)
+		return true
+	})
+
+	for root, replicas := range roots {
+		s, err := snapshot.Load(fsm.snapshotDir, root)
+		if err != nil {
+			fsm.warn("%v", err)
+		}
+		if s == nil {
+			s = snapshot.New(root)
+		}
+
+		// Changes from the previous snapshot are kept unless they were
+		// restored, in which case they are pending below if still unreported.
+		pending := set.New()
+		for _, p := range s.Pending {
+			pending.Add(p)
+		}
+
+		for _, r := range replicas {
+			for _, path := range r.watched.Paths() {
+				done, ok := fsm.restored(root, path)
+				if !ok {
+					continue
+				}
+				<-done
+
+				entries, err := snapshot.Scan(root, path)
+				if err != nil {
+					fsm.warn("Unable to scan %s for a snapshot: %v", root, err)
+					continue
+				}
+				s.Update(path, entries)
+
+				for _, p := range s.Pending {
+					if snapshot.Under(p, path) {
+						pending.Remove(p)
+					}
+				}
+			}
+
+			fsm.changesMutex.Lock()
+			if c, ok := r.owner.replicaChanges.Load(r.name); ok {
+				for _, p := range c.(*set.Set).StringSlice() {
+					pending.Add(p)
+				}
+			}
+			fsm.changesMutex.Unlock()
+		}
+
+		s.Pending = pending.StringSlice()
+		sort.Strings(s.Pending)
+
+		if err := s.Save(fsm.snapshotDir); err != nil {
+			fsm.warn("Unable to save the snapshot of %s: %v", root, err)
+		} else if fsm.debugEnabled() {
+			fsm.debug("Saved snapshot of %s with %d entries", root, len(s.Entries))
+		}
+	}
+}
+
+// snapshotLoop saves the snapshots periodically until Close is called.
+func (fsm *UnisonFSMonitor) snapshotLoop() {
+	ticker := time.NewTicker(fsm.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fsm.saveSnapshots()
+		case <-fsm.snapshotStop:
+			return
+		}
+	}
+}
+
+func restoreKey(root, path string) string {
+	return root + "\x00" + path
+}
@@ -0,0 +1,166 @@
+package unisonfsmonitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	root := makeTempDir(t)
+	defer os.RemoveAll(root)
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(root, "foo/a.txt"), "a")
+	writeTestFile(t, filepath.Join(root, "foo/b.txt"), "b")
+	writeTestFile(t, filepath.Join(root, "bar/c.txt"), "c")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithSnapshotDir(dir, 0))
+	c.Handshake()
+	c.Start("replica", root, "foo")
+	c.fsm.Close()
+	c.Close()
+
+	// Change the tree while no monitor is running.
+	writeTestFile(t, filepath.Join(root, "foo/a.txt"), "changed")
+	os.Remove(filepath.Join(root, "foo/b.txt"))
+	writeTestFile(t, filepath.Join(root, "foo/d/e.txt"), "e")
+	writeTestFile(t, filepath.Join(root, "bar/c.txt"), "not watched")
+
+	c = newUnisonClient(t, withBackend(b), WithSnapshotDir(dir, 0))
+	defer c.Close()
+	defer c.fsm.Close()
+
+	c.Handshake()
+	c.Start("replica", root, "foo")
+	c.Wait("replica")
+	c.ExpectNotification("replica")
+	c.ExpectChanges("replica", "foo/a.txt", "foo/b.txt", "foo/d")
+
+	// A second START for the path does not report the changes again.
+	c.Start("replica", root, "foo")
+	c.Wait("replica")
+	c.ExpectNoOutput(100 * time.Millisecond)
+}
+
+func TestSnapshotPendingChanges(t *testing.T) {
+	t.Parallel()
+
+	root := makeTempDir(t)
+	defer os.RemoveAll(root)
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(root, "foo/a.txt"), "a")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithSnapshotDir(dir, 0))
+	c.Handshake()
+	c.Start("replica", root, "foo")
+	b.Inject(t, root, fsmonitor.Event{Path: filepath.Join(root, "foo/a.txt"), Flags: fsmonitor.EventModified})
+	b.Sync(t, root)
+	c.fsm.Close()
+	c.Close()
+
+	// The change was never asked for, so the next monitor reports it.
+	c = newUnisonClient(t, withBackend(b), WithSnapshotDir(dir, 0))
+	defer c.Close()
+	defer c.fsm.Close()
+
+	c.Handshake()
+	c.Start("replica", root, "foo")
+	c.Wait("replica")
+	c.ExpectNotification("replica")
+	c.ExpectChanges("replica", "foo/a.txt")
+}
+
+func TestSnapshotWithoutSnapshot(t *testing.T) {
+	t.Parallel()
+
+	root := makeTempDir(t)
+	defer os.RemoveAll(root)
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(root, "a.txt"), "a")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithSnapshotDir(dir, 0))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", root, "")
+	c.Wait("replica")
+	c.ExpectNoOutput(100 * time.Millisecond)
+
+	if err := c.fsm.Close(); err != nil {
+		t.Fatalf("Unable to close the monitor: %v", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected a snapshot to be saved, got: %v", files)
+	}
+}
+
+func TestSnapshotSaveDoesNotBlockStart(t *testing.T) {
+	t.Parallel()
+
+	root := makeTempDir(t)
+	defer os.RemoveAll(root)
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithSnapshotDir(dir, 0))
+	defer c.Close()
+	defer c.fsm.Close()
+
+	// Hold up the restore of foo as if it were scanning a large tree.
+	done, ok := c.fsm.beginRestore(root, "foo")
+	if !ok {
+		t.Fatalf("Expected foo to need a restore")
+	}
+	c.Handshake()
+	c.Start("replica", root, "foo")
+
+	saved := make(chan empty)
+	go func() {
+		c.fsm.saveSnapshots()
+		close(saved)
+	}()
+
+	// Neither the restore nor the save waiting for it hold up the session.
+	c.Start("replica", root, "bar")
+	select {
+	case <-saved:
+		t.Fatalf("The snapshot of foo was saved before it was restored")
+	default:
+	}
+
+	close(done)
+	select {
+	case <-saved:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the snapshots to be saved")
+	}
+}
@@ -0,0 +1,169 @@
+package unisonfsmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+// statusTimeout bounds how long sending or reading a status may take.
+const statusTimeout = 5 * time.Second
+
+// Status is a snapshot of the state of a running monitor as served on the
+// status socket.
+type Status struct {
+	PID      int             `json:"pid"`
+	Started  time.Time       `json:"started"`
+	LogLevel string          `json:"log_level"`
+	Sessions int             `json:"sessions"`
+	Replicas []ReplicaStatus `json:"replicas"`
+}
+
+// ReplicaStatus is the state of a single replica within a Status.
+type ReplicaStatus struct {
+	Name           string     `json:"name"`
+	Root           string     `json:"root"`
+	Paths          []string   `json:"paths"`
+	Dirs           []string   `json:"dirs"`
+	Backend        string     `json:"backend"`
+	Watch          string     `json:"watch"`
+	Waiting        bool       `json:"waiting"`
+	Reported       bool       `json:"reported"`
+	PendingChanges int        `json:"pending_changes"`
+	LastEvent      *time.Time `json:"last_event,omitempty"`
+	// Cursor is the position in the change log of the replica, for
+	// fsmonitor.Replica.ChangesSince.
+	Cursor string `json:"cursor"`
+}
+
+// status takes a snapshot of the monitor's state.
+func (fsm *UnisonFSMonitor) status() Status {
+	s := Status{
+		PID:      os.Getpid(),
+		Started:  fsm.started,
+		LogLevel: fsm.getLogLevel().String(),
+		Replicas: []ReplicaStatus{},
+	}
+
+	sets := fsm.allReplicaSets()
+	fsm.changesMutex.Lock()
+	for _, rs := range sets {
+		s.Sessions += len(rs.sessions)
+	}
+	fsm.changesMutex.Unlock()
+
+	fsm.rangeReplicas(func(r *replica) bool {
+		rs := ReplicaStatus{
+			Name:    r.name,
+			Root:    r.root,
+			Paths:   r.watched.Paths(),
+			Dirs:    r.watched.Dirs(),
+			Backend: r.backend,
+			Watch:   r.watched.Watch(),
+			Cursor:  r.watched.Cursor().String(),
+		}
+
+		fsm.changesMutex.Lock()
+		for session := range r.owner.sessions {
+			rs.Waiting = rs.Waiting || session.replicaWaiting.Has(r.name)
+			rs.Reported = rs.Reported || session.replicaReportedChanges.Has(r.name)
+		}
+		if c, ok := r.owner.replicaChanges.Load(r.name); ok {
+			rs.PendingChanges = c.(*set.Set).Size()
+		}
+		fsm.changesMutex.Unlock()
+
+		if last := r.watched.LastEvent(); !last.IsZero() {
+			rs.LastEvent = &last
+		}
+
+		s.Replicas = append(s.Replicas, rs)
+		return true
+	})
+	sort.Slice(s.Replicas, func(i, j int) bool {
+		return s.Replicas[i].Name < s.Replicas[j].Name
+	})
+
+	return s
+}
+
+// socketPath returns the path of the socket to listen on. When path is a
+// directory, every monitor gets its own socket in it, named after its pid
+// with the extension ext, so that all of the monitors started by Unison can
+// be queried together.
+func socketPath(path, ext string) string {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return fmt.Sprintf("%s/unison-fsmonitor-%d%s", path, os.Getpid(), ext)
+	}
+	return path
+}
+
+// listenStatus starts serving the status of the monitor on a Unix domain
+// socket. Every connection gets one JSON document and is then closed.
+func (fsm *UnisonFSMonitor) listenStatus(path string) error {
+	path = socketPath(path, ".sock")
+
+	// A socket left behind by a monitor that did not shut down cleanly
+	// would make the listen fail, but only remove it if nobody answers.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("Status socket %s is in use by another monitor", path)
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("Unable to listen on status socket: %v", err)
+	}
+	// The status tells which trees are being watched, so keep other users
+	// out.
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("Unable to set the permissions of the status socket: %v", err)
+	}
+	fsm.statusListener = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			// A client that does not read its status must not hold up
+			// the others.
+			go func() {
+				defer conn.Close()
+				conn.SetWriteDeadline(time.Now().Add(statusTimeout))
+				if err := json.NewEncoder(conn).Encode(fsm.status()); err != nil {
+					fsm.warn("Unable to send status: %v", err)
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// ReadStatus connects to the status socket of a monitor and returns its
+// status.
+func ReadStatus(path string) (Status, error) {
+	var s Status
+
+	conn, err := net.DialTimeout("unix", path, statusTimeout)
+	if err != nil {
+		return s, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statusTimeout))
+
+	if err := json.NewDecoder(conn).Decode(&s); err != nil {
+		return s, fmt.Errorf("Unable to decode status from %s: %v", path, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,177 @@
+package unisonfsmonitor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+func TestStatusSocket(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "status.sock")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithStatusSocket(socket))
+	defer c.Close()
+	defer c.fsm.Close()
+
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expecting a socket only the user can access, got %v %v", fi, err)
+	}
+	s, err := ReadStatus(socket)
+	if err != nil {
+		t.Fatalf("Unable to read status: %v", err)
+	}
+	if s.PID != os.Getpid() || len(s.Replicas) != 0 {
+		t.Errorf("Unexpected status before START: %+v", s)
+	}
+
+	c.Handshake()
+	c.Start("replica", "/r", "foo", "foo/a", "foo/b")
+	c.Start("other", "/o", "")
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/foo/a/x.txt", Flags: fsmonitor.EventCreated})
+	c.Wait("replica")
+	c.ExpectNotification("replica")
+
+	s, err = ReadStatus(socket)
+	if err != nil {
+		t.Fatalf("Unable to read status: %v", err)
+	}
+	if len(s.Replicas) != 2 {
+		t.Fatalf("Expecting 2 replicas, got: %+v", s.Replicas)
+	}
+
+	other, r := s.Replicas[0], s.Replicas[1]
+	if other.Name != "other" || other.Root != "/o" || other.PendingChanges != 0 || other.LastEvent != nil || other.Waiting {
+		t.Errorf("Unexpected status for other: %+v", other)
+	}
+	if r.Name != "replica" || r.Root != "/r" || r.Backend != "fake" {
+		t.Errorf("Unexpected status for replica: %+v", r)
+	}
+	if !reflect.DeepEqual(r.Paths, []string{"foo"}) || !reflect.DeepEqual(r.Dirs, []string{"foo/a", "foo/b"}) {
+		t.Errorf("Unexpected paths or dirs for replica: %q %q", r.Paths, r.Dirs)
+	}
+	if !r.Waiting || !r.Reported || r.PendingChanges != 1 || r.LastEvent == nil {
+		t.Errorf("Unexpected change state for replica: %+v", r)
+	}
+	if c, err := fsmonitor.ParseCursor(r.Cursor); err != nil || c.Seq != 1 {
+		t.Errorf("Expecting the replica to be at the first batch, got cursor %q", r.Cursor)
+	}
+
+	c.ExpectChanges("replica", "foo/a/x.txt")
+}
+
+func TestStatusSocketDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	fsm, err := makeUnisonFSMonitor(WithStatusSocket(dir))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+
+	socket := filepath.Join(dir, fmt.Sprintf("unison-fsmonitor-%d.sock", os.Getpid()))
+	if _, err := ReadStatus(socket); err != nil {
+		t.Fatalf("Unable to read status: %v", err)
+	}
+
+	// A second monitor must not take over a socket that is in use.
+	if _, err := makeUnisonFSMonitor(WithStatusSocket(dir)); err == nil {
+		t.Errorf("Expected an error for a socket in use")
+	}
+
+	if err := fsm.Close(); err != nil {
+		t.Errorf("Unable to close the monitor: %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got: %v", err)
+	}
+}
+
+func TestStatusSocketStale(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "status.sock")
+
+	// Leave a file behind the way a crashed monitor would.
+	f, err := os.Create(socket)
+	if err != nil {
+		t.Fatalf("Unable to create stale socket: %v", err)
+	}
+	f.Close()
+
+	fsm, err := makeUnisonFSMonitor(WithStatusSocket(socket))
+	if err != nil {
+		t.Fatalf("Failure creating UnisonFSMonitor: %v", err)
+	}
+	defer fsm.Close()
+
+	if _, err := ReadStatus(socket); err != nil {
+		t.Errorf("Unable to read status: %v", err)
+	}
+}
+
+func TestStatusSocketClosedOnError(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "status.sock")
+
+	fail := func(*UnisonFSMonitor) error {
+		return errors.New("failed")
+	}
+	if _, err := makeUnisonFSMonitor(WithStatusSocket(socket), fail); err == nil {
+		t.Fatalf("Expected an error from the failing option")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got: %v", err)
+	}
+}
+
+func TestStatusSlowClient(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "status.sock")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithStatusSocket(socket))
+	defer c.Close()
+
+	// Make the status larger than the buffer of the socket.
+	var dirs []string
+	for i := 0; i < 4000; i++ {
+		dirs = append(dirs, fmt.Sprintf("foo/%s%d", strings.Repeat("d", 200), i))
+	}
+	c.Handshake()
+	c.Start("replica", "/r", "foo", dirs...)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Unable to connect to the status socket: %v", err)
+	}
+	defer conn.Close()
+
+	// The client above never reads, which must not keep others waiting.
+	if s, err := ReadStatus(socket); err != nil || len(s.Replicas) != 1 {
+		t.Errorf("Unable to read status while another client does not: %v", err)
+	}
+}
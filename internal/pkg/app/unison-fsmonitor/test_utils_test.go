@@ -0,0 +1,92 @@
+package unisonfsmonitor
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "unison-fsmonitor")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("Unable to get the real path of the tempdir: %v", err)
+	}
+
+	return dir
+}
+
+func makeUnisonFSMonitor(options ...func(*UnisonFSMonitor) error) (*UnisonFSMonitor, error) {
+	fsm, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsm, nil
+}
+
+// The below functions are for assigning the stdin, stdout and stderr that
+// unison-fsmonitor uses to communicate with the Unison process. Every test
+// passes its own readers and writers so that tests can run in parallel.
+func withStdin(r io.Reader) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		fsm.stdin = r
+		return nil
+	}
+}
+
+func withStdout(w io.Writer) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		fsm.stdout = w
+		return nil
+	}
+}
+
+func withStderr(w io.Writer) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		fsm.stderr = w
+		return nil
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written by the monitor's
+// goroutines while the test reads it.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.buf.Reset()
+}
+
+// withBackend makes the monitor use the given backend instead of the native
+// one.
+func withBackend(b fsmonitor.Backend) func(*UnisonFSMonitor) error {
+	return func(fsm *UnisonFSMonitor) error {
+		fsm.backend = b
+		return nil
+	}
+}
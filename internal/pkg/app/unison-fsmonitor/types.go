@@ -1,21 +1,29 @@
-// +build darwin
-
 package unisonfsmonitor
 
 import (
 	"bufio"
+	"context"
 	"io"
+	"net"
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/metrics"
 	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/sink"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/transcript"
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/watchman"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
 )
 
-const (
-	defaultLatency                  = 500 * time.Millisecond
-	defaultPendingEventsChannelSize = 10
-	defaultEventsChannelSize        = 10
-)
+// DefaultSnapshotInterval is how often snapshots are saved unless
+// configured otherwise.
+const DefaultSnapshotInterval = 5 * time.Minute
+
+// DefaultSelfTestTimeout is how long each step of SelfTest waits for the
+// monitor unless configured otherwise.
+const DefaultSelfTestTimeout = 10 * time.Second
 
 type empty struct{}
 type emptyMap map[string]empty
@@ -23,22 +31,126 @@ type emptyMap map[string]empty
 // UnisonFSMonitor is the controlling structure for the filesystem monitor.
 // The structure can accomodate multiple replicas being monitored. Fields
 // relating replicas are sync.Map types which are go-routine-safe types.
+//
+// A UnisonFSMonitor speaks the protocol with a single Unison process. The
+// replicas it knows about are kept in a replica set and their watches in a
+// state that are both shared with the other sessions of a daemon.
 type UnisonFSMonitor struct {
-	debugEnabled                bool
-	protocolVersion             float64
-	eventsChannelSize           int
-	pendingEventsChannelSize    int
-	ShutdownChannel             chan empty
-	shuttingDown                bool
-	stdin                       io.Reader
-	stdout                      io.Writer
-	stderr                      io.Writer
-	reader                      *bufio.Reader
-	replicaRoot                 *sync.Map
-	replicaPaths                *sync.Map
-	replicaEventStream          *sync.Map
-	replicaEndMonitoringChannel *sync.Map
-	replicaWaiting              *set.Set
-	replicaChanges              *sync.Map
-	replicaReportedChanges      *set.Set
+	*state
+	*replicaSet
+	protocolVersion        float64
+	ShutdownChannel        chan empty
+	shuttingDown           int32
+	stdin                  io.Reader
+	stdout                 io.Writer
+	reader                 *bufio.Reader
+	outputMutex            *sync.Mutex
+	transcript             *transcript.Recorder
+	replicaWaiting         *set.Set
+	replicaReportedChanges *set.Set
+	// notifications holds the replicas the notifier is to tell Unison
+	// about. It is guarded by the changes mutex.
+	notifications *set.Set
+	notify        chan empty
+	sessionDone   chan empty
+}
+
+// state is what outlives a protocol session: the watches and the resources
+// of the monitor as a whole. The watching itself is done by a
+// fsmonitor.Monitor, which is only there if a backend is.
+type state struct {
+	logLevel         int32
+	stderr           io.Writer
+	changesMutex     *sync.Mutex
+	backend          fsmonitor.Backend
+	monitor          *fsmonitor.Monitor
+	stopMonitor      context.CancelFunc
+	monitorDone      chan empty
+	started          time.Time
+	statusListener   net.Listener
+	metrics          *monitorMetrics
+	metricsAddress   string
+	metricsServer    *http.Server
+	caseFolding      string
+	snapshotDir      string
+	snapshotInterval time.Duration
+	watchmanSocket   string
+	watchman         *watchman.Server
+	sinks            []sink.Sink
+	sinksDone        *sync.WaitGroup
+	saveMutex        *sync.Mutex
+	snapshotStop     chan empty
+	snapshotMutex    *sync.Mutex
+	closed           int32
+	// restores maps the root and path of each restore from a snapshot to
+	// the channel closed once it is done. It is guarded by the snapshot
+	// mutex.
+	restores map[string]chan empty
+	// watched maps the replicas of the monitor to ours.
+	watched *sync.Map
+	// replicaSets holds every replica set of the monitor. It is guarded by
+	// the changes mutex.
+	replicaSets map[*replicaSet]empty
+	// listeners holds the sockets sessions are accepted on. It is guarded
+	// by the changes mutex.
+	listeners map[*Listener]empty
+}
+
+// replicaSet is a namespace of replicas together with the changes not yet
+// reported for them. The sessions of a daemon share a single set, while the
+// sessions of a Listener each get their own. The replicas of a set that is
+// not kept are reset when its last session ends.
+type replicaSet struct {
+	replicas            *sync.Map
+	replicaChanges      *sync.Map
+	replicaChangesSince *sync.Map
+	keep                bool
+	// sessions holds the sessions using the set. It is guarded by the
+	// changes mutex.
+	sessions map[*UnisonFSMonitor]empty
+}
+
+// replica holds what the monitor knows about a single replica: where it
+// lives and the replica of the fsmonitor.Monitor watching what Unison asked
+// to be watched.
+type replica struct {
+	name    string
+	root    string
+	backend string
+	owner   *replicaSet
+	watched *fsmonitor.Replica
+	// removed is set when the replica is reset. It is guarded by the
+	// changes mutex.
+	removed bool
+}
+
+// monitorMetrics are the metrics the monitor keeps about itself. They are
+// always kept, but only exposed when asked for with WithMetrics.
+type monitorMetrics struct {
+	registry        *metrics.Registry
+	eventsReceived  *metrics.Counter
+	eventsFiltered  *metrics.CounterVec
+	overflows       *metrics.Counter
+	changesReported *metrics.Counter
+	changesRequests *metrics.Counter
+	rollups         *metrics.Counter
+	commandsSent    *metrics.CounterVec
+	backendRestarts *metrics.Counter
+	reportLatency   *metrics.Histogram
+}
+
+// SelfTestStep is the outcome of a step of SelfTest.
+type SelfTestStep struct {
+	Name string
+	// Latency is how long the monitor took to answer, or for a change, how
+	// long it took for the change to be reported.
+	Latency time.Duration
+	Err     error
+}
+
+// selfTestClient plays the part of Unison in a self test.
+type selfTestClient struct {
+	w        io.Writer
+	lines    chan string
+	deadline time.Time
 }
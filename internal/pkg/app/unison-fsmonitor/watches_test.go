@@ -0,0 +1,104 @@
+package unisonfsmonitor
+
+import (
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+func TestSharedWatchSameRoot(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("one", "/r", "foo")
+	c.Start("two", "/r/", "bar")
+
+	if n := b.Watches(); n != 1 {
+		t.Fatalf("Expecting 1 watch, got: %d", n)
+	}
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/foo/a.txt", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/bar/b.txt", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+
+	c.ExpectChanges("one", "foo/a.txt")
+	c.ExpectChanges("two", "bar/b.txt")
+
+	c.Reset("one")
+	c.ExpectChanges("two")
+	if n := b.Active(); n != 1 {
+		t.Errorf("Expecting the watch to stay active, got %d active", n)
+	}
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/bar/c.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+	c.ExpectChanges("two", "bar/c.txt")
+
+	c.Reset("two")
+	c.ExpectChanges("two")
+	if n := b.Active(); n != 0 {
+		t.Errorf("Expecting no active watches, got: %d", n)
+	}
+}
+
+func TestSharedWatchNestedRoot(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("outer", "/r", "")
+	c.Start("inner", "/r/sub", "dir")
+	c.Start("other", "/rs", "")
+
+	if n := b.Watches(); n != 2 {
+		t.Fatalf("Expecting 2 watches, got: %d", n)
+	}
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/sub/dir/a.txt", Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: "/r/sub/b.txt", Flags: fsmonitor.EventModified},
+	)
+	b.Sync(t, "/r")
+
+	c.ExpectChanges("outer", "sub/b.txt", "sub/dir/a.txt")
+	c.ExpectChanges("inner", "dir/a.txt")
+	c.ExpectChanges("other")
+}
+
+func TestSharedWatchNotification(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("one", "/r", "")
+	c.Start("two", "/r", "")
+	c.Wait("one", "two")
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a.txt", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+
+	// Both replicas are notified, in either order.
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		seen[c.ReadLine()] = true
+	}
+	if !seen["CHANGES one"] || !seen["CHANGES two"] {
+		t.Errorf("Expecting notifications for both replicas, got: %v", seen)
+	}
+
+	c.ExpectChanges("one", "a.txt")
+	c.ExpectChanges("two", "a.txt")
+}
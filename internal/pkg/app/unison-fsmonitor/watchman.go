@@ -0,0 +1,33 @@
+package unisonfsmonitor
+
+import (
+	"errors"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/watchman"
+)
+
+// serveWatchman serves the Watchman protocol on the Watchman socket until
+// Close.
+func (fsm *UnisonFSMonitor) serveWatchman() error {
+	if fsm.monitor == nil {
+		return errors.New("Unable to serve the Watchman protocol: no filesystem event backend is available on this platform")
+	}
+
+	s, err := watchman.NewServer(fsm.monitor)
+	if err != nil {
+		return err
+	}
+	if err := s.Listen(fsm.watchmanSocket); err != nil {
+		return err
+	}
+	fsm.watchman = s
+
+	go func() {
+		if err := s.Serve(); err != nil {
+			fsm.warn("%v", err)
+		}
+	}()
+	fsm.info("Serving the Watchman protocol on %s", fsm.watchmanSocket)
+
+	return nil
+}
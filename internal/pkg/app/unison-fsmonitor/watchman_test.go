@@ -0,0 +1,128 @@
+package unisonfsmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+func TestWatchmanSocket(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Unable to create the root: %v", err)
+	}
+	socket := filepath.Join(dir, "watchman.sock")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithWatchmanSocket(socket))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", root, "")
+	c.Wait("replica")
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Unable to connect to the Watchman socket: %v", err)
+	}
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	request := func(req string) map[string]interface{} {
+		t.Helper()
+		fmt.Fprintln(conn, req)
+		var resp map[string]interface{}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("Unable to read the response to %s: %v", req, err)
+		}
+		if resp["error"] != nil {
+			t.Fatalf("Error response to %s: %v", req, resp["error"])
+		}
+		return resp
+	}
+
+	request(fmt.Sprintf(`["watch-project", %q]`, root))
+	if n := b.Watches(); n != 1 {
+		t.Errorf("Expected Watchman to share the watch of the replica, got %d watches", n)
+	}
+	clock := request(fmt.Sprintf(`["clock", %q, {"sync_timeout": 0}]`, root))["clock"]
+
+	// Both Unison and the Watchman client hear about the change.
+	b.Inject(t, root, fsmonitor.Event{Path: filepath.Join(root, "a.txt"), Flags: fsmonitor.EventCreated})
+	b.Sync(t, root)
+	c.ExpectNotification("replica")
+	c.ExpectChanges("replica", "a.txt")
+
+	resp := request(fmt.Sprintf(`["query", %q, {"since": %q, "fields": ["name"], "sync_timeout": 0}]`, root, clock))
+	if files := resp["files"]; !reflect.DeepEqual(files, []interface{}{"a.txt"}) {
+		t.Errorf("Expected a.txt to have changed, got %v", files)
+	}
+
+	c.fsm.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected Close to remove the Watchman socket")
+	}
+}
+
+func TestWatchmanCookiesNotReported(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "watchman.sock")
+
+	b := fsmonitortest.NewBackend()
+	c := newUnisonClient(t, withBackend(b), WithWatchmanSocket(socket))
+	defer c.Close()
+
+	c.Handshake()
+	c.Start("replica", dir, "")
+	c.Wait("replica")
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Unable to connect to the Watchman socket: %v", err)
+	}
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	fmt.Fprintf(conn, `["watch", %q]`+"\n", dir)
+	var resp map[string]interface{}
+	if err := dec.Decode(&resp); err != nil || resp["error"] != nil {
+		t.Fatalf("Unable to watch: %v %v", err, resp)
+	}
+
+	// Play the backend: deliver the events of the sync cookie of the clock
+	// request as it is written and removed.
+	go func() {
+		for {
+			names, _ := filepath.Glob(filepath.Join(dir, fsmonitor.CookiePrefix+"*"))
+			if len(names) > 0 {
+				b.Inject(t, dir, fsmonitor.Event{Path: names[0], Flags: fsmonitor.EventCreated})
+				b.Inject(t, dir, fsmonitor.Event{Path: names[0], Flags: fsmonitor.EventRemoved})
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	fmt.Fprintf(conn, `["clock", %q, {"sync_timeout": 10000}]`+"\n", dir)
+	if err := dec.Decode(&resp); err != nil || resp["error"] != nil {
+		t.Fatalf("Unable to get the clock: %v %v", err, resp)
+	}
+
+	// Unison is only told about the change made after the cookie.
+	b.Inject(t, dir, fsmonitor.Event{Path: filepath.Join(dir, "a.txt"), Flags: fsmonitor.EventCreated})
+	b.Sync(t, dir)
+	c.ExpectNotification("replica")
+	c.ExpectChanges("replica", "a.txt")
+}
@@ -0,0 +1,224 @@
+// Package doctor checks whether a monitor can watch a set of roots on this
+// machine: whether there is a backend, whether the roots exist and can be
+// read, whether symlinks lead to them, what filesystems hold them and
+// whether the backend can watch trees of their size.
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/profile"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// Inspect checks the replicas and the machine.
+func Inspect(replicas []profile.Replica) *Report {
+	r := &Report{Backend: "none"}
+
+	b := fsmonitor.DefaultBackend()
+	if b != nil {
+		r.Backend = b.Name()
+		r.add("", CheckBackend, LevelOK, "%s watches each root with a single stream", b.Name())
+	} else {
+		r.add("", CheckBackend, LevelProblem, "No filesystem event backend is available on %s, the monitor only runs on macOS", runtime.GOOS)
+	}
+
+	roots := &Report{}
+	dirs := 0
+	for _, replica := range replicas {
+		dirs += roots.inspectRoot(replica)
+	}
+	// Only a backend that is there has a budget to check against.
+	if b != nil && len(replicas) > 0 {
+		level, message := watchBudget(b.Name(), dirs)
+		r.add("", CheckWatchBudget, level, "%s", message)
+	}
+	r.Checks = append(r.Checks, roots.Checks...)
+
+	return r
+}
+
+// inspectRoot checks a replica and returns the number of directories below
+// its watched paths.
+func (r *Report) inspectRoot(replica profile.Replica) int {
+	root := replica.Root
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		r.add(root, CheckRoot, LevelProblem, "Unable to read the root: %v", err)
+		return 0
+	}
+	if !fi.IsDir() {
+		r.add(root, CheckRoot, LevelProblem, "The root is not a directory")
+		return 0
+	}
+	f, err := os.Open(root)
+	if err != nil {
+		r.add(root, CheckRoot, LevelProblem, "Unable to read the root: %v", err)
+		return 0
+	}
+	f.Close()
+	r.add(root, CheckRoot, LevelOK, "Watching the paths %s", strings.Join(displayPaths(replica.Paths), ", "))
+
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		real = root
+	}
+	if links := symlinks(root); len(links) > 0 {
+		r.add(root, CheckSymlinks, LevelWarning, "Symlinks lead to the root (%s): events are reported for its real path %s, which Unison has to be given as the root, while run and watch resolve it themselves", strings.Join(links, ", "), real)
+	} else {
+		r.add(root, CheckSymlinks, LevelOK, "No symlinks lead to the root")
+	}
+
+	switch info, err := filesystem(root); {
+	case err != nil:
+		r.add(root, CheckFilesystem, LevelWarning, "Unable to find the filesystem: %v", err)
+	case info.network:
+		r.add(root, CheckFilesystem, LevelWarning, "%s is a network filesystem: changes made through other machines are not reported, run the monitor where the files are", info.name)
+	case info.fuse:
+		r.add(root, CheckFilesystem, LevelWarning, "%s is a FUSE filesystem, which may not report changes", info.name)
+	default:
+		r.add(root, CheckFilesystem, LevelOK, "%s", info.name)
+	}
+
+	t := walk(real, replica.Paths)
+	switch {
+	case len(t.unreadable) > 0:
+		listed := t.unreadable
+		if len(listed) > maxListed {
+			listed = append(listed[:maxListed:maxListed], "...")
+		}
+		r.add(root, CheckTree, LevelWarning, "%d directories, %d files; %d directories cannot be read: %s", t.dirs, t.files, len(t.unreadable), strings.Join(listed, ", "))
+	case len(t.missing) > 0:
+		r.add(root, CheckTree, LevelWarning, "%d directories, %d files; the paths %s do not exist yet", t.dirs, t.files, strings.Join(t.missing, ", "))
+	default:
+		r.add(root, CheckTree, LevelOK, "%d directories, %d files", t.dirs, t.files)
+	}
+	return t.dirs
+}
+
+// watchBudget checks whether the backend named backend can watch trees with
+// dirs directories.
+func watchBudget(backend string, dirs int) (string, string) {
+	if backend == "fsevents" {
+		// FSEvents watches a tree with a single stream, whatever its size.
+		return LevelOK, fmt.Sprintf("FSEvents has no limit on the number of directories watched (%d)", dirs)
+	}
+	return LevelWarning, fmt.Sprintf("Unknown limit of %s for the %d directories to watch", backend, dirs)
+}
+
+// Problems returns the number of checks that found a problem.
+func (r *Report) Problems() int {
+	return r.count(LevelProblem)
+}
+
+// Warnings returns the number of checks that found something to look at.
+func (r *Report) Warnings() int {
+	return r.count(LevelWarning)
+}
+
+// Print writes the report as text.
+func (r *Report) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Backend: %s\n", r.Backend)
+	root := ""
+	for i, c := range r.Checks {
+		if i == 0 || c.Root != root {
+			root = c.Root
+			if root == "" {
+				fmt.Fprintf(tw, "\nMachine\n")
+			} else {
+				fmt.Fprintf(tw, "\nRoot %s\n", root)
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.Level, c.Name, c.Message)
+	}
+
+	if len(r.Settings) > 0 {
+		fmt.Fprintf(tw, "\nConfiguration\n")
+		for _, s := range r.Settings {
+			fmt.Fprintf(tw, "  %s\t%s\t(%s)\n", s.Name, s.Value, s.Source)
+		}
+	}
+
+	fmt.Fprintf(tw, "\n%d problems, %d warnings\n", r.Problems(), r.Warnings())
+	return tw.Flush()
+}
+
+func (r *Report) add(root, name, level, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, Check{Root: root, Name: name, Level: level, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) count(level string) int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Level == level {
+			n++
+		}
+	}
+	return n
+}
+
+// symlinks returns the symlinks along path, such as "/tmp -> private/tmp".
+func symlinks(path string) []string {
+	var links []string
+	parts := strings.Split(filepath.Clean(path), string(filepath.Separator))
+	for i := range parts {
+		p := strings.Join(parts[:i+1], string(filepath.Separator))
+		if p == "" {
+			continue
+		}
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, _ := os.Readlink(p)
+		links = append(links, p+" -> "+target)
+	}
+	return links
+}
+
+// walk counts the directories and files below the paths of root, without
+// following symlinks below root.
+func walk(root string, paths []string) tree {
+	var t tree
+	for _, p := range paths {
+		start := filepath.Join(root, p)
+		if _, err := os.Lstat(start); os.IsNotExist(err) {
+			t.missing = append(t.missing, p)
+			continue
+		}
+		filepath.Walk(start, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				t.unreadable = append(t.unreadable, path)
+				return nil
+			}
+			if fi.IsDir() {
+				t.dirs++
+			} else {
+				t.files++
+			}
+			return nil
+		})
+	}
+	return t
+}
+
+// displayPaths shows the root itself as ".".
+func displayPaths(paths []string) []string {
+	shown := make([]string, len(paths))
+	for i, p := range paths {
+		if p == "" {
+			p = "."
+		}
+		shown[i] = p
+	}
+	return shown
+}
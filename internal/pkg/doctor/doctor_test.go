@@ -0,0 +1,165 @@
+package doctor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/profile"
+)
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	// The tempdir may itself be reached through a symlink.
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("Unable to get the real path of the tempdir: %v", err)
+	}
+	return real
+}
+
+// check returns the check of root called name.
+func check(t *testing.T, r *Report, root, name string) Check {
+	t.Helper()
+
+	for _, c := range r.Checks {
+		if c.Root == root && c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("No %s check for %q in %+v", name, root, r.Checks)
+	return Check{}
+}
+
+func TestInspect(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{"a/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0700); err != nil {
+			t.Fatalf("Unable to create the tree: %v", err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(root, "a", "x"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(root, "c", "y"), nil, 0600)
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("root", link); err != nil {
+		t.Fatalf("Unable to create the symlink: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	r := Inspect([]profile.Replica{
+		{Root: root, Paths: []string{""}},
+		{Root: link, Paths: []string{"a", "d"}},
+		{Root: missing, Paths: []string{""}},
+	})
+
+	if c := check(t, r, "", CheckBackend); runtime.GOOS == "darwin" && c.Level != LevelOK || runtime.GOOS != "darwin" && c.Level != LevelProblem {
+		t.Errorf("Unexpected backend check %+v", c)
+	}
+	if c := check(t, r, root, CheckTree); c.Level != LevelOK || c.Message != "4 directories, 2 files" {
+		t.Errorf("Unexpected tree check %+v", c)
+	}
+	if c := check(t, r, root, CheckSymlinks); c.Level != LevelOK {
+		t.Errorf("Unexpected symlinks check %+v", c)
+	}
+	if c := check(t, r, link, CheckSymlinks); c.Level != LevelWarning || !strings.Contains(c.Message, link+" -> root") || !strings.Contains(c.Message, "real path "+root) {
+		t.Errorf("Unexpected symlinks check %+v", c)
+	}
+	// The tree is walked from the real path.
+	if c := check(t, r, link, CheckTree); c.Level != LevelWarning || c.Message != "2 directories, 1 files; the paths d do not exist yet" {
+		t.Errorf("Unexpected tree check %+v", c)
+	}
+	if c := check(t, r, missing, CheckRoot); c.Level != LevelProblem {
+		t.Errorf("Unexpected root check %+v", c)
+	}
+	check(t, r, root, CheckFilesystem)
+	// Without a backend there is no watch budget to check.
+	problems := 1
+	if r.Backend == "none" {
+		problems++
+		for _, c := range r.Checks {
+			if c.Name == CheckWatchBudget {
+				t.Errorf("Unexpected watch budget check without a backend %+v", c)
+			}
+		}
+	} else {
+		check(t, r, "", CheckWatchBudget)
+		if r.Checks[0].Name != CheckBackend || r.Checks[1].Name != CheckWatchBudget {
+			t.Errorf("Expecting the checks of the machine first, got %+v", r.Checks[:2])
+		}
+	}
+
+	if r.Problems() != problems {
+		t.Errorf("Expecting %d problems, got %d", problems, r.Problems())
+	}
+
+	r.Settings = []Setting{{Name: "case-folding", Value: "auto", Source: "default"}}
+	var buf bytes.Buffer
+	if err := r.Print(&buf); err != nil {
+		t.Fatalf("Print failed: %v", err)
+	}
+	out := buf.String()
+	for _, s := range []string{"Backend: " + r.Backend, "\nRoot " + root + "\n", "\nMachine\n", "case-folding  auto  (default)", "warnings\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expecting %q in the report:\n%s", s, out)
+		}
+	}
+}
+
+func TestInspectUnreadable(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() == 0 {
+		t.Skip("Every directory can be read by root")
+	}
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "secret")
+	os.Mkdir(secret, 0700)
+	os.Chmod(secret, 0)
+	defer os.Chmod(secret, 0700)
+
+	r := Inspect([]profile.Replica{{Root: dir, Paths: []string{""}}, {Root: secret, Paths: []string{""}}})
+	if c := check(t, r, dir, CheckTree); c.Level != LevelWarning || !strings.Contains(c.Message, "1 directories cannot be read: "+secret) {
+		t.Errorf("Unexpected tree check %+v", c)
+	}
+	if c := check(t, r, secret, CheckRoot); c.Level != LevelProblem {
+		t.Errorf("Unexpected root check %+v", c)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0700)
+	os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "l1"))
+	os.Symlink("b", filepath.Join(dir, "a", "l2"))
+
+	links := symlinks(filepath.Join(dir, "l1", "l2"))
+	expected := []string{
+		filepath.Join(dir, "l1") + " -> " + filepath.Join(dir, "a"),
+		filepath.Join(dir, "l1", "l2") + " -> b",
+	}
+	if strings.Join(links, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expecting %q, got %q", expected, links)
+	}
+	if links := symlinks(filepath.Join(dir, "a", "b")); len(links) != 0 {
+		t.Errorf("Expecting no symlinks, got %q", links)
+	}
+}
@@ -0,0 +1,43 @@
+// +build darwin
+
+package doctor
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// networkFilesystems are the types of filesystems that other machines can
+// change.
+var networkFilesystems = map[string]bool{
+	"nfs":    true,
+	"smbfs":  true,
+	"afpfs":  true,
+	"webdav": true,
+	"cifs":   true,
+	"ftp":    true,
+}
+
+// filesystem describes the filesystem holding path.
+func filesystem(path string) (fsInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fsInfo{}, err
+	}
+
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	info := fsInfo{name: string(name)}
+	info.network = networkFilesystems[info.name]
+	info.fuse = strings.Contains(info.name, "fuse")
+	if info.name == "" {
+		info.name = fmt.Sprintf("type %d", st.Type)
+	}
+	return info, nil
+}
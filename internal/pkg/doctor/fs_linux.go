@@ -0,0 +1,42 @@
+// +build linux
+
+package doctor
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// The magic numbers of the types of filesystems, from statfs(2).
+var filesystems = map[int64]fsInfo{
+	0xef53:     {name: "ext4"},
+	0x58465342: {name: "xfs"},
+	0x9123683e: {name: "btrfs"},
+	0x2fc12fc1: {name: "zfs"},
+	0x01021994: {name: "tmpfs"},
+	0x794c7630: {name: "overlayfs"},
+	0x4d44:     {name: "msdos"},
+	0x5346544e: {name: "ntfs"},
+	0x6969:     {name: "nfs", network: true},
+	0x517b:     {name: "smb", network: true},
+	0xfe534d42: {name: "smb2", network: true},
+	0xff534d42: {name: "cifs", network: true},
+	0x01021997: {name: "9p", network: true},
+	0x00c36400: {name: "ceph", network: true},
+	0x5346414f: {name: "afs", network: true},
+	0x65735546: {name: "fuse", fuse: true},
+}
+
+// filesystem describes the filesystem holding path.
+func filesystem(path string) (fsInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fsInfo{}, err
+	}
+
+	magic := int64(uint32(st.Type))
+	if info, ok := filesystems[magic]; ok {
+		return info, nil
+	}
+	return fsInfo{name: fmt.Sprintf("type 0x%x", magic)}, nil
+}
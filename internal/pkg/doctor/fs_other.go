@@ -0,0 +1,10 @@
+// +build !darwin,!linux
+
+package doctor
+
+import "errors"
+
+// filesystem describes the filesystem holding path.
+func filesystem(path string) (fsInfo, error) {
+	return fsInfo{}, errors.New("Not supported on this platform")
+}
@@ -0,0 +1,63 @@
+package doctor
+
+// The levels of the checks. Problems keep the monitor from working.
+const (
+	LevelOK      = "ok"
+	LevelWarning = "warning"
+	LevelProblem = "problem"
+)
+
+// The names of the checks.
+const (
+	CheckBackend     = "backend"
+	CheckRoot        = "root"
+	CheckSymlinks    = "symlinks"
+	CheckFilesystem  = "filesystem"
+	CheckTree        = "tree"
+	CheckWatchBudget = "watch budget"
+)
+
+// maxListed is how many unreadable directories are named in a check.
+const maxListed = 3
+
+// Check is the outcome of a check, either of a root or of the machine when
+// Root is empty.
+type Check struct {
+	Root    string
+	Name    string
+	Level   string
+	Message string
+}
+
+// Setting is a setting of the monitor as it is in effect, and where it was
+// taken from, such as "flag" or "default".
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// Report is the outcome of the checks of the environment of a monitor.
+type Report struct {
+	// Backend is the name of the backend that would be used, or "none".
+	Backend  string
+	Checks   []Check
+	Settings []Setting
+}
+
+// fsInfo describes the filesystem holding a root.
+type fsInfo struct {
+	name string
+	// network means changes made through other machines are not seen.
+	network bool
+	// fuse means the filesystem may not report changes at all.
+	fuse bool
+}
+
+// tree counts what is below the watched paths of a root.
+type tree struct {
+	dirs       int
+	files      int
+	unreadable []string
+	missing    []string
+}
@@ -0,0 +1,109 @@
+// Package gitfsmonitor implements version 2 of the protocol of git's
+// core.fsmonitor hook on top of a monitor serving the Watchman protocol.
+//
+// Git runs the hook with the protocol version and the token it got from the
+// hook the last time. The hook answers with a new token and the paths that
+// changed since the old one, each followed by a NUL byte. A path of "/"
+// makes git scan the whole worktree, which is what happens when the monitor
+// has no history for the token.
+package gitfsmonitor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/watchman"
+)
+
+// Version is the version of the hook protocol that is implemented.
+const Version = "2"
+
+// fullScan is the path telling git to scan the whole worktree.
+const fullScan = "/"
+
+// Hook answers the hook call of git with the arguments args for worktree,
+// asking the monitor listening on the Watchman socket at socket, and writes
+// the answer to w. Nothing is written if it fails, in which case git scans
+// the whole worktree.
+func Hook(socket, worktree string, args []string, w io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Expecting the hook version and token as arguments, got %q", args)
+	}
+	if args[0] != Version {
+		return fmt.Errorf("Unsupported fsmonitor hook version %s, set core.fsmonitorHookVersion to %s", args[0], Version)
+	}
+	token := args[1]
+
+	if real, err := filepath.EvalSymlinks(worktree); err == nil {
+		worktree = real
+	}
+
+	c, err := watchman.Dial(socket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// The worktree may lie below a root that is already watched, such as
+	// for a submodule, in which case that root is queried for the changes
+	// below the worktree. A root that was not watched before has no
+	// history for the token, so git scans it all this time.
+	resp, err := c.Call("watch-project", worktree)
+	if err != nil {
+		return fmt.Errorf("Unable to watch %s: %v", worktree, err)
+	}
+	root, _ := resp["watch"].(string)
+	if root == "" {
+		return fmt.Errorf("Invalid watch in the response of the monitor: %v", resp["watch"])
+	}
+
+	spec := map[string]interface{}{
+		"fields":                  []string{"name"},
+		"expression":              []interface{}{"not", []interface{}{"dirname", ".git"}},
+		"empty_on_fresh_instance": true,
+	}
+	if relative, _ := resp["relative_path"].(string); relative != "" {
+		spec["relative_root"] = relative
+	}
+	// Git passes a timestamp until it has a token from the hook, which
+	// the monitor has no history for either.
+	if strings.HasPrefix(token, "c:") {
+		spec["since"] = token
+	}
+
+	resp, err = c.Call("query", root, spec)
+	if err != nil {
+		return fmt.Errorf("Unable to query the changes of %s: %v", worktree, err)
+	}
+
+	files, _ := resp["files"].([]interface{})
+	if fresh, _ := resp["is_fresh_instance"].(bool); fresh {
+		files = []interface{}{fullScan}
+	}
+	return answer(w, resp["clock"], files)
+}
+
+// answer writes the new token and the changed paths in the format git
+// expects.
+func answer(w io.Writer, clock interface{}, files []interface{}) error {
+	token, ok := clock.(string)
+	if !ok || token == "" {
+		return fmt.Errorf("Invalid clock in the response of the monitor: %v", clock)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(token + "\x00")
+	for _, f := range files {
+		name, ok := f.(string)
+		if !ok {
+			return fmt.Errorf("Invalid file name in the response of the monitor: %v", f)
+		}
+		buf.WriteString(name + "\x00")
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,267 @@
+package gitfsmonitor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/watchman"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// envHookSocket makes the test binary act as the hook, asking the monitor on
+// the socket it names, so that git can run it.
+const envHookSocket = "GITFSMONITOR_TEST_SOCKET"
+
+func TestMain(m *testing.M) {
+	if socket := os.Getenv(envHookSocket); socket != "" {
+		dir, _ := os.Getwd()
+		if err := Hook(socket, dir, os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gitfsmonitor")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("Unable to get the real path of the tempdir: %v", err)
+	}
+
+	return dir
+}
+
+// newMonitor serves the Watchman protocol for a monitor using the fake
+// backend until the returned function is called.
+func newMonitor(t *testing.T, b *fsmonitortest.Backend) (string, func()) {
+	m, stop := fsmonitortest.Run(t, b)
+
+	// The fake backend only delivers the events the test injects, so
+	// waiting for those of sync cookies would never end.
+	s, err := watchman.NewServer(m, watchman.WithSyncTimeout(0))
+	if err != nil {
+		t.Fatalf("Unable to create the server: %v", err)
+	}
+	dir := makeTempDir(t)
+	socket := filepath.Join(dir, "watchman.sock")
+	if err := s.Listen(socket); err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	go s.Serve()
+
+	return socket, func() {
+		s.Close()
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// parseAnswer splits the answer of the hook into the token and the paths.
+func parseAnswer(t *testing.T, answer string) (string, []string) {
+	t.Helper()
+
+	if !strings.HasSuffix(answer, "\x00") {
+		t.Fatalf("Expecting the answer to end with a NUL byte, got %q", answer)
+	}
+	fields := strings.Split(strings.TrimSuffix(answer, "\x00"), "\x00")
+	return fields[0], fields[1:]
+}
+
+func TestHook(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	socket, stop := newMonitor(t, b)
+	defer stop()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	hook := func(token string) (string, []string) {
+		t.Helper()
+		var out bytes.Buffer
+		if err := Hook(socket, dir, []string{"2", token}, &out); err != nil {
+			t.Fatalf("Hook failed: %v", err)
+		}
+		return parseAnswer(t, out.String())
+	}
+
+	// The first call starts watching and asks for a full scan.
+	token, paths := hook("")
+	if len(paths) != 1 || paths[0] != "/" {
+		t.Errorf("Expecting a full scan, got %q", paths)
+	}
+	if b.Watches() != 1 {
+		t.Fatalf("Expecting the worktree to be watched")
+	}
+
+	if token, paths = hook(token); len(paths) != 0 {
+		t.Errorf("Expecting no changes, got %q", paths)
+	}
+
+	b.Inject(t, dir,
+		fsmonitor.Event{Path: filepath.Join(dir, "a.txt"), Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: filepath.Join(dir, ".git/index"), Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: filepath.Join(dir, "sub/b.txt"), Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, dir)
+	next, paths := hook(token)
+	if strings.Join(paths, ",") != "a.txt,sub/b.txt" {
+		t.Errorf("Expecting a.txt and sub/b.txt, got %q", paths)
+	}
+
+	// A token of another instance of the monitor makes git scan.
+	if _, paths = hook("c:1.2.3:4"); len(paths) != 1 || paths[0] != "/" {
+		t.Errorf("Expecting a full scan for an unknown token, got %q", paths)
+	}
+	if _, paths = hook(next); len(paths) != 0 {
+		t.Errorf("Expecting no changes, got %q", paths)
+	}
+
+	var out bytes.Buffer
+	if err := Hook(socket, dir, []string{"1", "0"}, &out); err == nil || out.Len() != 0 {
+		t.Errorf("Expecting version 1 to fail without an answer, got %v and %q", err, out.String())
+	}
+	if err := Hook(filepath.Join(dir, "missing.sock"), dir, []string{"2", ""}, &out); err == nil || out.Len() != 0 {
+		t.Errorf("Expecting a missing monitor to fail without an answer, got %v and %q", err, out.String())
+	}
+}
+
+func TestHookNestedWorktree(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	socket, stop := newMonitor(t, b)
+	defer stop()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0700); err != nil {
+		t.Fatalf("Unable to create the nested worktree: %v", err)
+	}
+
+	hook := func(worktree, token string) (string, []string) {
+		t.Helper()
+		var out bytes.Buffer
+		if err := Hook(socket, worktree, []string{"2", token}, &out); err != nil {
+			t.Fatalf("Hook failed for %s: %v", worktree, err)
+		}
+		return parseAnswer(t, out.String())
+	}
+
+	outer, _ := hook(dir, "")
+
+	// The nested worktree is answered from the watch of the outer one.
+	token, paths := hook(sub, "")
+	if len(paths) != 1 || paths[0] != "/" {
+		t.Errorf("Expecting a full scan, got %q", paths)
+	}
+	if b.Watches() != 1 {
+		t.Errorf("Expecting only the outer worktree to be watched, got %d watches", b.Watches())
+	}
+	if token, paths = hook(sub, token); len(paths) != 0 {
+		t.Errorf("Expecting no changes, got %q", paths)
+	}
+
+	b.Inject(t, dir,
+		fsmonitor.Event{Path: filepath.Join(dir, "a.txt"), Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: filepath.Join(sub, "b.txt"), Flags: fsmonitor.EventModified},
+	)
+	b.Sync(t, dir)
+	if _, paths = hook(sub, token); strings.Join(paths, ",") != "b.txt" {
+		t.Errorf("Expecting b.txt, got %q", paths)
+	}
+	if _, paths = hook(dir, outer); strings.Join(paths, ",") != "a.txt,sub/b.txt" {
+		t.Errorf("Expecting a.txt and sub/b.txt, got %q", paths)
+	}
+}
+
+// TestGitStatus runs git status in a repository using the test binary as
+// its fsmonitor hook. A change the monitor does not report is not seen by
+// git, which shows that git relies on the answers of the hook.
+func TestGitStatus(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Parallel()
+
+	hook, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Unable to find the test binary: %v", err)
+	}
+
+	b := fsmonitortest.NewBackend()
+	socket, stop := newMonitor(t, b)
+	defer stop()
+
+	repo := makeTempDir(t)
+	defer os.RemoveAll(repo)
+
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(), envHookSocket+"="+socket, "GIT_CONFIG_NOSYSTEM=1", "HOME="+repo)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return string(out)
+	}
+	write := func(name, content string) {
+		t.Helper()
+		p := filepath.Join(repo, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %v", name, err)
+		}
+		// Keep git from finding the file racily clean.
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(p, old, old)
+	}
+
+	git("init", "-q")
+	git("config", "user.name", "Test")
+	git("config", "user.email", "test@example.com")
+	write("a.txt", "a")
+	write("b.txt", "b")
+	git("add", "a.txt", "b.txt")
+	git("commit", "-q", "-m", "Initial commit")
+
+	git("config", "core.fsmonitor", hook)
+	git("config", "core.fsmonitorHookVersion", "2")
+
+	// The first status starts the watch and scans everything.
+	if out := git("status", "--porcelain"); out != "" {
+		t.Fatalf("Expecting a clean worktree, got %q", out)
+	}
+	if b.Watches() != 1 {
+		t.Fatalf("Expecting the hook to start watching the worktree")
+	}
+	git("status", "--porcelain")
+
+	write("a.txt", "unreported")
+	if out := git("status", "--porcelain"); out != "" {
+		t.Errorf("Expecting git to rely on the hook and miss the unreported change, got %q", out)
+	}
+
+	b.Inject(t, repo, fsmonitor.Event{Path: filepath.Join(repo, "a.txt"), Flags: fsmonitor.EventModified})
+	b.Sync(t, repo)
+	if out := git("status", "--porcelain"); out != " M a.txt\n" {
+		t.Errorf("Expecting a.txt to be modified, got %q", out)
+	}
+}
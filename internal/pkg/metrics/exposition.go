@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// contentType is the media type of the Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// writer accumulates the exposition and remembers the first error, so that
+// the metrics do not have to check every write.
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *writer) put(parts ...string) {
+	if w.err != nil {
+		return
+	}
+	for _, p := range parts {
+		if _, w.err = w.w.WriteString(p); w.err != nil {
+			return
+		}
+	}
+}
+
+func (w *writer) header(name, help, kind string) {
+	w.put("# HELP ", name, " ", escapeHelp(help), "\n")
+	w.put("# TYPE ", name, " ", kind, "\n")
+}
+
+func (w *writer) sample(name, labels string, v float64) {
+	w.put(name, labels, " ", formatFloat(v), "\n")
+}
+
+// Write writes all metrics in the text exposition format, ordered by
+// name.
+func (r *Registry) Write(out io.Writer) error {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mutex.Unlock()
+
+	w := &writer{w: bufio.NewWriter(out)}
+	for _, m := range metrics {
+		m.write(w)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape.
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", contentType)
+	r.Write(rw)
+}
+
+func (c *Counter) write(w *writer) {
+	w.header(c.name, c.help, "counter")
+	w.sample(c.name, "", c.Value())
+}
+
+func (c *CounterVec) write(w *writer) {
+	c.mutex.Lock()
+	values := make([]string, 0, len(c.counters))
+	for value := range c.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	counters := make([]*Counter, len(values))
+	for i, value := range values {
+		counters[i] = c.counters[value]
+	}
+	c.mutex.Unlock()
+
+	w.header(c.name, c.help, "counter")
+	for i, value := range values {
+		w.sample(c.name, "{"+c.label+"=\""+escapeLabel(value)+"\"}", counters[i].Value())
+	}
+}
+
+func (g *GaugeFunc) write(w *writer) {
+	w.header(g.name, g.help, "gauge")
+	w.sample(g.name, "", g.f())
+}
+
+func (h *Histogram) write(w *writer) {
+	h.mutex.Lock()
+	counts := append([]uint64{}, h.counts...)
+	count, sum := h.count, h.sum
+	h.mutex.Unlock()
+
+	w.header(h.name, h.help, "histogram")
+	for i, bound := range h.buckets {
+		w.sample(h.name+"_bucket", "{le=\""+formatFloat(bound)+"\"}", float64(counts[i]))
+	}
+	w.sample(h.name+"_bucket", "{le=\"+Inf\"}", float64(count))
+	w.sample(h.name+"_sum", "", sum)
+	w.sample(h.name+"_count", "", float64(count))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
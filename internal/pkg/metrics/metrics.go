@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the histogram buckets used when none are given. They
+// cover latencies from a millisecond to a minute.
+var DefaultBuckets = []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		mutex:   &sync.Mutex{},
+		metrics: make(map[string]metric),
+	}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.metrics[name] = m
+}
+
+// NewCounter creates and registers a counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.register(name, c)
+	return c
+}
+
+// NewCounterVec creates and registers a family of counters with one label.
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{
+		name:     name,
+		help:     help,
+		label:    label,
+		mutex:    &sync.Mutex{},
+		counters: make(map[string]*Counter),
+	}
+	r.register(name, c)
+	return c
+}
+
+// NewGaugeFunc creates and registers a gauge whose value is taken from f.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, f: f}
+	r.register(name, g)
+	return g
+}
+
+// NewHistogram creates and registers a histogram. The buckets are the
+// upper bounds of the buckets in increasing order; DefaultBuckets is used if
+// none are given.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		mutex:   &sync.Mutex{},
+		buckets: append([]float64{}, buckets...),
+		counts:  make([]uint64, len(buckets)),
+	}
+	r.register(name, h)
+	return h
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds a non-negative value to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&c.bits, old, next) {
+			return
+		}
+	}
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// With returns the counter for the given label value, creating it on first
+// use.
+func (c *CounterVec) With(value string) *Counter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counter, ok := c.counters[value]
+	if !ok {
+		counter = &Counter{name: c.name}
+		c.counters[value] = counter
+	}
+	return counter
+}
+
+// Observe records a single observation.
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A test counter.")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Add(0.5)
+
+	if v := c.Value(); v != 1000.5 {
+		t.Errorf("Expected 1000.5, got: %v", v)
+	}
+}
+
+func TestCounterDecrease(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic when decreasing a counter")
+		}
+	}()
+
+	NewRegistry().NewCounter("test_total", "").Add(-1)
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic when registering a name twice")
+		}
+	}()
+
+	r := NewRegistry()
+	r.NewCounter("test_total", "")
+	r.NewGaugeFunc("test_total", "", func() float64 { return 0 })
+}
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("b_total", "Counts b.\nOn two lines.").Add(3)
+	vec := r.NewCounterVec("a_total", `Counts a by "rule".`, "rule")
+	vec.With("outside").Inc()
+	vec.With(`quote"d`).Add(2)
+	r.NewGaugeFunc("c", "A gauge.", func() float64 { return 1.5 })
+	h := r.NewHistogram("d_seconds", "A histogram.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	expected := `# HELP a_total Counts a by "rule".
+# TYPE a_total counter
+a_total{rule="outside"} 1
+a_total{rule="quote\"d"} 2
+# HELP b_total Counts b.\nOn two lines.
+# TYPE b_total counter
+b_total 3
+# HELP c A gauge.
+# TYPE c gauge
+c 1.5
+# HELP d_seconds A histogram.
+# TYPE d_seconds histogram
+d_seconds_bucket{le="0.1"} 1
+d_seconds_bucket{le="1"} 2
+d_seconds_bucket{le="+Inf"} 3
+d_seconds_sum 5.55
+d_seconds_count 3
+`
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A test counter.").Inc()
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to scrape: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != contentType {
+		t.Errorf("Expected content type %q, got: %q", contentType, ct)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	if !bytes.Contains(buf.Bytes(), []byte("\ntest_total 1\n")) {
+		t.Errorf("Unexpected scrape:\n%s", buf.String())
+	}
+}
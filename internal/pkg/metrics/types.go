@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// Registry holds a set of metrics and writes them in the Prometheus text
+// exposition format. It is safe for concurrent use.
+type Registry struct {
+	mutex   *sync.Mutex
+	metrics map[string]metric
+}
+
+// metric is implemented by every kind of metric a Registry can hold.
+type metric interface {
+	write(w *writer)
+}
+
+// Counter is a value that only ever goes up.
+type Counter struct {
+	name string
+	help string
+	bits uint64
+}
+
+// CounterVec is a family of counters that differ in the value of a single
+// label.
+type CounterVec struct {
+	name     string
+	help     string
+	label    string
+	mutex    *sync.Mutex
+	counters map[string]*Counter
+}
+
+// GaugeFunc is a value that is computed by a function whenever the metrics
+// are written.
+type GaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// Histogram counts observations in buckets with configurable upper bounds.
+type Histogram struct {
+	name    string
+	help    string
+	mutex   *sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
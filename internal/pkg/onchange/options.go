@@ -0,0 +1,78 @@
+package onchange
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// WithStdin writes the changed paths to the standard input of the command,
+// one per line, instead of adding them to its arguments.
+func WithStdin() Option {
+	return func(r *Runner) error {
+		r.stdin = true
+		return nil
+	}
+}
+
+// WithDebounce sets how long no change has to arrive before the command runs
+// with the changes that did. The default is DefaultDebounce.
+func WithDebounce(d time.Duration) Option {
+	return func(r *Runner) error {
+		if d < 0 {
+			return fmt.Errorf("Invalid debounce: %s", d)
+		}
+		r.debounce = d
+		return nil
+	}
+}
+
+// WithRestart runs the command right away, and stops it and runs it again
+// whenever paths change. It is never given the paths. It suits commands that
+// keep running, such as servers.
+func WithRestart() Option {
+	return func(r *Runner) error {
+		r.restart = true
+		return nil
+	}
+}
+
+// WithKillPrevious stops the command when paths change while it still runs
+// for earlier changes, and runs it again for both. Without it, the command
+// first finishes and then runs for the changes that arrived meanwhile.
+func WithKillPrevious() Option {
+	return func(r *Runner) error {
+		r.killPrevious = true
+		return nil
+	}
+}
+
+// WithKillTimeout sets how long the command has to exit once it is sent
+// SIGTERM before it is sent SIGKILL. The default is DefaultKillTimeout.
+func WithKillTimeout(d time.Duration) Option {
+	return func(r *Runner) error {
+		if d <= 0 {
+			return fmt.Errorf("Invalid kill timeout: %s", d)
+		}
+		r.killTimeout = d
+		return nil
+	}
+}
+
+// WithOutput sets where the standard output and error of the command go.
+// They default to those of the process.
+func WithOutput(stdout, stderr io.Writer) Option {
+	return func(r *Runner) error {
+		r.stdout = stdout
+		r.stderr = stderr
+		return nil
+	}
+}
+
+// WithLog writes a line to w whenever the command starts, stops or fails.
+func WithLog(w io.Writer) Option {
+	return func(r *Runner) error {
+		r.log = w
+		return nil
+	}
+}
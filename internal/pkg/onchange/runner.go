@@ -0,0 +1,214 @@
+// Package onchange runs a command whenever paths change below the roots of a
+// fsmonitor.Monitor, such as to rebuild or restart something as files are
+// saved.
+//
+// Changes are collected until none has arrived for the debounce time, and the
+// command then runs with the absolute paths that changed, unless it is
+// restarted on every change. A single instance of the command runs at a time:
+// changes that arrive while it runs either wait for it to finish, or stop it
+// so that it runs again for both the old and the new changes.
+package onchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// New creates a runner of command, which is the program followed by its
+// arguments.
+func New(command []string, options ...Option) (*Runner, error) {
+	if len(command) == 0 {
+		return nil, errors.New("No command to run")
+	}
+
+	r := &Runner{
+		command:     command,
+		debounce:    DefaultDebounce,
+		killTimeout: DefaultKillTimeout,
+		stdout:      os.Stdout,
+		stderr:      os.Stderr,
+		log:         ioutil.Discard,
+	}
+
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return nil, fmt.Errorf("Error setting Runner options: %v", err)
+		}
+	}
+
+	return r, nil
+}
+
+// Run runs the command for the changes of the batches until ctx is done or
+// batches is closed. The command is then stopped if it still runs. Run
+// returns the exit status of the last run of the command that was not
+// stopped, which is 0 if there was none, or 128 plus the signal number if the
+// command was killed by a signal. It fails if the command cannot be started,
+// with the status a shell would give.
+func (r *Runner) Run(ctx context.Context, batches <-chan fsmonitor.Batch) (int, error) {
+	status := 0
+	pending := set.New()
+	var current *process
+	// due tells whether the pending changes have settled.
+	due := false
+	var settled <-chan time.Time
+
+	if r.restart {
+		p, err := r.start(nil)
+		if err != nil {
+			return statusNotRun, err
+		}
+		current = p
+	}
+
+	for {
+		var exited chan empty
+		if current != nil {
+			exited = current.exited
+		}
+
+		select {
+		case <-ctx.Done():
+			r.stop(current)
+			return status, nil
+		case b, ok := <-batches:
+			if !ok {
+				r.stop(current)
+				return status, nil
+			}
+			for _, p := range b.Paths {
+				pending.Add(filepath.Join(b.Replica.Root(), p))
+			}
+			settled = time.After(r.debounce)
+			continue
+		case <-settled:
+			settled = nil
+			due = true
+		case <-exited:
+			if current.stopping {
+				// It did not get to handle its changes.
+				for _, p := range current.paths {
+					pending.Add(p)
+				}
+			} else {
+				status = current.status
+				if status != 0 {
+					r.logf("WARN", "%s exited with status %d", r.command[0], status)
+				}
+			}
+			current = nil
+		}
+
+		if !due || pending.Size() == 0 {
+			continue
+		}
+		if current == nil {
+			p, err := r.start(fsmonitor.Coalesce(pending.StringSlice()))
+			if err != nil {
+				return statusNotRun, err
+			}
+			current = p
+			pending.Clear()
+			due = false
+		} else if (r.restart || r.killPrevious) && !current.stopping {
+			r.logf("INFO", "Stopping %s to run it for the new changes", r.command[0])
+			r.kill(current)
+		}
+	}
+}
+
+// start runs the command for the paths. A command that is restarted is not
+// given the paths, so that it runs the same way every time.
+func (r *Runner) start(paths []string) (*process, error) {
+	given := paths
+	if r.restart {
+		given = nil
+	}
+	args := r.command[1:]
+	if !r.stdin {
+		args = append(append([]string{}, args...), given...)
+	}
+
+	cmd := exec.Command(r.command[0], args...)
+	cmd.Stdout = r.stdout
+	cmd.Stderr = r.stderr
+	if r.stdin {
+		var input string
+		if len(given) > 0 {
+			input = strings.Join(given, "\n") + "\n"
+		}
+		cmd.Stdin = strings.NewReader(input)
+	}
+	// Run the command in a process group of its own, so that stopping it
+	// stops whatever it started too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Unable to run %s: %v", r.command[0], err)
+	}
+	r.logf("INFO", "Running %s for %d changed paths", r.command[0], len(paths))
+
+	p := &process{cmd: cmd, paths: paths, exited: make(chan empty)}
+	go func() {
+		p.status = exitStatus(cmd.Wait())
+		close(p.exited)
+	}()
+
+	return p, nil
+}
+
+// kill asks the process group of p to stop, and kills it if it does not
+// within the kill timeout.
+func (r *Runner) kill(p *process) {
+	p.stopping = true
+	pgid := -p.cmd.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-p.exited:
+		case <-time.After(r.killTimeout):
+			syscall.Kill(pgid, syscall.SIGKILL)
+		}
+	}()
+}
+
+// stop kills p, if it is running, and waits for it to exit.
+func (r *Runner) stop(p *process) {
+	if p == nil {
+		return
+	}
+	r.kill(p)
+	<-p.exited
+}
+
+func (r *Runner) logf(level, format string, a ...interface{}) {
+	fmt.Fprintf(r.log, "[%s] %s\n", level, fmt.Sprintf(format, a...))
+}
+
+// exitStatus returns the exit status for the error of waiting for a command.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				return 128 + int(ws.Signal())
+			}
+			return ws.ExitStatus()
+		}
+	}
+	return 1
+}
@@ -0,0 +1,276 @@
+package onchange
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// harness runs a runner for the changes of a replica at /r, watched with the
+// fake backend. The command runs in a temporary directory.
+type harness struct {
+	t       *testing.T
+	backend *fsmonitortest.Backend
+	dir     string
+	log     *syncBuffer
+	cancel  func()
+	done    chan int
+}
+
+// syncBuffer is a buffer the runner can log to while the test reads it.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func newHarness(t *testing.T, command string, options ...Option) *harness {
+	dir, err := ioutil.TempDir("", "onchange")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+
+	b := fsmonitortest.NewBackend()
+	m, err := fsmonitor.New(fsmonitor.WithBackend(b))
+	if err != nil {
+		t.Fatalf("Unable to create the monitor: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go m.Run(ctx)
+	if _, err := m.AddReplica("replica", "/r", ""); err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+
+	// The command runs in dir and appends what it is given to the file out.
+	log := &syncBuffer{}
+	options = append([]Option{WithDebounce(20 * time.Millisecond), WithKillTimeout(time.Second), WithLog(log)}, options...)
+	r, err := New([]string{"sh", "-c", "cd " + dir + " && " + command, "sh"}, options...)
+	if err != nil {
+		t.Fatalf("Unable to create the runner: %v", err)
+	}
+
+	h := &harness{t: t, backend: b, dir: dir, log: log, cancel: cancel, done: make(chan int, 1)}
+	s := m.Subscribe()
+	go func() {
+		status, err := r.Run(ctx, s.C)
+		if err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+		h.done <- status
+	}()
+
+	return h
+}
+
+// change injects events for the paths, which are relative to the root.
+func (h *harness) change(paths ...string) {
+	h.t.Helper()
+
+	var events []fsmonitor.Event
+	for _, p := range paths {
+		events = append(events, fsmonitor.Event{Path: filepath.Join("/r", p), Flags: fsmonitor.EventModified})
+	}
+	h.backend.Inject(h.t, "/r", events...)
+}
+
+// waitOutput waits until the command has written the lines to out.
+func (h *harness) waitOutput(lines ...string) {
+	h.t.Helper()
+
+	want := strings.Join(lines, "\n") + "\n"
+	deadline := time.Now().Add(fsmonitortest.Timeout)
+	for {
+		got, _ := ioutil.ReadFile(filepath.Join(h.dir, "out"))
+		if string(got) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Timed out waiting for output %q, got %q", want, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitLog waits until the runner has logged a line containing s.
+func (h *harness) waitLog(s string) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(fsmonitortest.Timeout)
+	for !strings.Contains(h.log.String(), s) {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Timed out waiting for %q in the log, got %q", s, h.log.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// stop stops the runner and returns its exit status.
+func (h *harness) stop() int {
+	h.cancel()
+	status := <-h.done
+	os.RemoveAll(h.dir)
+	return status
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(nil); err == nil {
+		t.Errorf("Expecting New to fail without a command")
+	}
+	if _, err := New([]string{"true"}, WithDebounce(-time.Second)); err == nil {
+		t.Errorf("Expecting New to fail with a negative debounce")
+	}
+	if _, err := New([]string{"true"}, WithKillTimeout(0)); err == nil {
+		t.Errorf("Expecting New to fail without a kill timeout")
+	}
+}
+
+func TestArgs(t *testing.T) {
+	t.Parallel()
+
+	h := newHarness(t, `echo "$@" >> out`)
+	// Changes that arrive within the debounce time make a single run.
+	h.change("b.txt", "dir/x")
+	h.change("a.txt")
+	h.waitOutput("/r/a.txt /r/b.txt /r/dir/x")
+
+	h.change("dir")
+	h.change("dir/y")
+	h.waitOutput("/r/a.txt /r/b.txt /r/dir/x", "/r/dir")
+
+	if status := h.stop(); status != 0 {
+		t.Errorf("Expecting status 0, got %d", status)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	t.Parallel()
+
+	h := newHarness(t, `cat >> out; echo "$#" >> out`, WithStdin())
+	h.change("a.txt", "b.txt")
+	h.waitOutput("/r/a.txt", "/r/b.txt", "0")
+	h.stop()
+}
+
+func TestExitStatus(t *testing.T) {
+	t.Parallel()
+
+	h := newHarness(t, `echo run >> out; exit 3`)
+	h.change("a.txt")
+	h.waitOutput("run")
+	h.waitLog("sh exited with status 3")
+
+	if status := h.stop(); status != 3 {
+		t.Errorf("Expecting status 3, got %d", status)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+
+	h := newHarness(t, `echo start "$@" >> out; sleep 0.3; echo end >> out`)
+	h.change("a.txt")
+	h.waitOutput("start /r/a.txt")
+
+	// The changes wait for the run to finish.
+	h.change("b.txt")
+	h.change("c.txt")
+	h.waitOutput("start /r/a.txt", "end", "start /r/b.txt /r/c.txt", "end")
+
+	if status := h.stop(); status != 0 {
+		t.Errorf("Expecting status 0, got %d", status)
+	}
+}
+
+func TestKillPrevious(t *testing.T) {
+	t.Parallel()
+
+	h := newHarness(t, `echo start "$@" >> out; sleep 10; echo end >> out`, WithKillPrevious())
+	h.change("a.txt")
+	h.waitOutput("start /r/a.txt")
+
+	// The stopped run did not finish with its changes, so they are passed
+	// on to the next one.
+	h.change("b.txt")
+	h.waitOutput("start /r/a.txt", "start /r/a.txt /r/b.txt")
+
+	// Stopping the runner stops the command too, which does not count.
+	start := time.Now()
+	if status := h.stop(); status != 0 {
+		t.Errorf("Expecting status 0, got %d", status)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expecting the command to be stopped, took %s", d)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	t.Parallel()
+
+	h := newHarness(t, `echo start $# "$@" >> out; exec sleep 10`, WithRestart())
+	h.waitOutput("start 0")
+
+	// The restarted command gets the same arguments, not the changed paths.
+	h.change("a.txt")
+	h.waitOutput("start 0", "start 0")
+	h.change("b.txt")
+	h.waitOutput("start 0", "start 0", "start 0")
+	h.stop()
+}
+
+func TestStartFailure(t *testing.T) {
+	t.Parallel()
+
+	r, err := New([]string{"/nonexistent/command"}, WithRestart())
+	if err != nil {
+		t.Fatalf("Unable to create the runner: %v", err)
+	}
+	status, err := r.Run(context.Background(), nil)
+	if err == nil || status != statusNotRun {
+		t.Errorf("Expecting status %d and an error, got %d and %v", statusNotRun, status, err)
+	}
+}
+
+func TestLog(t *testing.T) {
+	t.Parallel()
+
+	var log bytes.Buffer
+	r, err := New([]string{"sh", "-c", "exit 2"}, WithLog(&log))
+	if err != nil {
+		t.Fatalf("Unable to create the runner: %v", err)
+	}
+	p, err := r.start([]string{"/r/a"})
+	if err != nil {
+		t.Fatalf("Unable to start the command: %v", err)
+	}
+	<-p.exited
+
+	if p.status != 2 || !reflect.DeepEqual(p.paths, []string{"/r/a"}) {
+		t.Errorf("Expecting status 2 for /r/a, got %d for %v", p.status, p.paths)
+	}
+	if log.String() != "[INFO] Running sh for 1 changed paths\n" {
+		t.Errorf("Unexpected log: %q", log.String())
+	}
+}
@@ -0,0 +1,49 @@
+package onchange
+
+import (
+	"io"
+	"os/exec"
+	"time"
+)
+
+// DefaultDebounce is how long the changes have to settle before the command
+// runs.
+const DefaultDebounce = 100 * time.Millisecond
+
+// DefaultKillTimeout is how long a command that is stopped gets to exit
+// before it is killed.
+const DefaultKillTimeout = 5 * time.Second
+
+// statusNotRun is the exit status when the command cannot be started, as
+// with a shell.
+const statusNotRun = 127
+
+type empty struct{}
+
+// Runner runs a command with the paths that changed below the roots of a
+// fsmonitor.Monitor.
+type Runner struct {
+	command      []string
+	stdin        bool
+	debounce     time.Duration
+	restart      bool
+	killPrevious bool
+	killTimeout  time.Duration
+	stdout       io.Writer
+	stderr       io.Writer
+	log          io.Writer
+}
+
+// Option configures a Runner.
+type Option func(*Runner) error
+
+// process is a run of the command.
+type process struct {
+	cmd    *exec.Cmd
+	paths  []string
+	status int
+	// stopping is set once the process has been asked to stop.
+	stopping bool
+	// exited is closed once the process has exited and status is set.
+	exited chan empty
+}
@@ -0,0 +1,159 @@
+// Package profile reads Unison profiles, so that the roots, paths and ignore
+// rules Unison synchronizes can be watched without describing them again.
+//
+// A profile is a file of "name = value" lines in the Unison directory, named
+// after the profile with a .prf extension. Lines starting with # are
+// comments. "include name" reads the file name, or name.prf if there is no
+// such file, from the Unison directory at that point, "include? name" does
+// the same unless neither exists, and "source path" reads the file at path,
+// relative to the Unison directory. Preferences this package does not use are
+// skipped.
+package profile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The preferences that are kept.
+const (
+	prefRoot       = "root"
+	prefPath       = "path"
+	prefIgnore     = "ignore"
+	prefIgnoreNot  = "ignorenot"
+	prefIgnoreCase = "ignorecase"
+)
+
+// Dir returns the Unison directory: $UNISON if set, otherwise ~/.unison or,
+// on macOS when that does not exist, ~/Library/Application Support/Unison.
+func Dir() string {
+	if dir := os.Getenv("UNISON"); dir != "" {
+		return dir
+	}
+
+	home := os.Getenv("HOME")
+	dir := filepath.Join(home, ".unison")
+	if runtime.GOOS == "darwin" {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			mac := filepath.Join(home, "Library", "Application Support", "Unison")
+			if _, err := os.Stat(mac); err == nil {
+				return mac
+			}
+		}
+	}
+	return dir
+}
+
+// Load reads the profile called name from the Unison directory dir. A name
+// holding a slash is the path of the profile file instead.
+func Load(dir, name string) (*Profile, error) {
+	path := name
+	if !strings.Contains(name, "/") {
+		if filepath.Ext(name) != ".prf" {
+			name += ".prf"
+		}
+		path = filepath.Join(dir, name)
+	}
+
+	l := &loader{
+		dir:     dir,
+		profile: &Profile{Name: strings.TrimSuffix(filepath.Base(name), ".prf")},
+		reading: make(map[string]bool),
+	}
+	if err := l.read(path); err != nil {
+		return nil, err
+	}
+	return l.profile, nil
+}
+
+// read reads the file at path into the profile.
+func (l *loader) read(path string) error {
+	if l.reading[path] {
+		return fmt.Errorf("Profile %s includes itself", path)
+	}
+	l.reading[path] = true
+	defer delete(l.reading, path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read profile: %v", err)
+	}
+	defer f.Close()
+	l.profile.Files = append(l.profile.Files, path)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if err := l.line(strings.TrimSpace(scanner.Text())); err != nil {
+			return fmt.Errorf("%s, line %d: %v", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Unable to read profile %s: %v", path, err)
+	}
+	return nil
+}
+
+// line handles a line of a profile.
+func (l *loader) line(line string) error {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	if fields := strings.Fields(line); !strings.Contains(line, "=") && len(fields) > 0 {
+		arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		if arg == "" {
+			return fmt.Errorf("%s without a file", fields[0])
+		}
+		switch fields[0] {
+		case "include":
+			return l.include(arg, false)
+		case "include?":
+			return l.include(arg, true)
+		case "source":
+			if !filepath.IsAbs(arg) {
+				arg = filepath.Join(l.dir, arg)
+			}
+			return l.read(arg)
+		}
+		return fmt.Errorf("Expecting a preference or an include, got %q", line)
+	}
+
+	i := strings.Index(line, "=")
+	name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	if name == "" {
+		return errors.New("Missing the name of the preference")
+	}
+
+	p := l.profile
+	switch name {
+	case prefRoot:
+		p.Roots = append(p.Roots, value)
+	case prefPath:
+		p.Paths = append(p.Paths, value)
+	case prefIgnore:
+		p.Ignores = append(p.Ignores, value)
+	case prefIgnoreNot:
+		p.IgnoreNots = append(p.IgnoreNots, value)
+	case prefIgnoreCase:
+		p.IgnoreCase = value
+	}
+	return nil
+}
+
+// include reads the file name from the Unison directory, or name.prf if there
+// is no such file. Unless optional, one of them has to exist.
+func (l *loader) include(name string, optional bool) error {
+	path := filepath.Join(l.dir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path += ".prf"
+		if _, err := os.Stat(path); os.IsNotExist(err) && optional {
+			return nil
+		}
+	}
+	return l.read(path)
+}
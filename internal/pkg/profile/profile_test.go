@@ -0,0 +1,182 @@
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+const testDir = "testdata/unison"
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	p, err := Load(testDir, "docs")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	expected := &Profile{
+		Name: "docs",
+		Files: []string{
+			filepath.Join(testDir, "docs.prf"),
+			filepath.Join(testDir, "common"),
+			filepath.Join(testDir, "extra.prf"),
+		},
+		Roots:      []string{"/Users/me/Documents", "ssh://server//srv/me/Documents"},
+		Paths:      []string{"Projects", "Notes/"},
+		Ignores:    []string{"Name *.o", "Name {.DS_Store,._*}", "BelowPath build"},
+		IgnoreNots: []string{"Name keep.o"},
+		IgnoreCase: "true",
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expecting %+v, got %+v", expected, p)
+	}
+	if p.CaseFolding() != fsmonitor.CaseFoldingAlways {
+		t.Errorf("Expecting case folding to be %s, got %s", fsmonitor.CaseFoldingAlways, p.CaseFolding())
+	}
+
+	// Profiles can be named with their extension, or by their path.
+	for _, name := range []string{"docs.prf", filepath.Join(testDir, "docs.prf")} {
+		if other, err := Load(testDir, name); err != nil || !reflect.DeepEqual(other, expected) {
+			t.Errorf("Expecting %s to load the same profile, got %+v (%v)", name, other, err)
+		}
+	}
+
+	p, err = Load(testDir, "source")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !reflect.DeepEqual(p.Ignores, []string{`Regex .*\.swp`}) || p.CaseFolding() != fsmonitor.CaseFoldingAuto {
+		t.Errorf("Expecting the sourced ignore rule, got %+v", p)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name string
+		err  string
+	}{
+		{"nonexistent", "Unable to read profile"},
+		{"cycle", "includes itself"},
+		{"garbage", "garbage.prf, line 2: Expecting a preference or an include"},
+		{"noinclude", "noinclude.prf, line 1: Unable to read profile"},
+	}
+
+	for _, table := range tables {
+		_, err := Load(testDir, table.name)
+		if err == nil || !strings.Contains(err.Error(), table.err) {
+			t.Errorf("Load(%s): expecting an error containing %q, got %v", table.name, table.err, err)
+		}
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	t.Parallel()
+
+	p, err := Load(testDir, "docs")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	replicas, err := p.Replicas()
+	if err != nil {
+		t.Fatalf("Replicas failed: %v", err)
+	}
+
+	// The remote root is left out.
+	if len(replicas) != 1 {
+		t.Fatalf("Expecting a single replica, got %+v", replicas)
+	}
+	r := replicas[0]
+	if r.Root != "/Users/me/Documents" || !reflect.DeepEqual(r.Paths, []string{"Projects", "Notes"}) {
+		t.Errorf("Unexpected root and paths: %s, %q", r.Root, r.Paths)
+	}
+	if len(r.Ignores) != 3 || r.Ignores[1].String() != "Name {.DS_Store,._*}" || len(r.IgnoreNots) != 1 {
+		t.Errorf("Unexpected ignore rules: %v, %v", r.Ignores, r.IgnoreNots)
+	}
+
+	p, err = Load(testDir, "home")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	replicas, _ = p.Replicas()
+	wd, _ := os.Getwd()
+	if len(replicas) != 2 || replicas[0].Root != filepath.Join(os.Getenv("HOME"), "docs") || replicas[1].Root != filepath.Join(wd, "relative") {
+		t.Errorf("Expecting the roots to be made absolute, got %+v", replicas)
+	}
+	if !reflect.DeepEqual(replicas[0].Paths, []string{""}) {
+		t.Errorf("Expecting the whole root to be watched, got %q", replicas[0].Paths)
+	}
+
+	p, err = Load(testDir, "badignore")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, err := p.Replicas(); err == nil || !strings.Contains(err.Error(), "Invalid ignore preference") {
+		t.Errorf("Expecting an invalid ignore rule to fail, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	p, err := Load(testDir, "docs")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	replicas, err := p.Replicas()
+	if err != nil {
+		t.Fatalf("Replicas failed: %v", err)
+	}
+
+	m, err := fsmonitor.New(fsmonitor.WithBackend(fsmonitortest.NewBackend()))
+	if err != nil {
+		t.Fatalf("Unable to create the monitor: %v", err)
+	}
+	r, err := replicas[0].Watch(m)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if r.Root() != "/Users/me/Documents" || !reflect.DeepEqual(r.Paths(), []string{"Notes", "Projects"}) {
+		t.Errorf("Unexpected replica: %s, %q", r.Root(), r.Paths())
+	}
+	tables := []struct {
+		path    string
+		ignored bool
+	}{
+		{"Projects/a.o", true},
+		{"Projects/keep.o", false},
+		{"build/x", true},
+		{"Projects/build/x", false},
+		{"Notes/.DS_Store", true},
+		{"Notes/._todo.txt", true},
+		{"Notes/todo.txt", false},
+	}
+	for _, table := range tables {
+		if got := r.Ignored(table.path); got != table.ignored {
+			t.Errorf("Ignored(%s): expecting %t, got %t", table.path, table.ignored, got)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := os.Getenv("UNISON")
+	defer os.Setenv("UNISON", dir)
+
+	os.Setenv("UNISON", "/somewhere/unison")
+	if d := Dir(); d != "/somewhere/unison" {
+		t.Errorf("Expecting $UNISON, got %s", d)
+	}
+	os.Unsetenv("UNISON")
+	if d := Dir(); !strings.HasPrefix(d, os.Getenv("HOME")) {
+		t.Errorf("Expecting a directory in the home directory, got %s", d)
+	}
+}
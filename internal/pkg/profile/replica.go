@@ -0,0 +1,109 @@
+package profile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// remotePrefixes start the roots that are on another machine.
+var remotePrefixes = []string{"ssh://", "rsh://", "socket://"}
+
+// CaseFolding returns the case folding mode of fsmonitor matching the
+// ignorecase preference.
+func (p *Profile) CaseFolding() string {
+	switch p.IgnoreCase {
+	case "true":
+		return fsmonitor.CaseFoldingAlways
+	case "false":
+		return fsmonitor.CaseFoldingNever
+	}
+	return fsmonitor.CaseFoldingAuto
+}
+
+// Replicas returns what to watch for the roots of the profile on this
+// machine. Remote roots are left out. Relative roots are taken from the
+// current directory, as Unison does. Without path preferences the whole root
+// is watched.
+func (p *Profile) Replicas() ([]Replica, error) {
+	ignores, err := parseRules(prefIgnore, p.Ignores)
+	if err != nil {
+		return nil, err
+	}
+	ignoreNots, err := parseRules(prefIgnoreNot, p.IgnoreNots)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{""}
+	if len(p.Paths) > 0 {
+		paths = nil
+		for _, path := range p.Paths {
+			paths = append(paths, strings.Trim(path, "/"))
+		}
+	}
+
+	var replicas []Replica
+	for _, root := range p.Roots {
+		local, ok := localRoot(root)
+		if !ok {
+			continue
+		}
+		replicas = append(replicas, Replica{
+			Root:       local,
+			Paths:      paths,
+			Ignores:    ignores,
+			IgnoreNots: ignoreNots,
+		})
+	}
+	return replicas, nil
+}
+
+// Watch adds the replica to m, named after its root.
+func (r Replica) Watch(m *fsmonitor.Monitor) (*fsmonitor.Replica, error) {
+	watched, err := m.AddReplica(r.Root, r.Root, r.Paths...)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range r.Ignores {
+		watched.AddIgnore(rule)
+	}
+	for _, rule := range r.IgnoreNots {
+		watched.AddIgnoreNot(rule)
+	}
+	return watched, nil
+}
+
+// parseRules parses the values of the ignore or ignorenot preference.
+func parseRules(pref string, values []string) ([]fsmonitor.IgnoreRule, error) {
+	var rules []fsmonitor.IgnoreRule
+	for _, value := range values {
+		rule, err := fsmonitor.ParseIgnoreRule(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s preference: %v", pref, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// localRoot returns the absolute path of a root on this machine, with a
+// leading ~ standing for the home directory.
+func localRoot(root string) (string, bool) {
+	for _, prefix := range remotePrefixes {
+		if strings.HasPrefix(root, prefix) {
+			return "", false
+		}
+	}
+
+	if root == "~" || strings.HasPrefix(root, "~/") {
+		root = filepath.Join(os.Getenv("HOME"), root[1:])
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return root, true
+}
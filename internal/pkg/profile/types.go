@@ -0,0 +1,39 @@
+package profile
+
+import (
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// Profile holds the preferences of a Unison profile that matter for watching
+// its roots. Values are as written in the profile, in the order they were
+// read, includes included.
+type Profile struct {
+	// Name is the name the profile was loaded by.
+	Name string
+	// Files are the files that were read, the profile first.
+	Files      []string
+	Roots      []string
+	Paths      []string
+	Ignores    []string
+	IgnoreNots []string
+	// IgnoreCase is the value of the ignorecase preference, empty if it is
+	// not set.
+	IgnoreCase string
+}
+
+// Replica is what to watch of a local root of a profile.
+type Replica struct {
+	Root string
+	// Paths are relative to Root. The empty path stands for Root itself.
+	Paths      []string
+	Ignores    []fsmonitor.IgnoreRule
+	IgnoreNots []fsmonitor.IgnoreRule
+}
+
+// loader reads the files of a profile.
+type loader struct {
+	dir     string
+	profile *Profile
+	// reading holds the files being read, to catch include cycles.
+	reading map[string]bool
+}
@@ -0,0 +1,120 @@
+// Package quote implements the quoting Unison uses for the arguments of
+// filesystem monitor protocol commands, as done by quote and unquote in
+// Unison's fswatch.ml.
+//
+// Every byte up to and including the space, and the percent sign itself, is
+// written as a percent sign followed by two upper case hexadecimal digits.
+// All other bytes, including non-ASCII and invalid UTF-8, are written as is.
+package quote
+
+import (
+	"fmt"
+	"strings"
+)
+
+const hexDigits = "0123456789ABCDEF"
+
+func mustQuote(c byte) bool {
+	return c <= ' ' || c == '%'
+}
+
+// Quote quotes s so that it can be sent as a single protocol argument.
+func Quote(s string) string {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if mustQuote(s[i]) {
+			n++
+		}
+	}
+	if n == 0 {
+		return s
+	}
+
+	buf := make([]byte, 0, len(s)+2*n)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if mustQuote(c) {
+			buf = append(buf, '%', hexDigits[c>>4], hexDigits[c&0xf])
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+// Unquote reverses Quote. Any byte may be quoted, with upper or lower case
+// hexadecimal digits; a percent sign that is not followed by two of them is
+// an error.
+func Unquote(s string) (string, error) {
+	i := strings.IndexByte(s, '%')
+	if i < 0 {
+		return s, nil
+	}
+
+	buf := make([]byte, 0, len(s))
+	buf = append(buf, s[:i]...)
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			buf = append(buf, c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated escape in %q", s)
+		}
+		hi, ok1 := unhex(s[i+1])
+		lo, ok2 := unhex(s[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("invalid escape %q in %q", s[i:i+3], s)
+		}
+		buf = append(buf, hi<<4|lo)
+		i += 2
+	}
+	return string(buf), nil
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// Format builds a protocol line, without the newline, from a command and its
+// arguments.
+func Format(cmd string, args ...string) string {
+	parts := make([]string, len(args)+1)
+	parts[0] = cmd
+	for i, arg := range args {
+		parts[i+1] = Quote(arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Parse splits a protocol line into its command and unquoted arguments.
+// Unison quotes every byte up to the space, so unquoted ones only separate
+// tokens. This covers the line ending and the empty tokens that repeated
+// spaces would otherwise give. An empty line has an empty command.
+func Parse(line string) (string, []string, error) {
+	tokens := strings.FieldsFunc(line, func(r rune) bool {
+		return r <= ' '
+	})
+	if len(tokens) == 0 {
+		return "", []string{}, nil
+	}
+
+	args := make([]string, len(tokens)-1)
+	for i, t := range tokens[1:] {
+		a, err := Unquote(t)
+		if err != nil {
+			return "", nil, err
+		}
+		args[i] = a
+	}
+	return tokens[0], args, nil
+}
@@ -0,0 +1,161 @@
+package quote
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+type golden struct {
+	raw, quoted string
+}
+
+func readGolden(t *testing.T) []golden {
+	t.Helper()
+
+	f, err := os.Open("testdata/golden.txt")
+	if err != nil {
+		t.Fatalf("Unable to open golden file: %v", err)
+	}
+	defer f.Close()
+
+	var cases []golden
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			t.Fatalf("golden.txt:%d: expecting two fields", n)
+		}
+		raw, err1 := strconv.Unquote(fields[0])
+		quoted, err2 := strconv.Unquote(fields[1])
+		if err1 != nil || err2 != nil {
+			t.Fatalf("golden.txt:%d: invalid string literal", n)
+		}
+		cases = append(cases, golden{raw: raw, quoted: quoted})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Unable to read golden file: %v", err)
+	}
+	return cases
+}
+
+func TestQuoteGolden(t *testing.T) {
+	for _, c := range readGolden(t) {
+		if q := Quote(c.raw); q != c.quoted {
+			t.Errorf("Quote(%q): expecting: %q, got: %q", c.raw, c.quoted, q)
+		}
+		if u, err := Unquote(c.quoted); err != nil || u != c.raw {
+			t.Errorf("Unquote(%q): expecting: %q, got: %q, %v", c.quoted, c.raw, u, err)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tables := []struct {
+		quoted, raw string
+		err         bool
+	}{
+		{quoted: "%2f%2F", raw: "//"},
+		{quoted: "%41%62", raw: "Ab"},
+		{quoted: "+", raw: "+"},
+		{quoted: "%", err: true},
+		{quoted: "a%2", err: true},
+		{quoted: "%zz", err: true},
+		{quoted: "%2g", err: true},
+	}
+
+	for _, table := range tables {
+		raw, err := Unquote(table.quoted)
+		if (err != nil) != table.err || raw != table.raw {
+			t.Errorf("Unquote(%q): expecting: %q (error %t), got: %q, %v", table.quoted, table.raw, table.err, raw, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	f := func(b []byte) bool {
+		s := string(b)
+		q := Quote(s)
+		for i := 0; i < len(q); i++ {
+			if q[i] <= ' ' {
+				return false
+			}
+		}
+		u, err := Unquote(q)
+		return err == nil && u == s
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFormatParseRoundTrip(t *testing.T) {
+	f := func(cmd uint8, args []string) bool {
+		c := "CMD" + strconv.Itoa(int(cmd))
+		parsedCmd, parsedArgs, err := Parse(Format(c, args...) + "\n")
+		if err != nil || parsedCmd != c {
+			return false
+		}
+		// Empty arguments quote to nothing and are dropped.
+		var expected []string
+		for _, a := range args {
+			if a != "" {
+				expected = append(expected, a)
+			}
+		}
+		return len(parsedArgs) == len(expected) && (len(expected) == 0 || reflect.DeepEqual(parsedArgs, expected))
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tables := []struct {
+		line string
+		cmd  string
+		args []string
+		err  bool
+	}{
+		{line: "OK\n", cmd: "OK", args: []string{}},
+		{line: "", cmd: "", args: []string{}},
+		{line: "   \r\n", cmd: "", args: []string{}},
+		{line: "START replica /tmp/root%20dir sub%2Fdir\n", cmd: "START", args: []string{"replica", "/tmp/root dir", "sub/dir"}},
+		{line: "START  replica   /r\n", cmd: "START", args: []string{"replica", "/r"}},
+		{line: " WAIT replica \r\n", cmd: "WAIT", args: []string{"replica"}},
+		{line: "DIR a+b;c \xff\n", cmd: "DIR", args: []string{"a+b;c", "\xff"}},
+		{line: "\n WAIT\ta\x00b", cmd: "WAIT", args: []string{"a", "b"}},
+		{line: "DIR %zz", err: true},
+	}
+
+	for _, table := range tables {
+		cmd, args, err := Parse(table.line)
+		if (err != nil) != table.err {
+			t.Errorf("Parse(%q): unexpected error state: %v", table.line, err)
+			continue
+		}
+		if table.err {
+			continue
+		}
+		if cmd != table.cmd || !reflect.DeepEqual(args, table.args) {
+			t.Errorf("Parse(%q): expecting: %s %q, got: %s %q", table.line, table.cmd, table.args, cmd, args)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	if line := Format("RECURSIVE", "a b/100%"); line != "RECURSIVE a%20b/100%25" {
+		t.Errorf("Unexpected line: %q", line)
+	}
+	if line := Format("DONE"); line != "DONE" {
+		t.Errorf("Unexpected line: %q", line)
+	}
+}
@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// StdoutPath makes OpenNDJSON write to the standard output.
+const StdoutPath = "-"
+
+// ErrNoReader is returned when a record is dropped because nobody reads the
+// FIFO it was to be written to.
+var ErrNoReader = errors.New("No reader on the NDJSON FIFO")
+
+// NewNDJSON writes the records to w, which Close leaves open.
+func NewNDJSON(w io.Writer) *NDJSON {
+	return &NDJSON{mutex: &sync.Mutex{}, w: w}
+}
+
+// OpenNDJSON appends the records to the file at path, which is created if
+// it does not exist, or writes them to the standard output if path is
+// StdoutPath. If path is a FIFO, records are only written while a reader has
+// it open and dropped with ErrNoReader otherwise, so that the monitor never
+// waits for a reader.
+func OpenNDJSON(path string) (*NDJSON, error) {
+	if path == StdoutPath {
+		return NewNDJSON(os.Stdout), nil
+	}
+
+	s := &NDJSON{path: path, mutex: &sync.Mutex{}}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		s.fifo = true
+		return s, nil
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the file at the path of s. The caller holds the mutex.
+func (s *NDJSON) open() error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if s.fifo {
+		// Opening a FIFO without a reader fails instead of waiting.
+		flags = os.O_WRONLY | syscall.O_NONBLOCK
+	}
+	f, err := os.OpenFile(s.path, flags, 0600)
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENXIO {
+			return ErrNoReader
+		}
+		return fmt.Errorf("Unable to open NDJSON output: %v", err)
+	}
+	s.f = f
+	s.w = f
+	return nil
+}
+
+// Send writes the record as a single line.
+func (s *NDJSON) Send(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errors.New("NDJSON output is closed")
+	}
+	if s.w == nil {
+		if err := s.open(); err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+	}
+	w, f := s.w, s.f
+	s.mutex.Unlock()
+
+	// Write without holding the mutex, so that Close can end a write that
+	// waits for a slow reader.
+	if _, err := w.Write(line); err != nil {
+		if f != nil {
+			// The reader of a FIFO may have gone away. Open the file
+			// again for the next record.
+			s.mutex.Lock()
+			if s.f == f {
+				f.Close()
+				s.f = nil
+				s.w = nil
+			}
+			s.mutex.Unlock()
+		}
+		return fmt.Errorf("Unable to write NDJSON output: %v", err)
+	}
+	return nil
+}
+
+// Close closes the file the records are written to. Only the first call has
+// an effect.
+func (s *NDJSON) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.f != nil {
+		return s.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	return dir
+}
+
+var testRecord = Record{
+	Replica: "replica",
+	Root:    "/r",
+	Paths:   []string{"a.txt", "sub"},
+	Events:  []string{"created", "modified"},
+	Seq:     3,
+	Time:    time.Date(2018, 5, 1, 12, 30, 0, 0, time.UTC),
+}
+
+func TestNewRecord(t *testing.T) {
+	t.Parallel()
+
+	m, err := fsmonitor.New(fsmonitor.WithBackend(fsmonitortest.NewBackend()))
+	if err != nil {
+		t.Fatalf("Unable to create the monitor: %v", err)
+	}
+	r, err := m.AddReplica("replica", "/r", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+
+	b := fsmonitor.Batch{
+		Replica: r,
+		Paths:   []string{"a.txt", "sub"},
+		Events:  fsmonitor.EventModified | fsmonitor.EventCreated,
+		Cursor:  fsmonitor.Cursor{Instance: "x", Seq: 3},
+	}
+	if record := NewRecord(b, testRecord.Time); !reflect.DeepEqual(record, testRecord) {
+		t.Errorf("Expecting %+v, got %+v", testRecord, record)
+	}
+
+	data, _ := json.Marshal(NewRecord(fsmonitor.Batch{Replica: r}, testRecord.Time))
+	if !strings.Contains(string(data), `"paths":[],"events":[]`) {
+		t.Errorf("Expecting empty lists, got %s", data)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	s := NewNDJSON(&buf)
+	if err := s.Send(testRecord); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	s.Close()
+
+	expected := `{"replica":"replica","root":"/r","paths":["a.txt","sub"],"events":["created","modified"],"seq":3,"time":"2018-05-01T12:30:00Z"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expecting %q, got %q", expected, buf.String())
+	}
+	if err := s.Send(testRecord); err == nil {
+		t.Errorf("Expecting Send to fail once closed")
+	}
+}
+
+func TestNDJSONFile(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes.ndjson")
+	if err := ioutil.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+		t.Fatalf("Unable to write the file: %v", err)
+	}
+
+	s, err := OpenNDJSON(path)
+	if err != nil {
+		t.Fatalf("OpenNDJSON failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Send(testRecord); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	// Records are appended.
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 || lines[0] != "{}" {
+		t.Fatalf("Expecting two records after the existing line, got %q", data)
+	}
+	var record Record
+	if err := json.Unmarshal([]byte(lines[2]), &record); err != nil || !reflect.DeepEqual(record, testRecord) {
+		t.Errorf("Expecting %+v, got %+v (%v)", testRecord, record, err)
+	}
+
+	if _, err := OpenNDJSON(filepath.Join(dir, "missing", "changes.ndjson")); err == nil {
+		t.Errorf("Expecting OpenNDJSON to fail in a missing directory")
+	}
+}
+
+func TestNDJSONFIFO(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatalf("Unable to create the FIFO: %v", err)
+	}
+
+	s, err := OpenNDJSON(path)
+	if err != nil {
+		t.Fatalf("OpenNDJSON failed: %v", err)
+	}
+	defer s.Close()
+
+	// Without a reader, records are dropped.
+	if err := s.Send(testRecord); err != ErrNoReader {
+		t.Errorf("Expecting ErrNoReader, got %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("Unable to open the FIFO: %v", err)
+	}
+	if err := s.Send(testRecord); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Unable to read the FIFO: %v", err)
+	}
+	var record Record
+	if err := json.Unmarshal([]byte(line), &record); err != nil || !reflect.DeepEqual(record, testRecord) {
+		t.Errorf("Expecting %+v, got %q (%v)", testRecord, line, err)
+	}
+
+	// Once the reader is gone, the FIFO is opened again for the next
+	// reader.
+	f.Close()
+	if err := s.Send(testRecord); err == nil {
+		t.Errorf("Expecting Send to fail without a reader")
+	}
+	if err := s.Send(testRecord); err != ErrNoReader {
+		t.Errorf("Expecting ErrNoReader, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package sink
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WithSecret signs the body of every request with secret.
+func WithSecret(secret []byte) WebhookOption {
+	return func(w *Webhook) error {
+		w.secret = secret
+		return nil
+	}
+}
+
+// WithQueueSize sets how many records are kept while the endpoint is down.
+// Beyond that, the oldest are dropped. The default is DefaultQueueSize.
+func WithQueueSize(n int) WebhookOption {
+	return func(w *Webhook) error {
+		if n < 1 {
+			return fmt.Errorf("Invalid queue size: %d", n)
+		}
+		w.queueSize = n
+		return nil
+	}
+}
+
+// WithBackoff sets how long to wait before sending a record again after the
+// first failure, doubling up to max for every failure that follows. The
+// defaults are DefaultMinBackoff and DefaultMaxBackoff.
+func WithBackoff(min, max time.Duration) WebhookOption {
+	return func(w *Webhook) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("Invalid backoff: %s to %s", min, max)
+		}
+		w.minBackoff = min
+		w.maxBackoff = max
+		return nil
+	}
+}
+
+// WithHTTPClient sends the requests with c.
+func WithHTTPClient(c *http.Client) WebhookOption {
+	return func(w *Webhook) error {
+		w.client = c
+		return nil
+	}
+}
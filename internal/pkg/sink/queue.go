@@ -0,0 +1,196 @@
+package sink
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	queueLockName = "lock"
+	queueItemExt  = ".json"
+)
+
+// openQueue opens the queue of this process in dir, taking over the items of
+// the queues whose processes are gone. When there are more than size items,
+// the oldest are dropped.
+func openQueue(dir string, size int) (*queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create the queue directory: %v", err)
+	}
+
+	own := filepath.Join(dir, strconv.Itoa(os.Getpid()))
+	if err := os.MkdirAll(own, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create the queue directory: %v", err)
+	}
+	lock, err := lockQueue(own)
+	if err != nil {
+		return nil, err
+	}
+	q := &queue{dir: own, size: size, lock: lock, mutex: &sync.Mutex{}}
+
+	entries, _ := ioutil.ReadDir(dir)
+	for _, fi := range entries {
+		other := filepath.Join(dir, fi.Name())
+		if !fi.IsDir() || other == own {
+			continue
+		}
+		q.adopt(other)
+	}
+
+	q.items = queueItems(own)
+	q.trim()
+
+	return q, nil
+}
+
+// lockQueue locks the queue in dir, failing if another queue has it open.
+func lockQueue(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, queueLockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lock the queue: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Queue %s is in use", dir)
+	}
+	return f, nil
+}
+
+// adopt moves the items of the queue in dir to q if no process has that
+// queue open.
+func (q *queue) adopt(dir string) {
+	lock, err := lockQueue(dir)
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+
+	for _, name := range queueItems(dir) {
+		os.Rename(filepath.Join(dir, name), filepath.Join(q.dir, name))
+	}
+	removeQueue(dir)
+}
+
+// queueItems returns the names of the items in dir, oldest first.
+func queueItems(dir string) []string {
+	entries, _ := ioutil.ReadDir(dir)
+	var items []string
+	for _, fi := range entries {
+		if strings.HasSuffix(fi.Name(), queueItemExt) && !strings.HasPrefix(fi.Name(), ".") {
+			items = append(items, fi.Name())
+		}
+	}
+	sort.Strings(items)
+	return items
+}
+
+// removeQueue removes the directory of a queue without items.
+func removeQueue(dir string) {
+	entries, _ := ioutil.ReadDir(dir)
+	for _, fi := range entries {
+		if fi.Name() != queueLockName && !strings.HasPrefix(fi.Name(), ".") {
+			return
+		}
+		os.Remove(filepath.Join(dir, fi.Name()))
+	}
+	os.Remove(dir)
+}
+
+// push adds a payload to the queue. It returns the number of items that were
+// dropped to make room for it.
+func (q *queue) push(payload []byte) (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Names sort in the order the items were pushed, also across the
+	// queues that are taken over.
+	q.counter++
+	name := fmt.Sprintf("%019d-%06d%s", time.Now().UnixNano(), q.counter%1000000, queueItemExt)
+
+	// Write the item under a name that is not listed until it is
+	// complete.
+	tmp := filepath.Join(q.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, payload, 0600); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("Unable to queue the record: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("Unable to queue the record: %v", err)
+	}
+	q.items = append(q.items, name)
+
+	return q.trim(), nil
+}
+
+// trim drops the oldest items beyond the size of the queue and returns how
+// many it dropped. The caller holds the mutex, if needed.
+func (q *queue) trim() int {
+	n := len(q.items) - q.size
+	if n <= 0 {
+		return 0
+	}
+	for _, name := range q.items[:n] {
+		os.Remove(filepath.Join(q.dir, name))
+	}
+	q.items = append([]string{}, q.items[n:]...)
+	return n
+}
+
+// peek returns the oldest item.
+func (q *queue) peek() (string, []byte, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.items) > 0 {
+		name := q.items[0]
+		payload, err := ioutil.ReadFile(filepath.Join(q.dir, name))
+		if err == nil {
+			return name, payload, true
+		}
+		q.items = q.items[1:]
+	}
+	return "", nil, false
+}
+
+// remove removes an item, which may have been dropped already.
+func (q *queue) remove(name string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i := range q.items {
+		if q.items[i] == name {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			os.Remove(filepath.Join(q.dir, name))
+			return
+		}
+	}
+}
+
+// len returns the number of items in the queue.
+func (q *queue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.items)
+}
+
+// close unlocks the queue, leaving its items for the next process to open
+// the queue directory. The directory of an empty queue is removed.
+func (q *queue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.items) == 0 {
+		removeQueue(q.dir)
+	}
+	q.lock.Close()
+}
@@ -0,0 +1,30 @@
+// Package sink hands the change batches of a monitor to tools other than
+// Unison, such as scripts driving rsync, as records holding the replica, the
+// changed paths and the kinds of events that changed them.
+package sink
+
+import (
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// NewRecord returns the record of a batch delivered at t.
+func NewRecord(b fsmonitor.Batch, t time.Time) Record {
+	r := Record{
+		Replica: b.Replica.Name(),
+		Root:    b.Replica.Root(),
+		Paths:   b.Paths,
+		Events:  b.Events.Names(),
+		Seq:     b.Cursor.Seq,
+		Time:    t,
+	}
+	// Keep the JSON of an empty list a list.
+	if r.Paths == nil {
+		r.Paths = []string{}
+	}
+	if r.Events == nil {
+		r.Events = []string{}
+	}
+	return r
+}
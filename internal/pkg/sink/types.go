@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The defaults of a Webhook.
+const (
+	DefaultQueueSize  = 1000
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = time.Minute
+)
+
+type empty struct{}
+
+// Sink receives the change batches of a monitor, for tools other than
+// Unison. Send is called for one batch at a time.
+type Sink interface {
+	Send(r Record) error
+	Close() error
+}
+
+// Record is a coalesced change batch of a replica as sinks send it. Paths are
+// relative to Root, with the empty path standing for Root itself. Seq is the
+// sequence number of the batch in the change log of the replica.
+type Record struct {
+	Replica string    `json:"replica"`
+	Root    string    `json:"root"`
+	Paths   []string  `json:"paths"`
+	Events  []string  `json:"events"`
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+}
+
+// NDJSON writes each record as a line of JSON to a file, a FIFO or any
+// other writer.
+type NDJSON struct {
+	path string
+	fifo bool
+	// mutex guards the fields below.
+	mutex  *sync.Mutex
+	w      io.Writer
+	f      *os.File
+	closed bool
+}
+
+// Webhook POSTs each record as JSON to a URL. Records are queued on disk
+// first, so that they survive the endpoint being down and the monitor being
+// restarted, and delivered in order by a goroutine of their own.
+type Webhook struct {
+	url        string
+	secret     []byte
+	client     *http.Client
+	queueSize  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	queue      *queue
+	wake       chan empty
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// delivery is the context of the requests, which outlive ctx so that
+	// Close lets the delivery in progress finish.
+	delivery context.Context
+	abort    context.CancelFunc
+	stopped  chan empty
+	once     *sync.Once
+}
+
+// WebhookOption configures a Webhook.
+type WebhookOption func(*Webhook) error
+
+// queue is a bounded queue of payloads kept in a directory of its own below
+// the queue directory, which other processes can share. The directory is
+// locked for as long as the queue is open.
+type queue struct {
+	dir  string
+	size int
+	lock *os.File
+	// mutex guards the fields below.
+	mutex   *sync.Mutex
+	items   []string
+	counter uint64
+}
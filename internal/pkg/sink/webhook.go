@@ -0,0 +1,214 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The headers of the requests of a Webhook. The delivery header identifies
+// the record, which is sent again when the endpoint fails. The signature
+// header holds "sha256=" followed by the HMAC-SHA256 of the body in hex,
+// keyed with the secret.
+const (
+	DeliveryHeader  = "X-Unison-Fsmonitor-Delivery"
+	SignatureHeader = "X-Unison-Fsmonitor-Signature"
+)
+
+// requestTimeout bounds a single delivery attempt.
+const requestTimeout = 30 * time.Second
+
+// closeTimeout bounds how long Close waits for the delivery in progress.
+const closeTimeout = 5 * time.Second
+
+// statusError is a response of the endpoint other than a success.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("Webhook endpoint answered %d %s", e.code, http.StatusText(e.code))
+}
+
+// retry tells whether sending the record again may succeed. Other client
+// errors mean the endpoint does not want the record.
+func (e statusError) retry() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// NewWebhook creates a sink POSTing the records to url, queueing them in
+// queueDir until they are delivered. Monitors can share a queue directory:
+// the records of a monitor that is gone are delivered by the next one to
+// start.
+func NewWebhook(url, queueDir string, options ...WebhookOption) (*Webhook, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("Invalid webhook URL: %s", url)
+	}
+
+	w := &Webhook{
+		url:        url,
+		client:     &http.Client{Timeout: requestTimeout},
+		queueSize:  DefaultQueueSize,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		wake:       make(chan empty, 1),
+		stopped:    make(chan empty),
+		once:       &sync.Once{},
+	}
+
+	for _, option := range options {
+		if err := option(w); err != nil {
+			return nil, fmt.Errorf("Error setting Webhook options: %v", err)
+		}
+	}
+
+	q, err := openQueue(queueDir, w.queueSize)
+	if err != nil {
+		return nil, err
+	}
+	w.queue = q
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.delivery, w.abort = context.WithCancel(context.Background())
+	go w.run()
+
+	return w, nil
+}
+
+// Signature returns the value of the signature header for body, so that
+// receivers can check it with hmac.Equal.
+func Signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send queues the record for delivery. It fails if the record cannot be
+// queued, or if older records had to be dropped to make room for it.
+func (w *Webhook) Send(r Record) error {
+	select {
+	case <-w.ctx.Done():
+		return errors.New("Webhook is closed")
+	default:
+	}
+
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	dropped, err := w.queue.push(payload)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case w.wake <- empty{}:
+	default:
+	}
+
+	if dropped > 0 {
+		return fmt.Errorf("Webhook queue is full, dropped the %d oldest records", dropped)
+	}
+	return nil
+}
+
+// Pending returns the number of records waiting to be delivered.
+func (w *Webhook) Pending() int {
+	return w.queue.len()
+}
+
+// Close stops delivering records. It waits for the delivery in progress for
+// a while, then gives up on it. Records not delivered yet stay queued.
+func (w *Webhook) Close() error {
+	w.once.Do(func() {
+		w.cancel()
+		select {
+		case <-w.stopped:
+		case <-time.After(closeTimeout):
+			w.abort()
+			<-w.stopped
+		}
+		w.abort()
+		w.queue.close()
+	})
+	return nil
+}
+
+// run delivers the queued records in order until Close, waiting longer and
+// longer between the attempts to send a record while they fail.
+func (w *Webhook) run() {
+	defer close(w.stopped)
+
+	backoff := w.minBackoff
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		default:
+		}
+
+		name, payload, ok := w.queue.peek()
+		if !ok {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.ctx.Done():
+				return
+			}
+		}
+
+		err := w.post(strings.TrimSuffix(name, queueItemExt), payload)
+		if e, ok := err.(statusError); err == nil || ok && !e.retry() {
+			w.queue.remove(name)
+			backoff = w.minBackoff
+			continue
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// post sends a payload to the endpoint.
+func (w *Webhook) post(id string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(w.delivery)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "unison-fsmonitor")
+	req.Header.Set(DeliveryHeader, id)
+	if w.secret != nil {
+		req.Header.Set(SignatureHeader, Signature(w.secret, payload))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Read the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError{resp.StatusCode}
+	}
+	return nil
+}
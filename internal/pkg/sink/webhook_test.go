@@ -0,0 +1,270 @@
+package sink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// endpoint is a webhook endpoint that answers with the status codes it is
+// given, and 200 once they run out.
+type endpoint struct {
+	t      *testing.T
+	secret []byte
+	// hold, when set, holds up the responses until it is closed.
+	hold  chan struct{}
+	mutex sync.Mutex
+	codes []int
+	tries int
+	seqs  []uint64
+	ids   []string
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+		e.t.Errorf("Unexpected %s request of %s", req.Method, req.Header.Get("Content-Type"))
+	}
+	if e.secret != nil && req.Header.Get(SignatureHeader) != Signature(e.secret, body) {
+		e.t.Errorf("Invalid signature %q", req.Header.Get(SignatureHeader))
+	}
+
+	if e.hold != nil {
+		defer func() { <-e.hold }()
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.tries++
+	if len(e.codes) > 0 {
+		code := e.codes[0]
+		e.codes = e.codes[1:]
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+	}
+
+	var r Record
+	if err := json.Unmarshal(body, &r); err != nil {
+		e.t.Errorf("Invalid body %q: %v", body, err)
+	}
+	e.seqs = append(e.seqs, r.Seq)
+	e.ids = append(e.ids, req.Header.Get(DeliveryHeader))
+}
+
+// wait waits until n records have been received and returns their sequence
+// numbers.
+func (e *endpoint) wait(n int) []uint64 {
+	e.t.Helper()
+
+	deadline := time.Now().Add(fsmonitortest.Timeout)
+	for {
+		e.mutex.Lock()
+		seqs := append([]uint64{}, e.seqs...)
+		e.mutex.Unlock()
+		if len(seqs) >= n {
+			return seqs
+		}
+		if time.Now().After(deadline) {
+			e.t.Fatalf("Timed out waiting for %d records, got %v", n, seqs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func record(seq uint64) Record {
+	r := testRecord
+	r.Seq = seq
+	return r
+}
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	e := &endpoint{t: t, secret: []byte("secret")}
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, dir, WithSecret(e.secret))
+	if err != nil {
+		t.Fatalf("NewWebhook failed: %v", err)
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := w.Send(record(seq)); err != nil {
+			t.Errorf("Send failed: %v", err)
+		}
+	}
+	if seqs := e.wait(3); len(seqs) != 3 || seqs[0] != 1 || seqs[1] != 2 || seqs[2] != 3 {
+		t.Errorf("Expecting the records in order, got %v", seqs)
+	}
+	if e.ids[0] == "" || e.ids[0] == e.ids[1] {
+		t.Errorf("Expecting each record to have its own delivery id, got %q", e.ids)
+	}
+	// The endpoint has the last record before the webhook has its response.
+	deadline := time.Now().Add(fsmonitortest.Timeout)
+	for w.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	w.Close()
+	if err := w.Send(record(4)); err == nil {
+		t.Errorf("Expecting Send to fail once closed")
+	}
+	// Nothing is left queued.
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expecting the queue directory to be empty, got %d entries", len(entries))
+	}
+}
+
+func TestWebhookCloseWaitsForDelivery(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	e := &endpoint{t: t, hold: make(chan struct{})}
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, dir)
+	if err != nil {
+		t.Fatalf("NewWebhook failed: %v", err)
+	}
+	if err := w.Send(record(1)); err != nil {
+		t.Errorf("Send failed: %v", err)
+	}
+	e.wait(1)
+
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("Expecting Close to wait for the delivery in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(e.hold)
+	<-closed
+
+	// The delivered record is not sent again.
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expecting the queue directory to be empty, got %d entries", len(entries))
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Server errors are retried, the records the endpoint rejects are
+	// dropped.
+	e := &endpoint{t: t, codes: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest}}
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, dir, WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewWebhook failed: %v", err)
+	}
+	defer w.Close()
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		w.Send(record(seq))
+	}
+	if seqs := e.wait(2); len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 3 {
+		t.Errorf("Expecting records 1 and 3, got %v", seqs)
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.tries != 5 {
+		t.Errorf("Expecting 5 requests, got %d", e.tries)
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// The endpoint is down.
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	w, err := NewWebhook(url, dir, WithQueueSize(3), WithBackoff(time.Hour, time.Hour))
+	if err != nil {
+		t.Fatalf("NewWebhook failed: %v", err)
+	}
+	if _, err := NewWebhook(url, dir); err == nil {
+		t.Errorf("Expecting the queue of the process to be in use")
+	}
+	for seq := uint64(1); seq <= 5; seq++ {
+		err := w.Send(record(seq))
+		if seq <= 3 && err != nil {
+			t.Errorf("Send failed: %v", err)
+		}
+		if seq > 3 && err == nil {
+			t.Errorf("Expecting Send to tell that a record was dropped")
+		}
+	}
+	if n := w.Pending(); n != 3 {
+		t.Errorf("Expecting 3 pending records, got %d", n)
+	}
+	w.Close()
+
+	// The queue of a monitor that is gone is taken over.
+	other := filepath.Join(dir, "0")
+	os.Mkdir(other, 0700)
+	payload, _ := json.Marshal(record(6))
+	ioutil.WriteFile(filepath.Join(other, "9999999999999999999-000001.json"), payload, 0600)
+
+	e := &endpoint{t: t}
+	server = httptest.NewServer(e)
+	defer server.Close()
+	w, err = NewWebhook(server.URL, dir)
+	if err != nil {
+		t.Fatalf("NewWebhook failed: %v", err)
+	}
+	defer w.Close()
+
+	if seqs := e.wait(4); len(seqs) != 4 || seqs[0] != 3 || seqs[3] != 6 {
+		t.Errorf("Expecting records 3 to 6, got %v", seqs)
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Errorf("Expecting the other queue to be removed")
+	}
+}
+
+func TestNewWebhookErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := NewWebhook("ftp://example.com", dir); err == nil {
+		t.Errorf("Expecting an invalid URL to fail")
+	}
+	if _, err := NewWebhook("http://example.com", dir, WithQueueSize(0)); err == nil {
+		t.Errorf("Expecting an invalid queue size to fail")
+	}
+	if _, err := NewWebhook("http://example.com", dir, WithBackoff(time.Second, time.Millisecond)); err == nil {
+		t.Errorf("Expecting an invalid backoff to fail")
+	}
+}
@@ -0,0 +1,203 @@
+package snapshot
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// New creates an empty snapshot for the root.
+func New(root string) *Snapshot {
+	return &Snapshot{
+		Root:    root,
+		Entries: make(map[string]Entry),
+	}
+}
+
+// FileName returns the name of the file the snapshot of root is kept in. The
+// name is derived from the root so that every root has its own file.
+func FileName(root string) string {
+	return fmt.Sprintf("%x.snap", sha1.Sum([]byte(root)))
+}
+
+// Scan walks path below root and returns the state of everything in it.
+// Files that disappear during the walk are skipped.
+func Scan(root, path string) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	start := filepath.Join(root, path)
+
+	err := filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == start {
+				return err
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		entries[filepath.ToSlash(rel)] = entryOf(info)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		// A watched path that does not exist has no entries.
+		return entries, nil
+	}
+
+	return entries, err
+}
+
+func entryOf(info os.FileInfo) Entry {
+	if info.IsDir() {
+		return Entry{Mode: uint32(info.Mode())}
+	}
+	return Entry{
+		Mode:    uint32(info.Mode()),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	}
+}
+
+// Under tells whether p is path or lies below it. The empty path stands for
+// the root and contains everything.
+func Under(p, path string) bool {
+	return path == "" || p == path || strings.HasPrefix(p, path+"/")
+}
+
+// Covers tells whether the snapshot holds the state of path.
+func (s *Snapshot) Covers(path string) bool {
+	for _, p := range s.Paths {
+		if Under(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update replaces the state of path with the given entries.
+func (s *Snapshot) Update(path string, entries map[string]Entry) {
+	for p := range s.Entries {
+		if Under(p, path) {
+			delete(s.Entries, p)
+		}
+	}
+	for p, e := range entries {
+		s.Entries[p] = e
+	}
+
+	paths := []string{path}
+	for _, p := range s.Paths {
+		if !Under(p, path) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	s.Paths = paths
+}
+
+// Diff returns the paths below path that were added, removed or changed
+// between the snapshot and the current entries, in sorted order.
+func (s *Snapshot) Diff(path string, current map[string]Entry) []string {
+	var changed []string
+
+	for p, old := range s.Entries {
+		if !Under(p, path) {
+			continue
+		}
+		if e, ok := current[p]; !ok || e != old {
+			changed = append(changed, p)
+		}
+	}
+	for p := range current {
+		if _, ok := s.Entries[p]; !ok && Under(p, path) {
+			changed = append(changed, p)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// Load reads the snapshot of root from dir. It returns nil without an error
+// when there is no usable snapshot.
+func Load(dir, root string) (*Snapshot, error) {
+	f, err := os.Open(filepath.Join(dir, FileName(root)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read snapshot of %s: %v", root, err)
+	}
+	dec := gob.NewDecoder(zr)
+
+	var v int
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("Unable to read snapshot of %s: %v", root, err)
+	}
+	if v != version {
+		return nil, nil
+	}
+
+	s := New(root)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("Unable to read snapshot of %s: %v", root, err)
+	}
+	if s.Root != root {
+		return nil, nil
+	}
+	if s.Entries == nil {
+		s.Entries = make(map[string]Entry)
+	}
+
+	return s, nil
+}
+
+// Save writes the snapshot to dir. The file is replaced atomically, so a
+// crash while saving leaves the previous snapshot in place.
+func (s *Snapshot) Save(dir string) error {
+	s.Saved = time.Now()
+
+	f, err := ioutil.TempFile(dir, ".snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	zw := gzip.NewWriter(f)
+	enc := gob.NewEncoder(zw)
+	if err := enc.Encode(version); err != nil {
+		f.Close()
+		return err
+	}
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(dir, FileName(s.Root)))
+}
@@ -0,0 +1,153 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func makeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(root, name), content)
+	}
+	return root
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+}
+
+func TestUnder(t *testing.T) {
+	tables := []struct {
+		p, path string
+		under   bool
+	}{
+		{p: "foo", path: "", under: true},
+		{p: "", path: "", under: true},
+		{p: "foo", path: "foo", under: true},
+		{p: "foo/bar", path: "foo", under: true},
+		{p: "foobar", path: "foo", under: false},
+		{p: "", path: "foo", under: false},
+	}
+
+	for _, table := range tables {
+		if under := Under(table.p, table.path); under != table.under {
+			t.Errorf("Under(%q, %q): expecting %t, got %t", table.p, table.path, table.under, under)
+		}
+	}
+}
+
+func TestScanAndDiff(t *testing.T) {
+	root := makeTree(t, map[string]string{
+		"a.txt":       "a",
+		"foo/b.txt":   "b",
+		"foo/c.txt":   "c",
+		"bar/d.txt":   "d",
+		"foo/e/f.txt": "f",
+	})
+	defer os.RemoveAll(root)
+
+	entries, err := Scan(root, "foo")
+	if err != nil {
+		t.Fatalf("Unable to scan: %v", err)
+	}
+	s := New(root)
+	s.Update("foo", entries)
+
+	if !s.Covers("foo/e") || s.Covers("bar") || s.Covers("") {
+		t.Errorf("Unexpected coverage: %q", s.Paths)
+	}
+
+	writeFile(t, filepath.Join(root, "foo/b.txt"), "changed")
+	os.Remove(filepath.Join(root, "foo/c.txt"))
+	writeFile(t, filepath.Join(root, "foo/g/h.txt"), "h")
+	writeFile(t, filepath.Join(root, "bar/d.txt"), "changed outside")
+
+	current, err := Scan(root, "foo")
+	if err != nil {
+		t.Fatalf("Unable to scan: %v", err)
+	}
+	expected := []string{"foo/b.txt", "foo/c.txt", "foo/g", "foo/g/h.txt"}
+	if changed := s.Diff("foo", current); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expecting: %q, got: %q", expected, changed)
+	}
+	if changed := s.Diff("foo/e", current); changed != nil {
+		t.Errorf("Expecting no changes below foo/e, got: %q", changed)
+	}
+}
+
+func TestScanMissingPath(t *testing.T) {
+	root := makeTree(t, nil)
+	defer os.RemoveAll(root)
+
+	entries, err := Scan(root, "missing")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expecting no entries and no error, got: %v %v", entries, err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	root := makeTree(t, map[string]string{"foo/a.txt": "a"})
+	defer os.RemoveAll(root)
+	dir := makeTree(t, nil)
+	defer os.RemoveAll(dir)
+
+	if s, err := Load(dir, root); s != nil || err != nil {
+		t.Fatalf("Expecting no snapshot, got: %v %v", s, err)
+	}
+
+	entries, err := Scan(root, "")
+	if err != nil {
+		t.Fatalf("Unable to scan: %v", err)
+	}
+	s := New(root)
+	s.Update("", entries)
+	s.Pending = []string{"foo"}
+	if err := s.Save(dir); err != nil {
+		t.Fatalf("Unable to save: %v", err)
+	}
+
+	loaded, err := Load(dir, root)
+	if err != nil {
+		t.Fatalf("Unable to load: %v", err)
+	}
+	if loaded.Root != root || !reflect.DeepEqual(loaded.Entries, s.Entries) ||
+		!reflect.DeepEqual(loaded.Paths, s.Paths) || !reflect.DeepEqual(loaded.Pending, s.Pending) {
+		t.Errorf("Expecting: %+v, got: %+v", s, loaded)
+	}
+
+	// Only the snapshot file may be left behind.
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != FileName(root) {
+		t.Errorf("Unexpected files in the snapshot dir: %v", files)
+	}
+
+	// Snapshots of other roots are kept apart.
+	if s, err := Load(dir, root+"/foo"); s != nil || err != nil {
+		t.Errorf("Expecting no snapshot for another root, got: %v %v", s, err)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	dir := makeTree(t, map[string]string{FileName("/r"): "garbage"})
+	defer os.RemoveAll(dir)
+
+	if _, err := Load(dir, "/r"); err == nil {
+		t.Errorf("Expected an error for a corrupt snapshot")
+	}
+}
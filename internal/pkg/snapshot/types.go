@@ -0,0 +1,29 @@
+package snapshot
+
+import (
+	"time"
+)
+
+// version is written at the start of every snapshot file. Files written with
+// another version are ignored, which costs a single missed rescan.
+const version = 1
+
+// Entry is the state of a single file, directory or symlink in a tree.
+// Directories only record their presence; a change below a directory shows
+// up as a change of its children.
+type Entry struct {
+	Mode    uint32
+	Size    int64
+	ModTime int64
+}
+
+// Snapshot is the state of the watched parts of a replica's tree at the time
+// it was saved, together with the changes that had not been reported to
+// Unison yet. Paths are relative to Root, using "/" as the separator.
+type Snapshot struct {
+	Root    string
+	Saved   time.Time
+	Paths   []string
+	Entries map[string]Entry
+	Pending []string
+}
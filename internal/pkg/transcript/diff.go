@@ -0,0 +1,67 @@
+package transcript
+
+// Diff compares the expected lines against the actual lines and returns a
+// line-oriented diff. Lines only in expected are prefixed with "-", lines
+// only in actual with "+" and common lines with " ". A nil slice is
+// returned when both are the same.
+func Diff(expected, actual []string) []string {
+	if equal(expected, actual) {
+		return nil
+	}
+
+	// lcs[i][j] holds the length of the longest common subsequence of
+	// expected[i:] and actual[j:].
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(actual)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(actual) - 1; j >= 0; j-- {
+			switch {
+			case expected[i] == actual[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(expected) && j < len(actual) {
+		switch {
+		case expected[i] == actual[j]:
+			out = append(out, " "+expected[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+expected[i])
+			i++
+		default:
+			out = append(out, "+"+actual[j])
+			j++
+		}
+	}
+	for ; i < len(expected); i++ {
+		out = append(out, "-"+expected[i])
+	}
+	for ; j < len(actual); j++ {
+		out = append(out, "+"+actual[j])
+	}
+
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
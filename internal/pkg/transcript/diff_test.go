@@ -0,0 +1,52 @@
+package transcript
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tables := []struct {
+		expected []string
+		actual   []string
+		diff     string
+	}{
+		{
+			expected: []string{"VERSION 1", "OK"},
+			actual:   []string{"VERSION 1", "OK"},
+			diff:     "",
+		},
+		{
+			expected: []string{"VERSION 1", "OK", "DONE"},
+			actual:   []string{"VERSION 1", "DONE"},
+			diff:     " VERSION 1|-OK| DONE",
+		},
+		{
+			expected: []string{"VERSION 1", "DONE"},
+			actual:   []string{"VERSION 1", "RECURSIVE foo", "DONE"},
+			diff:     " VERSION 1|+RECURSIVE foo| DONE",
+		},
+		{
+			expected: []string{"OK"},
+			actual:   nil,
+			diff:     "-OK",
+		},
+	}
+
+	for _, table := range tables {
+		diff := strings.Join(Diff(table.expected, table.actual), "|")
+		if diff != table.diff {
+			t.Errorf("Expected: %q, got: %q", table.diff, diff)
+		}
+	}
+}
+
+func BenchmarkDiff(b *testing.B) {
+	b.ReportAllocs()
+
+	expected := []string{"VERSION 1", "OK", "OK", "DONE", "RECURSIVE a", "DONE"}
+	actual := []string{"VERSION 1", "OK", "DONE", "RECURSIVE b", "DONE"}
+	for i := 0; i < b.N; i++ {
+		Diff(expected, actual)
+	}
+}
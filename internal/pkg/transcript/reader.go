@@ -0,0 +1,92 @@
+package transcript
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Read parses a transcript. Blank lines are skipped; any other line that is
+// not in the format written by a Recorder is an error.
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		text := trimNewline(scanner.Text())
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		entry, err := parseEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func parseEntry(text string) (Entry, error) {
+	// The line itself may contain spaces, so only split off the first two
+	// fields.
+	fields := strings.SplitN(text, " ", 3)
+	if len(fields) < 2 {
+		return Entry{}, fmt.Errorf("Malformed transcript line: %q", text)
+	}
+
+	t, err := time.Parse(timeFormat, fields[0])
+	if err != nil {
+		return Entry{}, fmt.Errorf("Malformed timestamp: %v", err)
+	}
+
+	dir := Direction(fields[1])
+	if dir != Received && dir != Sent {
+		return Entry{}, fmt.Errorf("Unknown direction: %q", fields[1])
+	}
+
+	entry := Entry{Time: t, Direction: dir}
+	if len(fields) == 3 {
+		entry.Line = fields[2]
+	}
+	return entry, nil
+}
+
+// Sessions splits the entries of a transcript into monitor sessions. Unison
+// starts a fresh monitor after every error, and all of them may append to
+// the same transcript. Every session starts with the monitor sending its
+// VERSION.
+func Sessions(entries []Entry) [][]Entry {
+	var sessions [][]Entry
+
+	start := 0
+	for i, entry := range entries {
+		if i > start && entry.Direction == Sent && strings.HasPrefix(entry.Line, "VERSION ") {
+			sessions = append(sessions, entries[start:i])
+			start = i
+		}
+	}
+	if start < len(entries) {
+		sessions = append(sessions, entries[start:])
+	}
+
+	return sessions
+}
+
+// Lines returns the lines of the entries that have the given direction.
+func Lines(entries []Entry, dir Direction) []string {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Direction == dir {
+			lines = append(lines, entry.Line)
+		}
+	}
+	return lines
+}
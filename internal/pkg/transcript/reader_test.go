@@ -0,0 +1,76 @@
+package transcript
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tables := []struct {
+		input string
+		lines int
+		err   bool
+	}{
+		{
+			input: "2018-07-01T12:30:45.000000Z send VERSION 1\n\n2018-07-01T12:30:45.000001Z recv VERSION 1\n",
+			lines: 2,
+		},
+		{
+			input: "2018-07-01T12:30:45.000000Z sideways VERSION 1\n",
+			err:   true,
+		},
+		{
+			input: "yesterday send VERSION 1\n",
+			err:   true,
+		},
+		{
+			input: "2018-07-01T12:30:45.000000Z\n",
+			err:   true,
+		},
+	}
+
+	for _, table := range tables {
+		entries, err := Read(strings.NewReader(table.input))
+		if (err != nil) != table.err {
+			t.Errorf("Read(%q): unexpected error state: %v", table.input, err)
+		}
+		if len(entries) != table.lines {
+			t.Errorf("Read(%q): expected %d entries, got: %d", table.input, table.lines, len(entries))
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	entries := []Entry{
+		{Direction: Sent, Line: "VERSION 1"},
+		{Direction: Received, Line: "VERSION 1"},
+		{Direction: Sent, Line: "ERROR Unknown%20command"},
+		{Direction: Sent, Line: "VERSION 1"},
+		{Direction: Received, Line: "VERSION 1"},
+	}
+
+	sessions := Sessions(entries)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got: %d", len(sessions))
+	}
+	if len(sessions[0]) != 3 || len(sessions[1]) != 2 {
+		t.Errorf("Unexpected session lengths: %d, %d", len(sessions[0]), len(sessions[1]))
+	}
+
+	if sessions := Sessions(nil); len(sessions) != 0 {
+		t.Errorf("Expected no sessions, got: %d", len(sessions))
+	}
+}
+
+func TestLines(t *testing.T) {
+	entries := []Entry{
+		{Direction: Sent, Line: "VERSION 1"},
+		{Direction: Received, Line: "VERSION 1"},
+		{Direction: Sent, Line: "OK"},
+	}
+
+	lines := Lines(entries, Sent)
+	if strings.Join(lines, "|") != "VERSION 1|OK" {
+		t.Errorf("Unexpected lines: %v", lines)
+	}
+}
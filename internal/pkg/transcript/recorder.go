@@ -0,0 +1,34 @@
+package transcript
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// NewRecorder creates a Recorder that writes transcript lines to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		w:     w,
+		now:   time.Now,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Record writes a single line with the current time and the given direction.
+// Trailing newlines are stripped from the line.
+func (r *Recorder) Record(dir Direction, line string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, err := fmt.Fprintf(r.w, "%s %s %s\n", r.now().UTC().Format(timeFormat), dir, trimNewline(line))
+	return err
+}
+
+func trimNewline(line string) string {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	return line
+}
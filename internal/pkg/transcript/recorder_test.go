@@ -0,0 +1,59 @@
+package transcript
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+
+	r := NewRecorder(&buf)
+	r.now = func() time.Time {
+		return time.Date(2018, 7, 1, 12, 30, 45, 123456000, time.UTC)
+	}
+
+	r.Record(Sent, "VERSION 1")
+	r.Record(Received, "START replica /tmp/root%20dir\n")
+
+	expected := "2018-07-01T12:30:45.123456Z send VERSION 1\n" +
+		"2018-07-01T12:30:45.123456Z recv START replica /tmp/root%20dir\n"
+	if buf.String() != expected {
+		t.Errorf("Expected: %q, got: %q", expected, buf.String())
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	r := NewRecorder(&buf)
+	r.Record(Sent, "VERSION 1")
+	r.Record(Received, "VERSION 1")
+	r.Record(Sent, "")
+
+	entries, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read(): %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got: %d", len(entries))
+	}
+	if entries[1].Direction != Received || entries[1].Line != "VERSION 1" {
+		t.Errorf("Unexpected entry: %+v", entries[1])
+	}
+	if entries[2].Direction != Sent || entries[2].Line != "" {
+		t.Errorf("Unexpected entry: %+v", entries[2])
+	}
+}
+
+func BenchmarkRecord(b *testing.B) {
+	b.ReportAllocs()
+
+	var buf bytes.Buffer
+	r := NewRecorder(&buf)
+	for i := 0; i < b.N; i++ {
+		r.Record(Sent, "RECURSIVE foo/bar")
+		buf.Reset()
+	}
+}
@@ -0,0 +1,36 @@
+package transcript
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction tells whether a line was received by the monitor from Unison or
+// sent by the monitor to Unison.
+type Direction string
+
+// The directions a transcript line can have.
+const (
+	Received Direction = "recv"
+	Sent     Direction = "send"
+)
+
+// timeFormat is used for the timestamp that starts every transcript line. It
+// is fixed width so that transcripts line up when viewed in a pager.
+const timeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Entry is a single line of a transcript.
+type Entry struct {
+	Time      time.Time
+	Direction Direction
+	Line      string
+}
+
+// Recorder writes transcript entries to an underlying writer. It is safe for
+// concurrent use.
+type Recorder struct {
+	w     io.Writer
+	now   func() time.Time
+	mutex *sync.Mutex
+}
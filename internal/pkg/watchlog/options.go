@@ -0,0 +1,9 @@
+package watchlog
+
+// WithJSON writes each entry as a line of JSON instead of text.
+func WithJSON() Option {
+	return func(l *Logger) error {
+		l.json = true
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package watchlog
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// The kinds of entries.
+const (
+	// TypeEvent is an event of the backend matched against a replica.
+	TypeEvent = "event"
+	// TypeReport is a batch of changes, as reported to Unison.
+	TypeReport = "report"
+)
+
+// What is done with an event.
+const (
+	// VerdictKept means the event changes a path that is reported.
+	VerdictKept = "kept"
+	// VerdictFiltered means the event lies outside of the paths of the
+	// replica.
+	VerdictFiltered = "filtered"
+	// VerdictIgnored means the path of the event is ignored.
+	VerdictIgnored = "ignored"
+	// VerdictRescan means every path of the replica is reported.
+	VerdictRescan = "rescan"
+)
+
+// Entry is a line of the log.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Replica string    `json:"replica"`
+	// Path is the absolute path of an event.
+	Path    string   `json:"path,omitempty"`
+	Events  []string `json:"events,omitempty"`
+	Verdict string   `json:"verdict,omitempty"`
+	// Paths are the paths reported for an event that is kept or a rescan,
+	// and the coalesced paths of a report.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// Logger writes what a fsmonitor.Monitor does with the events it gets.
+type Logger struct {
+	w     io.Writer
+	json  bool
+	now   func() time.Time
+	mutex *sync.Mutex
+}
+
+// Option configures a Logger.
+type Option func(*Logger) error
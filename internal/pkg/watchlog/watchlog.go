@@ -0,0 +1,128 @@
+// Package watchlog writes a line for every event a fsmonitor.Monitor gets,
+// telling whether it is kept and what path is reported for it, and for every
+// batch of changes, to find out why paths are reported or not without Unison
+// in the loop.
+package watchlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// timeFormat is the format of the time of the text entries.
+const timeFormat = "15:04:05.000"
+
+// New creates a logger writing to w.
+func New(w io.Writer, options ...Option) (*Logger, error) {
+	l := &Logger{
+		w:     w,
+		now:   time.Now,
+		mutex: &sync.Mutex{},
+	}
+
+	for _, option := range options {
+		if err := option(l); err != nil {
+			return nil, fmt.Errorf("Error setting Logger options: %v", err)
+		}
+	}
+
+	return l, nil
+}
+
+// Trace returns the functions of a fsmonitor.Trace that log the events.
+func (l *Logger) Trace() fsmonitor.Trace {
+	return fsmonitor.Trace{
+		Kept: func(r *fsmonitor.Replica, e fsmonitor.Event, path string) {
+			l.event(r, e, VerdictKept, []string{path})
+		},
+		Rescan: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			l.event(r, e, VerdictRescan, fsmonitor.Coalesce(r.Paths()))
+		},
+		Filtered: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			l.event(r, e, VerdictFiltered, nil)
+		},
+		Ignored: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			l.event(r, e, VerdictIgnored, nil)
+		},
+	}
+}
+
+// Report logs a batch of changes with its paths coalesced, as they are
+// reported to Unison.
+func (l *Logger) Report(b fsmonitor.Batch) error {
+	return l.write(Entry{
+		Time:    l.now(),
+		Type:    TypeReport,
+		Replica: b.Replica.Name(),
+		Paths:   fsmonitor.Coalesce(b.Paths),
+	})
+}
+
+// event logs an event matched against a replica. Errors are dropped, as the
+// trace functions cannot return them.
+func (l *Logger) event(r *fsmonitor.Replica, e fsmonitor.Event, verdict string, paths []string) {
+	l.write(Entry{
+		Time:    l.now(),
+		Type:    TypeEvent,
+		Replica: r.Name(),
+		Path:    e.Path,
+		Events:  e.Flags.Names(),
+		Verdict: verdict,
+		Paths:   paths,
+	})
+}
+
+// write writes an entry as a line.
+func (l *Logger) write(e Entry) error {
+	var line string
+	if l.json {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		line = string(data) + "\n"
+	} else {
+		line = e.String() + "\n"
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := io.WriteString(l.w, line)
+	return err
+}
+
+// String formats the entry as text, such as
+// "12:30:00.000 /r kept /r/a.c [modified] -> a.c". The root is shown as ".".
+func (e Entry) String() string {
+	fields := []string{e.Time.Format(timeFormat), e.Replica}
+	if e.Type == TypeReport {
+		fields = append(fields, TypeReport)
+	} else {
+		fields = append(fields, e.Verdict, display(e.Path), "["+strings.Join(e.Events, "|")+"]")
+		if len(e.Paths) > 0 {
+			fields = append(fields, "->")
+		}
+	}
+	for _, p := range e.Paths {
+		fields = append(fields, display(p))
+	}
+	return strings.Join(fields, " ")
+}
+
+// display returns p as shown in text entries.
+func display(p string) string {
+	if p == "" {
+		return "."
+	}
+	if strings.ContainsAny(p, " \t\n\r\"\\") {
+		return strconv.Quote(p)
+	}
+	return p
+}
@@ -0,0 +1,109 @@
+package watchlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+var testTime = time.Date(2018, 5, 1, 12, 30, 0, 0, time.UTC)
+
+// logEvents logs what a monitor does with events for a replica at /r,
+// watching the paths a and b and ignoring *.o, and returns the lines
+// written.
+func logEvents(t *testing.T, events []fsmonitor.Event, options ...Option) []string {
+	var buf bytes.Buffer
+	l, err := New(&buf, options...)
+	if err != nil {
+		t.Fatalf("Unable to create the logger: %v", err)
+	}
+	l.now = func() time.Time { return testTime }
+
+	b := fsmonitortest.NewBackend()
+	m, stop := fsmonitortest.Run(t, b,
+		fsmonitor.WithTrace(l.Trace()),
+		fsmonitor.WithHandler(func(batch fsmonitor.Batch) { l.Report(batch) }),
+	)
+
+	r, err := m.AddReplica("/r", "/r", "a", "b")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	rule, _ := fsmonitor.ParseIgnoreRule("Name *.o")
+	r.AddIgnore(rule)
+
+	b.Inject(t, "/r", events...)
+	b.Sync(t, "/r")
+	stop()
+
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+
+	lines := logEvents(t, []fsmonitor.Event{
+		{Path: "/r/a/x y", Flags: fsmonitor.EventCreated},
+		{Path: "/r/a/x.o", Flags: fsmonitor.EventModified},
+		{Path: "/r/c", Flags: fsmonitor.EventRemoved | fsmonitor.EventIsDir},
+		{Path: "/r/a", Flags: fsmonitor.EventModified | fsmonitor.EventIsDir},
+	})
+	expected := []string{
+		`12:30:00.000 /r kept "/r/a/x y" [created] -> "a/x y"`,
+		`12:30:00.000 /r ignored /r/a/x.o [modified]`,
+		`12:30:00.000 /r filtered /r/c [removed|dir]`,
+		`12:30:00.000 /r kept /r/a [modified|dir] -> a`,
+		`12:30:00.000 /r report a`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expecting\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	lines = logEvents(t, []fsmonitor.Event{{Path: "/r", Flags: fsmonitor.EventOverflow}})
+	expected = []string{
+		`12:30:00.000 /r rescan /r [overflow] -> a b`,
+		`12:30:00.000 /r report a b`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expecting\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	t.Parallel()
+
+	lines := logEvents(t, []fsmonitor.Event{
+		{Path: "/r/b/y", Flags: fsmonitor.EventModified},
+		{Path: "/r/c", Flags: fsmonitor.EventCreated},
+	}, WithJSON())
+	expected := []Entry{
+		{Time: testTime, Type: TypeEvent, Replica: "/r", Path: "/r/b/y", Events: []string{"modified"}, Verdict: VerdictKept, Paths: []string{"b/y"}},
+		{Time: testTime, Type: TypeEvent, Replica: "/r", Path: "/r/c", Events: []string{"created"}, Verdict: VerdictFiltered},
+		{Time: testTime, Type: TypeReport, Replica: "/r", Paths: []string{"b/y"}},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expecting %d lines, got %q", len(expected), lines)
+	}
+	for i, line := range lines {
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Invalid JSON %q: %v", line, err)
+		}
+		if !e.Time.Equal(testTime) {
+			t.Errorf("Expecting the time %s, got %s", testTime, e.Time)
+		}
+		e.Time = testTime
+		if !reflect.DeepEqual(e, expected[i]) {
+			t.Errorf("Expecting %+v, got %+v", expected[i], e)
+		}
+	}
+	if !strings.HasPrefix(lines[2], `{"time":"2018-05-01T12:30:00Z","type":"report","replica":"/r","paths":["b/y"]}`) {
+		t.Errorf("Unexpected report %s", lines[2])
+	}
+}
@@ -0,0 +1,57 @@
+package watchman
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Dial connects to the server listening on the Unix domain socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to Watchman socket: %v", err)
+	}
+
+	dec := json.NewDecoder(conn)
+	dec.UseNumber()
+	return &Client{conn: conn, dec: dec}, nil
+}
+
+// Close hangs up.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Call sends a request made of a command and its arguments and returns the
+// response. An error response is returned as an *Error.
+func (c *Client) Call(cmd string, args ...interface{}) (map[string]interface{}, error) {
+	req, err := json.Marshal(append([]interface{}{cmd}, args...))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode the %s request: %v", cmd, err)
+	}
+	if _, err := c.conn.Write(append(req, '\n')); err != nil {
+		return nil, fmt.Errorf("Unable to send the %s request: %v", cmd, err)
+	}
+
+	var resp map[string]interface{}
+	if err := c.dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("Unable to read the response to %s: %v", cmd, err)
+	}
+	if msg, ok := resp["error"].(string); ok {
+		return resp, &Error{Message: msg}
+	}
+	return resp, nil
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// IsNotWatched tells whether err is the error response to a request about a
+// root that is not watched.
+func IsNotWatched(err error) bool {
+	e, ok := err.(*Error)
+	return ok && strings.HasPrefix(e.Message, "unable to resolve root") && strings.Contains(e.Message, "is not watched")
+}
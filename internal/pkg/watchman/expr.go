@@ -0,0 +1,332 @@
+package watchman
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// compile turns a query expression into a function matching files. The
+// terms are those listed in capabilities.
+func compile(v interface{}) (expr, error) {
+	var term []interface{}
+	switch t := v.(type) {
+	case string:
+		term = []interface{}{t}
+	case []interface{}:
+		term = t
+	default:
+		return nil, fmt.Errorf("expected an expression, got %v", v)
+	}
+	if len(term) == 0 {
+		return nil, fmt.Errorf("expected a non-empty array for an expression")
+	}
+	name, ok := term[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected the name of a term, got %v", term[0])
+	}
+	args := term[1:]
+
+	switch name {
+	case "true":
+		return func(*file) bool { return true }, nil
+	case "false":
+		return func(*file) bool { return false }, nil
+	case "not":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("'not' takes exactly one expression")
+		}
+		e, err := compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(f *file) bool { return !e(f) }, nil
+	case "allof", "anyof":
+		exprs := make([]expr, len(args))
+		for i, a := range args {
+			e, err := compile(a)
+			if err != nil {
+				return nil, err
+			}
+			exprs[i] = e
+		}
+		want := name == "anyof"
+		return func(f *file) bool {
+			for _, e := range exprs {
+				if e(f) == want {
+					return want
+				}
+			}
+			return !want
+		}, nil
+	case "exists":
+		return func(f *file) bool { return f.info != nil }, nil
+	case "type":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("'type' takes exactly one type")
+		}
+		t, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("'type' expects a type, got %v", args[0])
+		}
+		return func(f *file) bool { return f.info != nil && fileType(f.info) == t }, nil
+	case "suffix":
+		suffixes, err := stringList(name, args)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *file) bool {
+			ext := strings.ToLower(path.Ext(f.name))
+			for _, s := range suffixes {
+				if ext == "."+strings.ToLower(s) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "name", "iname":
+		return compileName(name, args)
+	case "match", "imatch":
+		return compileMatch(name, args)
+	case "dirname", "idirname":
+		return compileDirname(name, args)
+	}
+	return nil, fmt.Errorf("unknown expression term '%s'", name)
+}
+
+// stringList returns the strings of the first argument of a term, which is
+// a string or an array of strings.
+func stringList(term string, args []interface{}) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("'%s' expects a string or an array of strings", term)
+	}
+	switch v := args[0].(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, s := range v {
+			var ok bool
+			if list[i], ok = s.(string); !ok {
+				return nil, fmt.Errorf("'%s' expects an array of strings", term)
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("'%s' expects a string or an array of strings", term)
+}
+
+// scope returns the scope argument at index i of a term, which is either
+// "basename", the default, or "wholename".
+func scope(term string, args []interface{}, i int) (bool, error) {
+	if len(args) <= i {
+		return false, nil
+	}
+	switch args[i] {
+	case "basename":
+		return false, nil
+	case "wholename":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid scope '%v' for '%s'", args[i], term)
+}
+
+// subject returns the name of the file a name or match term looks at.
+func subject(f *file, wholename, fold bool) string {
+	s := f.name
+	if !wholename {
+		s = path.Base(s)
+	}
+	if fold {
+		s = strings.ToLower(s)
+	}
+	return s
+}
+
+func compileName(term string, args []interface{}) (expr, error) {
+	names, err := stringList(term, args)
+	if err != nil {
+		return nil, err
+	}
+	wholename, err := scope(term, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	fold := term == "iname"
+
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		if fold {
+			n = strings.ToLower(n)
+		}
+		set[n] = true
+	}
+	return func(f *file) bool { return set[subject(f, wholename, fold)] }, nil
+}
+
+func compileMatch(term string, args []interface{}) (expr, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("'%s' expects a pattern", term)
+	}
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("'%s' expects a pattern, got %v", term, args[0])
+	}
+	wholename, err := scope(term, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	dotfiles := false
+	if len(args) > 2 {
+		opts, ok := args[2].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'%s' expects an object with options", term)
+		}
+		dotfiles, _ = opts["includedotfiles"].(bool)
+	}
+	fold := term == "imatch"
+	if fold {
+		pattern = strings.ToLower(pattern)
+	}
+
+	re, err := wildmatch(pattern, dotfiles)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern for '%s': %v", term, err)
+	}
+	return func(f *file) bool { return re.MatchString(subject(f, wholename, fold)) }, nil
+}
+
+// wildmatch compiles a glob pattern: * and ? match within a path component,
+// ** matches any number of components and brackets match a set of
+// characters. Unless dotfiles is set, wildcards do not match the dot that
+// starts a hidden file or directory.
+func wildmatch(pattern string, dotfiles bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+
+	// first is "[^/]", or "[^/.]" when a leading dot has to be spelled out.
+	first := "[^/]"
+	if !dotfiles {
+		first = "[^/.]"
+	}
+
+	start := true
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && strings.HasPrefix(pattern[i:], "**/") && start:
+			b.WriteString("(?:" + first + "[^/]*/)*")
+			i += 2
+			continue
+		case c == '*' && strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString("(?:" + first + "[^/]*(?:/" + first + "[^/]*)*)?")
+			i++
+		case c == '*' && start && !dotfiles:
+			if i+1 < len(pattern) && pattern[i+1] == '.' {
+				b.WriteString("[^/.][^/]*")
+			} else {
+				// Whatever follows an empty match is still at the
+				// start of the component.
+				b.WriteString("(?:[^/.][^/]*)?")
+				continue
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			if start {
+				b.WriteString(first)
+			} else {
+				b.WriteString("[^/]")
+			}
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+		start = c == '/'
+	}
+
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func compileDirname(term string, args []interface{}) (expr, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("'%s' expects a directory", term)
+	}
+	dir, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("'%s' expects a directory, got %v", term, args[0])
+	}
+	fold := term == "idirname"
+	if fold {
+		dir = strings.ToLower(dir)
+	}
+	dir = strings.Trim(dir, "/")
+
+	// The depth is the number of directories between dir and the file,
+	// which may be limited with ["depth", op, n].
+	depthOK := func(int64) bool { return true }
+	if len(args) > 1 {
+		d, ok := args[1].([]interface{})
+		if !ok || len(d) != 3 || d[0] != "depth" {
+			return nil, fmt.Errorf("'%s' expects [\"depth\", op, n] as its second argument", term)
+		}
+		n, err := toInt(d[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid depth for '%s': %v", term, err)
+		}
+		switch d[1] {
+		case "eq":
+			depthOK = func(depth int64) bool { return depth == n }
+		case "ne":
+			depthOK = func(depth int64) bool { return depth != n }
+		case "gt":
+			depthOK = func(depth int64) bool { return depth > n }
+		case "ge":
+			depthOK = func(depth int64) bool { return depth >= n }
+		case "lt":
+			depthOK = func(depth int64) bool { return depth < n }
+		case "le":
+			depthOK = func(depth int64) bool { return depth <= n }
+		default:
+			return nil, fmt.Errorf("invalid depth operator '%v' for '%s'", d[1], term)
+		}
+	}
+
+	return func(f *file) bool {
+		name := f.name
+		if fold {
+			name = strings.ToLower(name)
+		}
+		if dir != "" {
+			if !strings.HasPrefix(name, dir+"/") {
+				return false
+			}
+			name = name[len(dir)+1:]
+		}
+		return depthOK(int64(strings.Count(name, "/")))
+	}, nil
+}
+
+func toInt(v interface{}) (int64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, got %v", v)
+	}
+	return n.Int64()
+}
@@ -0,0 +1,46 @@
+package watchman
+
+import "testing"
+
+func TestWildmatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		dotfiles bool
+		name     string
+		want     bool
+	}{
+		{"*.go", false, "main.go", true},
+		{"*.go", false, "src/main.go", false},
+		{"*.go", false, ".go", false},
+		{"*.go", true, ".go", true},
+		{"?ain.go", false, "main.go", true},
+		{"?ain.go", false, ".ain.go", false},
+		{"src/**/*.go", false, "src/main.go", true},
+		{"src/**/*.go", false, "src/a/b/main.go", true},
+		{"src/**/*.go", false, "src/.a/main.go", false},
+		{"src/**/*.go", true, "src/.a/main.go", true},
+		{"**", false, "a/b/c", true},
+		{"a/**", false, "a/b/c", true},
+		{"[abc].txt", false, "b.txt", true},
+		{"[!abc].txt", false, "b.txt", false},
+		{"[!abc].txt", false, "d.txt", true},
+		{`\*.txt`, false, "*.txt", true},
+		{`\*.txt`, false, "a.txt", false},
+		{"a.c", false, "abc", false},
+	}
+
+	for _, tt := range tests {
+		re, err := wildmatch(tt.pattern, tt.dotfiles)
+		if err != nil {
+			t.Errorf("Unable to compile %q: %v", tt.pattern, err)
+			continue
+		}
+		if got := re.MatchString(tt.name); got != tt.want {
+			t.Errorf("Expected %q (dotfiles %t) matching %q to be %t", tt.pattern, tt.dotfiles, tt.name, tt.want)
+		}
+	}
+
+	if _, err := wildmatch("[abc", false); err == nil {
+		t.Errorf("Expected an error for an unterminated bracket")
+	}
+}
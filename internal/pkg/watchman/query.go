@@ -0,0 +1,254 @@
+package watchman
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// defaultFields are the fields of the results of a query that does not ask
+// for any. Watchman also reports "new", which the change log cannot tell.
+var defaultFields = []interface{}{"name", "exists", "size", "mode"}
+
+// query answers the query command. Only the since generator is supported:
+// a query reports the files that changed since its since clock, or every
+// file when the clock is of another instance or too old.
+func (s *Server) query(req request) response {
+	r, err := s.lookupRoot(req)
+	if err != nil {
+		return errorResponse("%v", err)
+	}
+	if len(req) < 3 {
+		return errorResponse("wrong number of arguments to 'query'")
+	}
+	spec, ok := req[2].(map[string]interface{})
+	if !ok {
+		return errorResponse("query: expected an object with the query")
+	}
+
+	for _, generator := range []string{"path", "glob", "suffix"} {
+		if _, ok := spec[generator]; ok {
+			return errorResponse("query: the %s generator is not supported", generator)
+		}
+	}
+
+	fields := defaultFields
+	if v, ok := spec["fields"]; ok {
+		if fields, ok = v.([]interface{}); !ok || len(fields) == 0 {
+			return errorResponse("query: fields must be a non-empty array of field names")
+		}
+	}
+	for _, f := range fields {
+		if name, _ := f.(string); !hasCapability("field-" + name) {
+			return errorResponse("query: unknown field %v", f)
+		}
+	}
+
+	match := func(*file) bool { return true }
+	if v, ok := spec["expression"]; ok {
+		if match, err = compile(v); err != nil {
+			return errorResponse("query: %v", err)
+		}
+	}
+
+	relativeRoot := ""
+	if v, ok := spec["relative_root"]; ok {
+		rr, ok := v.(string)
+		if !ok {
+			return errorResponse("query: relative_root must be a string")
+		}
+		relativeRoot = strings.Trim(filepath.Clean("/"+rr), "/")
+	}
+
+	emptyOnFresh, _ := spec["empty_on_fresh_instance"].(bool)
+
+	timeout, err := syncTimeout(spec, s.syncTimeout)
+	if err != nil {
+		return errorResponse("query: %v", err)
+	}
+	if err := s.sync(r, timeout); err != nil {
+		return errorResponse("%v", err)
+	}
+
+	// Named cursors are kept by the server; a query with one moves it on.
+	var (
+		cursor fsmonitor.Cursor
+		named  string
+	)
+	switch since := spec["since"].(type) {
+	case nil:
+	case string:
+		if strings.HasPrefix(since, "n:") {
+			named = since
+			s.mutex.Lock()
+			cursor = r.cursors[named]
+			s.mutex.Unlock()
+		} else if since != "" {
+			if cursor, err = parseClock(since); err != nil {
+				return errorResponse("query: %v", err)
+			}
+		}
+	default:
+		return errorResponse("query: since must be a clock string")
+	}
+
+	changes := r.replica.ChangesSince(cursor)
+	fresh := changes.FreshInstance
+	for _, p := range changes.Paths {
+		// A rescan of the root tells nothing about what changed.
+		if p == "" {
+			fresh = true
+		}
+	}
+
+	if named != "" {
+		s.mutex.Lock()
+		r.cursors[named] = changes.Cursor
+		s.mutex.Unlock()
+	}
+
+	var names []string
+	switch {
+	case fresh && emptyOnFresh:
+	case fresh:
+		if names, err = walk(r.path, relativeRoot); err != nil {
+			return errorResponse("query: %v", err)
+		}
+	default:
+		names = changes.Paths
+	}
+
+	files := []interface{}{}
+	for _, name := range names {
+		if strings.HasPrefix(filepath.Base(name), fsmonitor.CookiePrefix) {
+			continue
+		}
+		if relativeRoot != "" {
+			if !strings.HasPrefix(name, relativeRoot+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(name, relativeRoot+"/")
+		}
+
+		f := &file{name: name}
+		if fi, err := os.Lstat(filepath.Join(r.path, relativeRoot, name)); err == nil {
+			f.info = fi
+		}
+		if fresh && f.info == nil {
+			continue
+		}
+		if match(f) {
+			files = append(files, f.fields(fields))
+		}
+	}
+
+	return response{
+		"version":           Version,
+		"clock":             formatClock(changes.Cursor),
+		"is_fresh_instance": fresh,
+		"files":             files,
+	}
+}
+
+// walk returns the paths of every file below dir of root, relative to dir,
+// in sorted order.
+func walk(root, dir string) ([]string, error) {
+	base := filepath.Join(root, dir)
+
+	var names []string
+	err := filepath.Walk(base, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Files may come and go during the walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == base {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		names = append(names, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to crawl %s: %v", base, err)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// fields returns the result for the file: the value of the only field, or
+// an object with every field.
+func (f *file) fields(fields []interface{}) interface{} {
+	if len(fields) == 1 {
+		return f.field(fields[0].(string))
+	}
+
+	o := make(map[string]interface{}, len(fields))
+	for _, name := range fields {
+		if v := f.field(name.(string)); v != nil {
+			o[name.(string)] = v
+		}
+	}
+	return o
+}
+
+// field returns the value of a field of the file, or nil if it does not
+// exist and the field is about its metadata.
+func (f *file) field(name string) interface{} {
+	switch name {
+	case "name":
+		return f.name
+	case "exists":
+		return f.info != nil
+	}
+	if f.info == nil {
+		return nil
+	}
+
+	switch name {
+	case "size":
+		return f.info.Size()
+	case "mode":
+		if st, ok := f.info.Sys().(*syscall.Stat_t); ok {
+			return uint32(st.Mode)
+		}
+		return uint32(f.info.Mode().Perm())
+	case "mtime":
+		return f.info.ModTime().Unix()
+	case "mtime_ms":
+		return f.info.ModTime().UnixNano() / 1e6
+	case "type":
+		return fileType(f.info)
+	}
+	return nil
+}
+
+// fileType returns the type of the file as Watchman names it.
+func fileType(fi os.FileInfo) string {
+	m := fi.Mode()
+	switch {
+	case m.IsRegular():
+		return "f"
+	case m.IsDir():
+		return "d"
+	case m&os.ModeSymlink != 0:
+		return "l"
+	case m&os.ModeNamedPipe != 0:
+		return "p"
+	case m&os.ModeSocket != 0:
+		return "s"
+	case m&os.ModeCharDevice != 0:
+		return "c"
+	case m&os.ModeDevice != 0:
+		return "b"
+	}
+	return "?"
+}
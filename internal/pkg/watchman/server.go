@@ -0,0 +1,504 @@
+package watchman
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// NewServer creates a server watching the roots clients ask for with m.
+func NewServer(m *fsmonitor.Monitor, options ...Option) (*Server, error) {
+	s := &Server{
+		monitor:     m,
+		syncTimeout: DefaultSyncTimeout,
+		mutex:       &sync.Mutex{},
+		roots:       make(map[string]*root),
+		conns:       make(map[net.Conn]empty),
+		serving:     &sync.WaitGroup{},
+	}
+
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, fmt.Errorf("Error setting Server options: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+// WithSyncTimeout sets how long queries that do not set sync_timeout wait for
+// the events of the changes made before them. Zero makes them answer with
+// the events that have arrived.
+func WithSyncTimeout(d time.Duration) Option {
+	return func(s *Server) error {
+		if d < 0 {
+			return fmt.Errorf("Invalid sync timeout: %s", d)
+		}
+		s.syncTimeout = d
+		return nil
+	}
+}
+
+// Listen listens for clients on the Unix domain socket at path.
+func (s *Server) Listen(path string) error {
+	// Only take over a socket nobody answers on.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("Watchman socket %s is in use", path)
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("Unable to listen on Watchman socket: %v", err)
+	}
+	// Clients can watch anything the server can read, so keep other users
+	// out.
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("Unable to set the permissions of the Watchman socket: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		ln.Close()
+		return fmt.Errorf("Unable to listen on Watchman socket: server is closed")
+	}
+	s.listener = ln
+	s.sockname = path
+	return nil
+}
+
+// Serve accepts clients until the server is closed.
+func (s *Server) Serve() error {
+	s.mutex.Lock()
+	ln := s.listener
+	s.mutex.Unlock()
+	if ln == nil {
+		return fmt.Errorf("Unable to serve: Listen was not called")
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return fmt.Errorf("Unable to accept a Watchman client: %v", err)
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn answers the requests of a single client until it hangs up or
+// the server is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = empty{}
+	s.serving.Add(1)
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+		s.serving.Done()
+	}()
+
+	dec := json.NewDecoder(conn)
+	dec.UseNumber()
+	enc := json.NewEncoder(conn)
+
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF && !s.isClosed() {
+				// There is no telling where the next request starts.
+				enc.Encode(errorResponse("invalid JSON request: %v", err))
+			}
+			return
+		}
+		if err := enc.Encode(s.handle(req)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closed
+}
+
+// Close stops accepting clients, hangs up on the connected ones and stops
+// watching the roots. Closing a Unix listener also removes its socket file.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.serving.Wait()
+
+	s.mutex.Lock()
+	roots := s.roots
+	s.roots = make(map[string]*root)
+	s.mutex.Unlock()
+
+	for _, r := range roots {
+		s.monitor.RemoveReplica(r.replica)
+	}
+	return err
+}
+
+// handle answers a single request.
+func (s *Server) handle(req request) response {
+	if len(req) == 0 {
+		return errorResponse("invalid command (expected an array with some elements!)")
+	}
+	cmd, ok := req[0].(string)
+	if !ok {
+		return errorResponse("invalid command: expected element 0 to be the command name")
+	}
+
+	switch cmd {
+	case "version":
+		return s.version(req)
+	case "get-sockname":
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return response{"version": Version, "sockname": s.sockname}
+	case "watch-list":
+		return response{"version": Version, "roots": s.rootPaths()}
+	case "watch", "watch-project":
+		return s.watch(cmd, req)
+	case "watch-del":
+		return s.watchDel(req)
+	case "watch-del-all":
+		return s.watchDelAll()
+	case "clock":
+		return s.clock(req)
+	case "query":
+		return s.query(req)
+	}
+	return errorResponse("unknown command %s", cmd)
+}
+
+// capabilities are the capabilities the version command reports.
+var capabilities = []string{
+	"cmd-clock",
+	"cmd-get-sockname",
+	"cmd-query",
+	"cmd-version",
+	"cmd-watch",
+	"cmd-watch-del",
+	"cmd-watch-del-all",
+	"cmd-watch-list",
+	"cmd-watch-project",
+	"field-exists",
+	"field-mode",
+	"field-mtime",
+	"field-mtime_ms",
+	"field-name",
+	"field-size",
+	"field-type",
+	"relative_root",
+	"term-allof",
+	"term-anyof",
+	"term-dirname",
+	"term-exists",
+	"term-false",
+	"term-idirname",
+	"term-imatch",
+	"term-iname",
+	"term-match",
+	"term-name",
+	"term-not",
+	"term-suffix",
+	"term-true",
+	"term-type",
+	"wildmatch",
+}
+
+func hasCapability(name string) bool {
+	i := sort.SearchStrings(capabilities, name)
+	return i < len(capabilities) && capabilities[i] == name
+}
+
+// version answers the version command, along with the capabilities the
+// client asks about.
+func (s *Server) version(req request) response {
+	resp := response{"version": Version}
+	if len(req) < 2 {
+		return resp
+	}
+	spec, ok := req[1].(map[string]interface{})
+	if !ok {
+		return errorResponse("version: expected an object with capabilities")
+	}
+
+	caps := make(map[string]interface{})
+	for _, key := range []string{"optional", "required"} {
+		names, _ := spec[key].([]interface{})
+		for _, n := range names {
+			name, _ := n.(string)
+			caps[name] = hasCapability(name)
+			if key == "required" && !hasCapability(name) {
+				resp["error"] = fmt.Sprintf("client required capability `%s` is not supported by this server", name)
+			}
+		}
+	}
+	resp["capabilities"] = caps
+	return resp
+}
+
+// rootPaths returns the watched roots in sorted order.
+func (s *Server) rootPaths() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paths := make([]string, 0, len(s.roots))
+	for p := range s.roots {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// resolve returns the real path of the path argument at index i.
+func resolve(req request, i int) (string, error) {
+	if len(req) <= i {
+		return "", fmt.Errorf("wrong number of arguments to '%s'", req[0])
+	}
+	p, ok := req[i].(string)
+	if !ok {
+		return "", fmt.Errorf("expected argument %d to '%s' to be a path", i, req[0])
+	}
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("unable to resolve root %s: path must be absolute", p)
+	}
+	if real, err := filepath.EvalSymlinks(p); err == nil {
+		p = real
+	}
+	return filepath.Clean(p), nil
+}
+
+// findRoot returns the watched root that is path or contains it.
+func (s *Server) findRoot(path string) (*root, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if r, ok := s.roots[dir]; ok {
+			return r, true
+		}
+		if filepath.Dir(dir) == dir {
+			return nil, false
+		}
+	}
+}
+
+// watch answers the watch and watch-project commands. Both watch the path
+// unless it is, or for watch-project lies below, a watched root.
+func (s *Server) watch(cmd string, req request) response {
+	path, err := resolve(req, 1)
+	if err != nil {
+		return errorResponse("%v", err)
+	}
+
+	if r, ok := s.findRoot(path); ok && (r.path == path || cmd == "watch-project") {
+		resp := response{"version": Version, "watch": r.path, "watcher": s.monitor.Backend().Name()}
+		if r.path != path {
+			resp["relative_path"] = strings.TrimPrefix(path, r.path+"/")
+		}
+		return resp
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		return errorResponse("unable to resolve root %s: %v", path, err)
+	} else if !fi.IsDir() {
+		return errorResponse("unable to resolve root %s: not a directory", path)
+	}
+
+	replica, err := s.monitor.AddReplica("watchman", path, "")
+	if err != nil {
+		return errorResponse("unable to watch %s: %v", path, err)
+	}
+
+	s.mutex.Lock()
+	if _, ok := s.roots[path]; ok || s.closed {
+		// Another client watched it meanwhile, or the server was closed.
+		s.mutex.Unlock()
+		s.monitor.RemoveReplica(replica)
+		if s.isClosed() {
+			return errorResponse("server is shutting down")
+		}
+		return response{"version": Version, "watch": path, "watcher": s.monitor.Backend().Name()}
+	}
+	s.roots[path] = &root{
+		path:    path,
+		replica: replica,
+		cursors: make(map[string]fsmonitor.Cursor),
+	}
+	s.mutex.Unlock()
+
+	return response{"version": Version, "watch": path, "watcher": s.monitor.Backend().Name()}
+}
+
+// watchDel answers the watch-del command.
+func (s *Server) watchDel(req request) response {
+	path, err := resolve(req, 1)
+	if err != nil {
+		return errorResponse("%v", err)
+	}
+
+	s.mutex.Lock()
+	r, ok := s.roots[path]
+	delete(s.roots, path)
+	s.mutex.Unlock()
+
+	if !ok {
+		return errorResponse("unable to resolve root %s: directory %s is not watched", path, path)
+	}
+	s.monitor.RemoveReplica(r.replica)
+	return response{"version": Version, "watch-del": true, "root": path}
+}
+
+// watchDelAll answers the watch-del-all command.
+func (s *Server) watchDelAll() response {
+	s.mutex.Lock()
+	roots := s.roots
+	s.roots = make(map[string]*root)
+	s.mutex.Unlock()
+
+	paths := make([]string, 0, len(roots))
+	for p, r := range roots {
+		s.monitor.RemoveReplica(r.replica)
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return response{"version": Version, "roots": paths}
+}
+
+// lookupRoot returns the watched root given as the argument at index 1.
+func (s *Server) lookupRoot(req request) (*root, error) {
+	path, err := resolve(req, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.roots[path]
+	if !ok {
+		return nil, fmt.Errorf("unable to resolve root %s: directory %s is not watched", path, path)
+	}
+	return r, nil
+}
+
+// clock answers the clock command.
+func (s *Server) clock(req request) response {
+	r, err := s.lookupRoot(req)
+	if err != nil {
+		return errorResponse("%v", err)
+	}
+
+	timeout := s.syncTimeout
+	if len(req) > 2 {
+		spec, ok := req[2].(map[string]interface{})
+		if !ok {
+			return errorResponse("clock: expected an object with options")
+		}
+		if timeout, err = syncTimeout(spec, timeout); err != nil {
+			return errorResponse("clock: %v", err)
+		}
+	}
+	if err := s.sync(r, timeout); err != nil {
+		return errorResponse("%v", err)
+	}
+
+	return response{"version": Version, "clock": formatClock(r.replica.Cursor())}
+}
+
+// sync waits up to timeout for the events of every change made to the root
+// before it was called.
+func (s *Server) sync(r *root, timeout time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+
+	err := s.monitor.Sync(r.replica, timeout)
+	if err == fsmonitor.ErrSyncTimeout {
+		return fmt.Errorf("sync_timeout expired waiting for the events of %s", r.path)
+	}
+	return err
+}
+
+// syncTimeout returns the sync_timeout of a spec, in milliseconds, or def if
+// it has none.
+func syncTimeout(spec map[string]interface{}, def time.Duration) (time.Duration, error) {
+	v, ok := spec["sync_timeout"]
+	if !ok {
+		return def, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("sync_timeout must be a number")
+	}
+	ms, err := n.Int64()
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("sync_timeout must be a non-negative integer")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// formatClock turns a cursor into a Watchman clock.
+func formatClock(c fsmonitor.Cursor) string {
+	return "c:" + c.String()
+}
+
+// parseClock turns a Watchman clock made by formatClock back into a cursor.
+func parseClock(clock string) (fsmonitor.Cursor, error) {
+	if !strings.HasPrefix(clock, "c:") {
+		return fsmonitor.Cursor{}, fmt.Errorf("invalid clock %q", clock)
+	}
+	c, err := fsmonitor.ParseCursor(strings.TrimPrefix(clock, "c:"))
+	if err != nil {
+		return fsmonitor.Cursor{}, fmt.Errorf("invalid clock %q", clock)
+	}
+	return c, nil
+}
+
+func errorResponse(format string, args ...interface{}) response {
+	return response{"version": Version, "error": fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,390 @@
+package watchman
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// The fixtures in testdata/*.txt hold the requests of a client and the
+// responses Watchman gives to them, with the values that differ between runs
+// replaced by variables. Their lines are:
+//
+//	> request   sent to the server
+//	< response  expected from the server
+//	! action    made to the tree, see fixture.act
+//
+// A variable such as $CLOCK1 is bound to the value it stands for in the
+// first response it appears in, and stands for that value afterwards. $ROOT
+// is the root of the tree.
+
+type fixture struct {
+	t       *testing.T
+	backend *fsmonitortest.Backend
+	root    string
+	vars    map[string]interface{}
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+var varPattern = regexp.MustCompile(`\$[A-Z]+[0-9]*`)
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "watchman")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("Unable to get the real path of the tempdir: %v", err)
+	}
+
+	return dir
+}
+
+// newServer runs a server with a monitor using the fake backend until the
+// returned function is called.
+func newServer(t *testing.T, b *fsmonitortest.Backend, options ...Option) (*Server, string, func()) {
+	m, stop := fsmonitortest.Run(t, b)
+
+	s, err := NewServer(m, options...)
+	if err != nil {
+		t.Fatalf("Unable to create the server: %v", err)
+	}
+	dir := makeTempDir(t)
+	sock := filepath.Join(dir, "watchman.sock")
+	if err := s.Listen(sock); err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+
+	return s, sock, func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("Unable to close the server: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.txt")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No fixtures found: %v", err)
+	}
+
+	for _, p := range paths {
+		p := p
+		t.Run(strings.TrimSuffix(filepath.Base(p), ".txt"), func(t *testing.T) {
+			t.Parallel()
+			runFixture(t, p)
+		})
+	}
+}
+
+func runFixture(t *testing.T, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read fixture: %v", err)
+	}
+
+	b := fsmonitortest.NewBackend()
+	_, sock, stop := newServer(t, b, WithSyncTimeout(0))
+	defer stop()
+
+	root := makeTempDir(t)
+	defer os.RemoveAll(root)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer conn.Close()
+
+	f := &fixture{
+		t:       t,
+		backend: b,
+		root:    root,
+		vars:    map[string]interface{}{"$ROOT": root},
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+	}
+
+	for n, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) < 2 || line[1] != ' ' {
+			t.Fatalf("%s:%d: invalid line", path, n+1)
+		}
+		arg := line[2:]
+
+		switch line[0] {
+		case '>':
+			f.send(arg)
+		case '<':
+			f.expect(fmt.Sprintf("%s:%d", path, n+1), arg)
+		case '!':
+			f.act(strings.Fields(arg))
+		default:
+			t.Fatalf("%s:%d: invalid line", path, n+1)
+		}
+	}
+}
+
+// expand replaces the variables in s with their values.
+func (f *fixture) expand(s string) string {
+	return varPattern.ReplaceAllStringFunc(s, func(v string) string {
+		value, ok := f.vars[v]
+		if !ok {
+			f.t.Fatalf("Unbound variable %s in %s", v, s)
+		}
+		if str, ok := value.(string); ok {
+			return str
+		}
+		return fmt.Sprint(value)
+	})
+}
+
+func (f *fixture) send(req string) {
+	req = f.expand(req)
+	if _, err := fmt.Fprintln(f.conn, req); err != nil {
+		f.t.Fatalf("Unable to send %s: %v", req, err)
+	}
+}
+
+func (f *fixture) expect(where, resp string) {
+	var want interface{}
+	dec := json.NewDecoder(strings.NewReader(resp))
+	dec.UseNumber()
+	if err := dec.Decode(&want); err != nil {
+		f.t.Fatalf("%s: invalid response: %v", where, err)
+	}
+
+	f.conn.SetReadDeadline(time.Now().Add(fsmonitortest.Timeout))
+	line, err := f.reader.ReadString('\n')
+	if err != nil {
+		f.t.Fatalf("%s: unable to read the response: %v", where, err)
+	}
+	var got interface{}
+	dec = json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&got); err != nil {
+		f.t.Fatalf("%s: invalid response %s: %v", where, line, err)
+	}
+
+	if !f.match(want, got) {
+		f.t.Errorf("%s: expected %s, got %s", where, resp, strings.TrimSpace(line))
+	}
+}
+
+// match compares a response with the expected one, binding the variables of
+// the expected one.
+func (f *fixture) match(want, got interface{}) bool {
+	switch w := want.(type) {
+	case string:
+		if varPattern.FindString(w) != w {
+			return f.expand(w) == got
+		}
+		if v, ok := f.vars[w]; ok {
+			return reflect.DeepEqual(v, got)
+		}
+		f.vars[w] = got
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !f.match(w[i], g[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for k := range w {
+			if !f.match(w[k], g[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(want, got)
+}
+
+// act changes the tree and delivers the events the change makes:
+//
+//	write PATH         creates or modifies a file
+//	mkdir PATH         creates a directory
+//	remove PATH        removes a file or an empty directory
+//	rename FROM TO     renames a file or directory
+//	overflow           reports that the backend dropped events
+//
+// The events are only delivered while the root is watched.
+func (f *fixture) act(args []string) {
+	t := f.t
+	if len(args) == 0 {
+		t.Fatalf("Empty action")
+	}
+	abs := func(i int) string {
+		if len(args) <= i {
+			t.Fatalf("Missing argument to %s", args[0])
+		}
+		return filepath.Join(f.root, args[i])
+	}
+
+	var events []fsmonitor.Event
+	switch args[0] {
+	case "write":
+		p := abs(1)
+		flags := fsmonitor.EventModified
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			flags = fsmonitor.EventCreated
+		}
+		if err := ioutil.WriteFile(p, []byte(args[1]), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %v", p, err)
+		}
+		events = append(events, fsmonitor.Event{Path: p, Flags: flags})
+	case "mkdir":
+		p := abs(1)
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatalf("Unable to create %s: %v", p, err)
+		}
+		events = append(events, fsmonitor.Event{Path: p, Flags: fsmonitor.EventCreated | fsmonitor.EventIsDir})
+	case "remove":
+		p := abs(1)
+		if err := os.Remove(p); err != nil {
+			t.Fatalf("Unable to remove %s: %v", p, err)
+		}
+		events = append(events, fsmonitor.Event{Path: p, Flags: fsmonitor.EventRemoved})
+	case "rename":
+		from, to := abs(1), abs(2)
+		if err := os.Rename(from, to); err != nil {
+			t.Fatalf("Unable to rename %s: %v", from, err)
+		}
+		events = append(events,
+			fsmonitor.Event{Path: from, Flags: fsmonitor.EventRenamed},
+			fsmonitor.Event{Path: to, Flags: fsmonitor.EventRenamed},
+		)
+	case "overflow":
+		events = append(events, fsmonitor.Event{Path: f.root, Flags: fsmonitor.EventOverflow})
+	default:
+		t.Fatalf("Unknown action %s", args[0])
+	}
+
+	// Changes made before the root is watched make no events.
+	if f.backend.Active() > 0 {
+		f.backend.Inject(t, f.root, events...)
+		f.backend.Sync(t, f.root)
+	}
+}
+
+func TestSyncCookie(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	_, sock, stop := newServer(t, b, WithSyncTimeout(fsmonitortest.Timeout))
+	defer stop()
+
+	root := makeTempDir(t)
+	defer os.RemoveAll(root)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+
+	fmt.Fprintf(conn, `["watch", %q]`+"\n", root)
+	var resp map[string]interface{}
+	if err := dec.Decode(&resp); err != nil || resp["error"] != nil {
+		t.Fatalf("Unable to watch: %v %v", err, resp)
+	}
+
+	// Play the backend: deliver the event of the cookie once it is
+	// written, and only then that of an earlier change.
+	go func() {
+		for {
+			names, _ := filepath.Glob(filepath.Join(root, fsmonitor.CookiePrefix+"*"))
+			if len(names) > 0 {
+				b.Inject(t, root,
+					fsmonitor.Event{Path: filepath.Join(root, "early.txt"), Flags: fsmonitor.EventCreated},
+					fsmonitor.Event{Path: names[0], Flags: fsmonitor.EventCreated},
+				)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	fmt.Fprintf(conn, `["query", %q, {"since": "c:", "fields": ["name"], "empty_on_fresh_instance": true}]`+"\n", root)
+	if err := dec.Decode(&resp); err != nil || resp["error"] != nil {
+		t.Fatalf("Unable to query: %v %v", err, resp)
+	}
+	clock := resp["clock"].(string)
+
+	fmt.Fprintf(conn, `["query", %q, {"since": %q, "fields": ["name"], "sync_timeout": 0}]`+"\n", root, clock)
+	if err := dec.Decode(&resp); err != nil || resp["error"] != nil {
+		t.Fatalf("Unable to query: %v %v", err, resp)
+	}
+	if files := resp["files"].([]interface{}); len(files) != 0 {
+		t.Errorf("Expected the clock of the synced query to include the earlier change, got %v", files)
+	}
+	if names, _ := filepath.Glob(filepath.Join(root, fsmonitor.CookiePrefix+"*")); len(names) != 0 {
+		t.Errorf("Expected the cookie to be removed, got %v", names)
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	_, sock, stop := newServer(t, b, WithSyncTimeout(0))
+
+	root := makeTempDir(t)
+	defer os.RemoveAll(root)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, `["watch", %q]`+"\n", root)
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("Unable to watch: %v", err)
+	}
+
+	stop()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed")
+	}
+	deadline := time.Now().Add(fsmonitortest.Timeout)
+	for b.Active() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the watch to be stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
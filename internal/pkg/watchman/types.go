@@ -0,0 +1,75 @@
+package watchman
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// Version is the Watchman release whose protocol the server follows. Clients
+// compare it to decide what they can ask for.
+const Version = "4.9.0"
+
+// DefaultSyncTimeout is how long a query waits for the events of the changes
+// made before it when the query does not set sync_timeout.
+const DefaultSyncTimeout = 10 * time.Second
+
+type empty struct{}
+
+// Server answers requests in Watchman's JSON protocol with the changes a
+// fsmonitor.Monitor tracks. Every watched root is a replica of the monitor,
+// so it shares the backend watches with everything else the monitor
+// watches.
+type Server struct {
+	monitor     *fsmonitor.Monitor
+	syncTimeout time.Duration
+	// mutex guards the fields below.
+	mutex    *sync.Mutex
+	roots    map[string]*root
+	listener net.Listener
+	sockname string
+	conns    map[net.Conn]empty
+	closed   bool
+	serving  *sync.WaitGroup
+}
+
+// root is a watched root along with the named cursors clients keep in it.
+type root struct {
+	path    string
+	replica *fsmonitor.Replica
+	cursors map[string]fsmonitor.Cursor
+}
+
+// Option configures a Server.
+type Option func(*Server) error
+
+// request is a decoded request: the command followed by its arguments.
+type request []interface{}
+
+// response is an object sent back for a request.
+type response map[string]interface{}
+
+// file is a candidate for the results of a query. Info is nil when the file
+// does not exist.
+type file struct {
+	name string
+	info os.FileInfo
+}
+
+// expr is a compiled query expression.
+type expr func(f *file) bool
+
+// Client talks to a server of Watchman's JSON protocol.
+type Client struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// Error is an error response of a server.
+type Error struct {
+	Message string
+}
@@ -0,0 +1,113 @@
+// +build darwin
+
+package fsmonitor
+
+import (
+	"github.com/fsnotify/fsevents"
+)
+
+// DefaultBackend returns the native backend of the platform, which watches
+// roots with the macOS FSEvents API.
+func DefaultBackend() Backend {
+	return &fseventsBackend{
+		eventsChannelSize: defaultEventsChannelSize,
+	}
+}
+
+// fseventsBackend watches roots with the macOS FSEvents API.
+type fseventsBackend struct {
+	eventsChannelSize int
+}
+
+type fseventsWatcher struct {
+	es     *fsevents.EventStream
+	events chan []Event
+	stop   chan empty
+	done   chan empty
+}
+
+func (b *fseventsBackend) Name() string {
+	return "fsevents"
+}
+
+func (b *fseventsBackend) Watch(root string) (Watcher, error) {
+	w := &fseventsWatcher{
+		es: &fsevents.EventStream{
+			Paths:   []string{root},
+			Latency: DefaultLatency,
+			Events:  make(chan []fsevents.Event, b.eventsChannelSize),
+			Flags:   fsevents.FileEvents | fsevents.WatchRoot,
+		},
+		events: make(chan []Event, b.eventsChannelSize),
+		stop:   make(chan empty),
+		done:   make(chan empty),
+	}
+	w.es.Start()
+
+	go w.translate()
+
+	return w, nil
+}
+
+func (w *fseventsWatcher) Events() <-chan []Event {
+	return w.events
+}
+
+func (w *fseventsWatcher) Stop() {
+	w.es.Stop()
+	close(w.stop)
+	<-w.done
+}
+
+// translate converts the FSEvents events to backend independent events until
+// the watcher is stopped.
+func (w *fseventsWatcher) translate() {
+	defer close(w.done)
+
+	for {
+		select {
+		case fsEvents := <-w.es.Events:
+			events := make([]Event, len(fsEvents))
+			for i, e := range fsEvents {
+				events[i] = Event{Path: e.Path, Flags: translateFlags(e.Flags)}
+			}
+			select {
+			case w.events <- events:
+			case <-w.stop:
+				return
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+var fseventsFlags = []struct {
+	from fsevents.EventFlags
+	to   EventFlags
+}{
+	{fsevents.ItemCreated, EventCreated},
+	{fsevents.ItemRemoved, EventRemoved},
+	{fsevents.ItemModified, EventModified},
+	{fsevents.ItemRenamed, EventRenamed},
+	{fsevents.ItemInodeMetaMod, EventMetadata},
+	{fsevents.ItemFinderInfoMod, EventMetadata},
+	{fsevents.ItemChangeOwner, EventMetadata},
+	{fsevents.ItemXattrMod, EventMetadata},
+	{fsevents.ItemIsDir, EventIsDir},
+	{fsevents.ItemIsSymlink, EventIsSymlink},
+	{fsevents.MustScanSubDirs, EventMustScanSubDirs},
+	{fsevents.UserDropped, EventOverflow},
+	{fsevents.KernelDropped, EventOverflow},
+	{fsevents.RootChanged, EventRootChanged},
+}
+
+func translateFlags(f fsevents.EventFlags) EventFlags {
+	var flags EventFlags
+	for _, t := range fseventsFlags {
+		if f&t.from != 0 {
+			flags |= t.to
+		}
+	}
+	return flags
+}
@@ -0,0 +1,10 @@
+// +build !darwin
+
+package fsmonitor
+
+// DefaultBackend returns the native backend of the platform. There is none
+// outside of macOS, so nil is returned and a backend has to be given with
+// WithBackend.
+func DefaultBackend() Backend {
+	return nil
+}
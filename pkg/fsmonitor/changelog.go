@@ -0,0 +1,167 @@
+package fsmonitor
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+// DefaultChangeLogSize is how many changed paths each replica remembers for
+// ChangesSince.
+const DefaultChangeLogSize = 10000
+
+// instances numbers the change logs created by this process.
+var instances uint64
+
+// Cursor is a position in the change log of a replica. The zero Cursor lies
+// before every change of every replica.
+type Cursor struct {
+	// Instance identifies the change log. It differs for every replica
+	// added to a monitor, including one added again after being removed.
+	Instance string
+	// Seq is the sequence number of the last batch of changes seen.
+	Seq uint64
+}
+
+// String formats the cursor as a token that ParseCursor understands. The
+// zero Cursor is the empty string.
+func (c Cursor) String() string {
+	if c.Instance == "" && c.Seq == 0 {
+		return ""
+	}
+	return c.Instance + ":" + strconv.FormatUint(c.Seq, 10)
+}
+
+// ParseCursor parses a token made by Cursor.String. The empty string is the
+// zero Cursor.
+func ParseCursor(s string) (Cursor, error) {
+	if s == "" {
+		return Cursor{}, nil
+	}
+
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return Cursor{}, fmt.Errorf("Invalid cursor: %s", s)
+	}
+	seq, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("Invalid cursor: %s", s)
+	}
+	return Cursor{Instance: s[:i], Seq: seq}, nil
+}
+
+// Changes is the answer to a ChangesSince query.
+type Changes struct {
+	// Paths are the paths that changed after the cursor of the query, in
+	// sorted order and relative to the root of the replica.
+	Paths []string
+	// Cursor is the position to query from next time.
+	Cursor Cursor
+	// FreshInstance is set when the log does not reach back to the cursor
+	// of the query, or the cursor is of another log. Paths then holds every
+	// path of the replica, which all have to be rescanned.
+	FreshInstance bool
+}
+
+// changeLog keeps the latest changed paths of a replica, numbered by the
+// batch they came in, in a ring of a fixed size.
+type changeLog struct {
+	mutex    sync.Mutex
+	instance string
+	seq      uint64
+	// dropped is the sequence number of the latest batch that no longer is
+	// completely in the log.
+	dropped uint64
+	entries []logEntry
+	start   int
+	count   int
+}
+
+type logEntry struct {
+	seq  uint64
+	path string
+}
+
+func newChangeLog(size int) *changeLog {
+	n := atomic.AddUint64(&instances, 1)
+	return &changeLog{
+		instance: fmt.Sprintf("%x.%x.%d", os.Getpid(), time.Now().UnixNano(), n),
+		entries:  make([]logEntry, size),
+	}
+}
+
+// add appends the paths of a batch to the log and returns the cursor after
+// it.
+func (l *changeLog) add(paths []string) Cursor {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.seq++
+	for _, p := range paths {
+		if l.count == len(l.entries) {
+			l.dropped = l.entries[l.start].seq
+			l.start = (l.start + 1) % len(l.entries)
+			l.count--
+		}
+		l.entries[(l.start+l.count)%len(l.entries)] = logEntry{seq: l.seq, path: p}
+		l.count++
+	}
+
+	return Cursor{Instance: l.instance, Seq: l.seq}
+}
+
+func (l *changeLog) cursor() Cursor {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return Cursor{Instance: l.instance, Seq: l.seq}
+}
+
+// since returns the paths logged after c, or false if the log does not reach
+// back to c.
+func (l *changeLog) since(c Cursor) ([]string, Cursor, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	cur := Cursor{Instance: l.instance, Seq: l.seq}
+	if c.Instance != l.instance || c.Seq > l.seq || c.Seq < l.dropped {
+		return nil, cur, false
+	}
+
+	changes := set.New()
+	for i := 0; i < l.count; i++ {
+		e := l.entries[(l.start+i)%len(l.entries)]
+		if e.seq > c.Seq {
+			changes.Add(e.path)
+		}
+	}
+	paths := changes.StringSlice()
+	sort.Strings(paths)
+
+	return paths, cur, true
+}
+
+// Cursor returns the current position in the change log of the replica.
+func (r *Replica) Cursor() Cursor {
+	return r.log.cursor()
+}
+
+// ChangesSince returns the paths of the replica that changed after the
+// cursor, which is usually one returned by an earlier query, and the cursor
+// to query from next. Every consumer keeps its own cursor, so unlike the
+// batches of a Subscription the changes can be read by any number of them.
+// The paths are not coalesced.
+func (r *Replica) ChangesSince(c Cursor) Changes {
+	paths, cur, ok := r.log.since(c)
+	if !ok {
+		return Changes{Paths: r.Paths(), Cursor: cur, FreshInstance: true}
+	}
+	return Changes{Paths: paths, Cursor: cur}
+}
@@ -0,0 +1,123 @@
+package fsmonitor_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+func TestParseCursor(t *testing.T) {
+	for _, c := range []fsmonitor.Cursor{{}, {Instance: "1a.2b.3", Seq: 42}} {
+		parsed, err := fsmonitor.ParseCursor(c.String())
+		if err != nil {
+			t.Errorf("Unable to parse %q: %v", c.String(), err)
+		} else if parsed != c {
+			t.Errorf("Expected %q to parse to %v, got %v", c.String(), c, parsed)
+		}
+	}
+
+	for _, s := range []string{"42", "1a.2b.3:", "1a.2b.3:x"} {
+		if _, err := fsmonitor.ParseCursor(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	m, stop := fsmonitortest.Run(t, b)
+	defer stop()
+
+	r, err := m.AddReplica("replica", "/r", "a", "b")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+
+	// A consumer without a cursor has to scan everything.
+	c := r.ChangesSince(fsmonitor.Cursor{})
+	if !c.FreshInstance || !reflect.DeepEqual(c.Paths, []string{"a", "b"}) {
+		t.Errorf("Expected a fresh instance with every path, got %+v", c)
+	}
+	first := c.Cursor
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a/x", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+	c = r.ChangesSince(first)
+	if c.FreshInstance || !reflect.DeepEqual(c.Paths, []string{"a/x"}) {
+		t.Errorf("Expected a/x, got %+v", c)
+	}
+	second := c.Cursor
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/b/y", Flags: fsmonitor.EventModified})
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a/x", Flags: fsmonitor.EventRemoved})
+	b.Sync(t, "/r")
+
+	// Consumers read the same log independently.
+	if c = r.ChangesSince(first); !reflect.DeepEqual(c.Paths, []string{"a/x", "b/y"}) {
+		t.Errorf("Expected a/x and b/y since the first cursor, got %+v", c)
+	}
+	if c = r.ChangesSince(second); !reflect.DeepEqual(c.Paths, []string{"a/x", "b/y"}) {
+		t.Errorf("Expected a/x and b/y since the second cursor, got %+v", c)
+	}
+	if c = r.ChangesSince(c.Cursor); c.FreshInstance || len(c.Paths) != 0 {
+		t.Errorf("Expected no changes since the latest cursor, got %+v", c)
+	}
+}
+
+func TestChangesSinceBounded(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	m, stop := fsmonitortest.Run(t, b, fsmonitor.WithChangeLogSize(3))
+	defer stop()
+
+	r, err := m.AddReplica("replica", "/r", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+
+	start := r.Cursor()
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+	middle := r.Cursor()
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/b", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/c", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/d", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+
+	if c := r.ChangesSince(start); !c.FreshInstance || !reflect.DeepEqual(c.Paths, []string{""}) {
+		t.Errorf("Expected a fresh instance once the log no longer reaches back, got %+v", c)
+	}
+	if c := r.ChangesSince(middle); c.FreshInstance || !reflect.DeepEqual(c.Paths, []string{"b", "c", "d"}) {
+		t.Errorf("Expected b, c and d, got %+v", c)
+	}
+}
+
+func TestChangesSinceOtherInstance(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	m, stop := fsmonitortest.Run(t, b)
+	defer stop()
+
+	r, err := m.AddReplica("replica", "/r", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	cursor := r.Cursor()
+	m.RemoveReplica(r)
+
+	r, err = m.AddReplica("replica", "/r", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	if c := r.ChangesSince(cursor); !c.FreshInstance {
+		t.Errorf("Expected a fresh instance for the cursor of a removed replica, got %+v", c)
+	}
+}
@@ -0,0 +1,117 @@
+package fsmonitor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CookiePrefix starts the names of the files Sync creates, like those of
+// Watchman. The events of the files created by Sync are never reported as
+// changes, while other files with such a name are reported as usual.
+const CookiePrefix = ".watchman-cookie-"
+
+// cookieExpiry is how long the name of a removed cookie is kept when the
+// event of its removal does not arrive.
+const cookieExpiry = time.Minute
+
+// ErrSyncTimeout is returned by Sync when the event of its cookie does not
+// arrive in time.
+var ErrSyncTimeout = errors.New("Timed out waiting for the sync cookie")
+
+// Sync waits up to timeout for the events of every change made below the
+// root of the replica before it was called. It creates a cookie file in the
+// root and waits for its event, which the backend delivers after those of
+// the earlier changes. Once Sync returns nil, those changes are in the change
+// log of the replica.
+func (m *Monitor) Sync(r *Replica, timeout time.Duration) error {
+	host, _ := os.Hostname()
+	c := &cookie{seen: make(chan empty)}
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	m.cookieCount++
+	name := fmt.Sprintf("%s%s-%d-%d", CookiePrefix, host, os.Getpid(), m.cookieCount)
+	c.watch = r.watch
+	m.cookies[name] = c
+	m.mutex.Unlock()
+
+	path := filepath.Join(r.root, name)
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		m.forgetCookie(name, c)
+		return fmt.Errorf("Unable to write sync cookie: %v", err)
+	}
+	// The name is kept once the cookie is removed, so that the event of its
+	// removal is dropped too.
+	defer func() {
+		os.Remove(path)
+		time.AfterFunc(cookieExpiry, func() { m.forgetCookie(name, c) })
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.seen:
+		return nil
+	case <-timer.C:
+		return ErrSyncTimeout
+	}
+}
+
+// forgetCookie stops dropping the events of the cookie c called name.
+func (m *Monitor) forgetCookie(name string, c *cookie) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.cookies[name] == c {
+		delete(m.cookies, name)
+	}
+}
+
+// takeCookies drops the events of cookies from a batch of events of the
+// watch. It returns the other events and the cookies of Sync calls that can
+// return once the batch has been handled. An event that makes every path
+// change may stand for the event of a cookie, so it releases every cookie of
+// the watch.
+func (m *Monitor) takeCookies(w *watch, events []Event) ([]Event, []*cookie) {
+	kept := make([]Event, 0, len(events))
+	var seen []*cookie
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	release := func(c *cookie) {
+		if !c.released {
+			c.released = true
+			seen = append(seen, c)
+		}
+	}
+
+	for _, e := range events {
+		name := filepath.Base(e.Path)
+		if c, ok := m.cookies[name]; ok && c.watch == w {
+			release(c)
+			// Nothing is left to drop once the cookie is removed.
+			if e.Flags&EventRemoved != 0 {
+				delete(m.cookies, name)
+			}
+			continue
+		}
+		if e.Flags.Rescan() {
+			for _, c := range m.cookies {
+				if c.watch == w {
+					release(c)
+				}
+			}
+		}
+		kept = append(kept, e)
+	}
+
+	return kept, seen
+}
@@ -0,0 +1,141 @@
+package fsmonitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+var eventFlagNames = []struct {
+	flag EventFlags
+	name string
+}{
+	{EventCreated, "created"},
+	{EventRemoved, "removed"},
+	{EventModified, "modified"},
+	{EventRenamed, "renamed"},
+	{EventMetadata, "metadata"},
+	{EventIsDir, "dir"},
+	{EventIsSymlink, "symlink"},
+	{EventMustScanSubDirs, "must-scan-subdirs"},
+	{EventOverflow, "overflow"},
+	{EventRootChanged, "root-changed"},
+}
+
+// Names returns the names of the flags that are set, such as "created".
+func (f EventFlags) Names() []string {
+	var names []string
+	for _, n := range eventFlagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func (f EventFlags) String() string {
+	names := f.Names()
+	if len(names) == 0 {
+		return fmt.Sprintf("flags(%d)", uint32(f))
+	}
+	return strings.Join(names, "|")
+}
+
+// Rescan returns true when the event says nothing about the individual
+// paths that changed and every watched path has to be rescanned.
+func (f EventFlags) Rescan() bool {
+	return f&(EventOverflow|EventRootChanged) != 0
+}
+
+// handleEvents collects the changes of a batch of events for the replica and
+// hands them to the handlers and subscriptions.
+func (m *Monitor) handleEvents(r *Replica, events []Event) {
+	paths := r.paths.StringSlice()
+	changes := set.New()
+	var flags EventFlags
+
+	for _, e := range events {
+		if m.trace.Event != nil {
+			m.trace.Event(r, e)
+		}
+
+		if e.Flags.Rescan() {
+			// Nothing is known about what changed, so every watched path has
+			// to be rescanned.
+			if m.trace.Rescan != nil {
+				m.trace.Rescan(r, e)
+			}
+			for _, p := range paths {
+				changes.Add(p)
+			}
+			flags |= e.Flags
+		} else if p, ok := matchPath(r.root, paths, e.Path, r.fold); ok {
+			if !r.Ignored(p) {
+				p = r.Respell(p)
+				if m.trace.Kept != nil {
+					m.trace.Kept(r, e, p)
+				}
+				changes.Add(p)
+				flags |= e.Flags
+			} else if m.trace.Ignored != nil {
+				m.trace.Ignored(r, e)
+			}
+		} else if m.trace.Filtered != nil {
+			m.trace.Filtered(r, e)
+		}
+	}
+
+	if changes.Size() == 0 || r.Removed() {
+		return
+	}
+	b := Batch{Replica: r, Paths: changes.StringSlice(), Events: flags}
+	sort.Strings(b.Paths)
+	b.Cursor = r.log.add(b.Paths)
+	m.deliver(b)
+}
+
+// deliver hands a batch to the handlers and the subscriptions.
+func (m *Monitor) deliver(b Batch) {
+	for _, h := range m.handlers {
+		h(b)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for s := range m.subscriptions {
+		s.add(b)
+	}
+}
+
+// Coalesce sorts the paths and drops every path that lies below another path
+// in the list, as a rescan of a path covers everything below it. The empty
+// path stands for the root and covers every other path.
+func Coalesce(paths []string) []string {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+
+	coalesced := make([]string, 0, len(sorted))
+	kept := make(map[string]bool, len(sorted))
+	for _, p := range sorted {
+		if kept[""] || kept[p] {
+			continue
+		}
+
+		covered := false
+		for i := strings.LastIndex(p, "/"); i > 0; i = strings.LastIndex(p[:i], "/") {
+			if kept[p[:i]] {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			coalesced = append(coalesced, p)
+			kept[p] = true
+		}
+	}
+
+	return coalesced
+}
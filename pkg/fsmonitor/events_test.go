@@ -0,0 +1,43 @@
+package fsmonitor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCoalesce(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		paths    []string
+		expected []string
+	}{
+		{paths: nil, expected: []string{}},
+		{paths: []string{"b", "a"}, expected: []string{"a", "b"}},
+		{paths: []string{"foo/bar", "foo", "foo/baz/qux"}, expected: []string{"foo"}},
+		{paths: []string{"foo bar", "foo/bar", "foo"}, expected: []string{"foo", "foo bar"}},
+		{paths: []string{"foobar", "foo/bar"}, expected: []string{"foo/bar", "foobar"}},
+		{paths: []string{"a/b", "", "c"}, expected: []string{""}},
+	}
+
+	for _, table := range tables {
+		coalesced := Coalesce(table.paths)
+		if strings.Join(coalesced, "|") != strings.Join(table.expected, "|") || len(coalesced) != len(table.expected) {
+			t.Errorf("Coalesce(%v): expecting: %v, got: %v", table.paths, table.expected, coalesced)
+		}
+	}
+}
+
+func TestEventFlagsString(t *testing.T) {
+	t.Parallel()
+
+	if s := (EventCreated | EventIsDir).String(); s != "created|dir" {
+		t.Errorf("Expecting: created|dir, got: %s", s)
+	}
+	if s := EventFlags(0).String(); s != "flags(0)" {
+		t.Errorf("Expecting: flags(0), got: %s", s)
+	}
+	if names := (EventRemoved | EventOverflow).Names(); strings.Join(names, ",") != "removed,overflow" {
+		t.Errorf("Expecting: [removed overflow], got: %v", names)
+	}
+}
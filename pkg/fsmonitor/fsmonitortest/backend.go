@@ -0,0 +1,172 @@
+// Package fsmonitortest provides an in-memory filesystem event backend for
+// testing code that uses package fsmonitor.
+package fsmonitortest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// Timeout bounds how long Inject waits for a watcher to take a batch.
+var Timeout = 10 * time.Second
+
+// Backend is an in-memory backend. Tests inject events into the watcher of a
+// root in any order and with any flags, without touching the filesystem.
+type Backend struct {
+	mutex    sync.Mutex
+	watchers map[string][]*watcher
+	watches  int
+	fail     error
+	// stopGate, when set, holds up stopping watchers until it is closed.
+	stopGate chan struct{}
+}
+
+type watcher struct {
+	backend *Backend
+	root    string
+	events  chan []fsmonitor.Event
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewBackend creates a backend without any watchers.
+func NewBackend() *Backend {
+	return &Backend{
+		watchers: make(map[string][]*watcher),
+	}
+}
+
+// Name identifies the backend.
+func (b *Backend) Name() string {
+	return "fake"
+}
+
+// Watch creates a watcher of root. It fails with the error set by Fail, if
+// any.
+func (b *Backend) Watch(root string) (fsmonitor.Watcher, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.fail != nil {
+		return nil, b.fail
+	}
+
+	// The events channel is unbuffered so that an injection only returns
+	// once the event handler has taken the batch.
+	w := &watcher{
+		backend: b,
+		root:    root,
+		events:  make(chan []fsmonitor.Event),
+		stopped: make(chan struct{}),
+	}
+	b.watchers[root] = append(b.watchers[root], w)
+	b.watches++
+
+	return w, nil
+}
+
+// Fail makes every further Watch fail with err, or succeed again if err is
+// nil.
+func (b *Backend) Fail(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.fail = err
+}
+
+// HoldStops makes stopping watchers block until the returned function is
+// called.
+func (b *Backend) HoldStops() func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	gate := make(chan struct{})
+	b.stopGate = gate
+	return func() { close(gate) }
+}
+
+// Active returns the number of watchers that have not been stopped.
+func (b *Backend) Active() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	n := 0
+	for _, ws := range b.watchers {
+		n += len(ws)
+	}
+	return n
+}
+
+// Watches returns the number of watchers that were ever created.
+func (b *Backend) Watches() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.watches
+}
+
+// Inject delivers a batch of events to every active watcher of the root. It
+// returns once each watcher's consumer has received the batch.
+func (b *Backend) Inject(t testing.TB, root string, events ...fsmonitor.Event) {
+	t.Helper()
+
+	b.mutex.Lock()
+	ws := append([]*watcher{}, b.watchers[root]...)
+	b.mutex.Unlock()
+
+	if len(ws) == 0 {
+		t.Fatalf("No watcher for root %s", root)
+	}
+	for _, w := range ws {
+		select {
+		case w.events <- events:
+		case <-w.stopped:
+		case <-time.After(Timeout):
+			t.Fatalf("Timed out injecting events for root %s", root)
+		}
+	}
+}
+
+// Sync returns once every event injected for the root before it has been
+// handled. Consumers handle one batch at a time, so taking an empty batch
+// means the previous one is done.
+func (b *Backend) Sync(t testing.TB, root string) {
+	t.Helper()
+
+	b.Inject(t, root)
+}
+
+func (w *watcher) Events() <-chan []fsmonitor.Event {
+	return w.events
+}
+
+func (w *watcher) Stop() {
+	w.backend.mutex.Lock()
+	gate := w.backend.stopGate
+	w.backend.mutex.Unlock()
+	if gate != nil {
+		<-gate
+	}
+
+	w.once.Do(func() {
+		close(w.stopped)
+
+		b := w.backend
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		ws := b.watchers[w.root]
+		for i := range ws {
+			if ws[i] == w {
+				b.watchers[w.root] = append(ws[:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(b.watchers[w.root]) == 0 {
+			delete(b.watchers, w.root)
+		}
+	})
+}
@@ -0,0 +1,31 @@
+package fsmonitortest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+)
+
+// Run runs a monitor watching with b and configured with options until the
+// returned function is called, which fails the test if Run returned an
+// error.
+func Run(t testing.TB, b *Backend, options ...fsmonitor.Option) (*fsmonitor.Monitor, func()) {
+	t.Helper()
+
+	m, err := fsmonitor.New(append([]fsmonitor.Option{fsmonitor.WithBackend(b)}, options...)...)
+	if err != nil {
+		t.Fatalf("Unable to create the monitor: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	return m, func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	}
+}
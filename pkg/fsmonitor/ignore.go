@@ -0,0 +1,203 @@
+package fsmonitor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The kinds of ignore rules, as in Unison's ignore preference.
+const (
+	IgnoreName      = "Name"
+	IgnorePath      = "Path"
+	IgnoreBelowPath = "BelowPath"
+	IgnoreRegex     = "Regex"
+)
+
+// IgnoreRule matches paths relative to the root of a replica in the syntax
+// of Unison's ignore and ignorenot preferences: "Name glob" matches the last
+// component, "Path glob" the whole path, "BelowPath glob" the path and
+// everything below it, and "Regex regexp" the whole path. In globs, * and ?
+// do not match a slash nor a leading dot, [...] matches a class of
+// characters and {a,b} matches either alternative.
+type IgnoreRule struct {
+	kind    string
+	pattern string
+	re      *regexp.Regexp
+	reFold  *regexp.Regexp
+}
+
+// ParseIgnoreRule parses a rule such as "Name *.o".
+func ParseIgnoreRule(rule string) (IgnoreRule, error) {
+	fields := strings.SplitN(strings.TrimSpace(rule), " ", 2)
+	if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+		return IgnoreRule{}, fmt.Errorf("Invalid ignore rule %q, expecting a kind and a pattern", rule)
+	}
+	i := IgnoreRule{kind: fields[0], pattern: norm.NFC.String(strings.TrimSpace(fields[1]))}
+
+	var expr string
+	switch i.kind {
+	case IgnoreName:
+		expr = "(?:.*/)?" + globRegexp(i.pattern)
+	case IgnorePath:
+		expr = globRegexp(i.pattern)
+	case IgnoreBelowPath:
+		expr = globRegexp(i.pattern) + "(?:/.*)?"
+	case IgnoreRegex:
+		expr = "(?:" + i.pattern + ")"
+	default:
+		return IgnoreRule{}, fmt.Errorf("Unknown kind of ignore rule %q in %q", i.kind, rule)
+	}
+
+	var err error
+	if i.re, err = regexp.Compile("^" + expr + "$"); err != nil {
+		return IgnoreRule{}, fmt.Errorf("Invalid ignore rule %q: %v", rule, err)
+	}
+	i.reFold = regexp.MustCompile("(?i)^" + expr + "$")
+
+	return i, nil
+}
+
+// String returns the rule in the syntax it was parsed from.
+func (i IgnoreRule) String() string {
+	return i.kind + " " + i.pattern
+}
+
+// Match tells whether the rule matches the path, which is relative to the
+// root of a replica. With fold, case is not taken into account.
+func (i IgnoreRule) Match(p string, fold bool) bool {
+	if i.re == nil {
+		return false
+	}
+	p = norm.NFC.String(strings.Trim(p, "/"))
+	if fold {
+		return i.reFold.MatchString(p)
+	}
+	return i.re.MatchString(p)
+}
+
+// globRegexp translates a glob in Unison's syntax to a regular expression.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	start := true
+	braces := 0
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && start:
+			if i+1 < len(glob) && glob[i+1] == '.' {
+				b.WriteString("[^/.][^/]*")
+				break
+			}
+			// Whatever follows an empty match is still at the start of
+			// the component.
+			b.WriteString("(?:[^/.][^/]*)?")
+			continue
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?' && start:
+			b.WriteString("[^/.]")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				break
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '{':
+			braces++
+			b.WriteString("(?:")
+		case c == '}' && braces > 0:
+			braces--
+			b.WriteString(")")
+		case c == ',' && braces > 0:
+			b.WriteString("|")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+		start = c == '/' || (c == ',' || c == '{') && start
+	}
+	for ; braces > 0; braces-- {
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// AddIgnore stops reporting the changes of the paths the rule matches,
+// unless a rule added with AddIgnoreNot matches them too. As Unison does not
+// descend into ignored directories, whatever lies below an ignored path is
+// ignored as well.
+func (r *Replica) AddIgnore(rule IgnoreRule) {
+	r.ignoreMutex.Lock()
+	defer r.ignoreMutex.Unlock()
+
+	r.ignores = append(r.ignores, rule)
+}
+
+// AddIgnoreNot keeps reporting the changes of the paths the rule matches
+// even if a rule added with AddIgnore matches them.
+func (r *Replica) AddIgnoreNot(rule IgnoreRule) {
+	r.ignoreMutex.Lock()
+	defer r.ignoreMutex.Unlock()
+
+	r.ignoreNots = append(r.ignoreNots, rule)
+}
+
+// IgnoreRules returns the rules added with AddIgnore and AddIgnoreNot.
+func (r *Replica) IgnoreRules() (ignores, ignoreNots []IgnoreRule) {
+	r.ignoreMutex.RLock()
+	defer r.ignoreMutex.RUnlock()
+
+	return append([]IgnoreRule{}, r.ignores...), append([]IgnoreRule{}, r.ignoreNots...)
+}
+
+// Ignored tells whether the changes of the path, which is relative to the
+// root, go unreported because of the ignore rules of the replica.
+func (r *Replica) Ignored(p string) bool {
+	r.ignoreMutex.RLock()
+	defer r.ignoreMutex.RUnlock()
+
+	if len(r.ignores) == 0 {
+		return false
+	}
+	parts := splitPath(p)
+	for n := 1; n <= len(parts); n++ {
+		if r.ignoredPath(strings.Join(parts[:n], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredPath tells whether the path itself, leaving aside its ancestors, is
+// ignored. The caller holds ignoreMutex.
+func (r *Replica) ignoredPath(p string) bool {
+	ignored := false
+	for _, i := range r.ignores {
+		if i.Match(p, r.fold) {
+			ignored = true
+			break
+		}
+	}
+	if !ignored {
+		return false
+	}
+	for _, i := range r.ignoreNots {
+		if i.Match(p, r.fold) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package fsmonitor
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIgnoreRuleMatch(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		rule     string
+		path     string
+		fold     bool
+		expected bool
+	}{
+		{rule: "Name *.o", path: "a.o", expected: true},
+		{rule: "Name *.o", path: "src/lib/a.o", expected: true},
+		{rule: "Name *.o", path: "a.out", expected: false},
+		{rule: "Name *.o", path: "src/.o", expected: false},
+		{rule: "Name *", path: ".hidden", expected: false},
+		{rule: "Name .*", path: "src/.hidden", expected: true},
+		{rule: "Name ?.txt", path: "a.txt", expected: true},
+		{rule: "Name ?.txt", path: "ab.txt", expected: false},
+		{rule: "Name {*.tmp,*~}", path: "x/a.tmp", expected: true},
+		{rule: "Name {*.tmp,*~}", path: "x/a.txt~", expected: true},
+		{rule: "Name {*.tmp,*~}", path: "x/a.txt", expected: false},
+		{rule: "Name [ab].txt", path: "b.txt", expected: true},
+		{rule: "Name [!ab].txt", path: "b.txt", expected: false},
+		{rule: "Name *.O", path: "a.o", fold: true, expected: true},
+		{rule: "Name *.O", path: "a.o", expected: false},
+		{rule: "Name " + resumeNFC, path: resumeNFD, expected: true},
+		{rule: "Path build", path: "build", expected: true},
+		{rule: "Path build", path: "src/build", expected: false},
+		{rule: "Path build", path: "build/a.o", expected: false},
+		{rule: "Path src/*/gen", path: "src/a/gen", expected: true},
+		{rule: "Path src/*/gen", path: "src/a/b/gen", expected: false},
+		{rule: "BelowPath build", path: "build", expected: true},
+		{rule: "BelowPath build", path: "build/a/b.o", expected: true},
+		{rule: "BelowPath build", path: "builds", expected: false},
+		{rule: "Regex .*\\.swp", path: "a/.b.swp", expected: true},
+		{rule: "Regex a|b", path: "ab", expected: false},
+		{rule: "Regex a|b", path: "b", expected: true},
+	}
+
+	for _, table := range tables {
+		i, err := ParseIgnoreRule(table.rule)
+		if err != nil {
+			t.Errorf("ParseIgnoreRule(%q) failed: %v", table.rule, err)
+			continue
+		}
+		if got := i.Match(table.path, table.fold); got != table.expected {
+			t.Errorf("%q matching %q (fold: %t): expecting: %t, got: %t", table.rule, table.path, table.fold, table.expected, got)
+		}
+	}
+}
+
+func TestParseIgnoreRuleErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, rule := range []string{"", "Name", "Name ", "Glob *.o", "Regex (", "name *.o"} {
+		if _, err := ParseIgnoreRule(rule); err == nil {
+			t.Errorf("Expecting ParseIgnoreRule(%q) to fail", rule)
+		}
+	}
+
+	i, err := ParseIgnoreRule("  BelowPath  a b ")
+	if err != nil {
+		t.Fatalf("ParseIgnoreRule failed: %v", err)
+	}
+	if i.String() != "BelowPath a b" || !i.Match("a b/c", false) {
+		t.Errorf("Expecting the pattern to be trimmed, got %q", i)
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	t.Parallel()
+
+	r := &Replica{spellings: &sync.Map{}, ignoreMutex: &sync.RWMutex{}}
+	if r.Ignored("a.o") {
+		t.Errorf("Expecting nothing to be ignored without rules")
+	}
+
+	for _, rule := range []string{"Name *.o", "Name node_modules", "BelowPath tmp"} {
+		i, _ := ParseIgnoreRule(rule)
+		r.AddIgnore(i)
+	}
+	keep, _ := ParseIgnoreRule("Name keep.o")
+	r.AddIgnoreNot(keep)
+
+	tables := []struct {
+		path     string
+		expected bool
+	}{
+		{"a.o", true},
+		{"src/a.c", false},
+		{"keep.o", false},
+		{"src/node_modules", true},
+		{"src/node_modules/x/package.json", true},
+		// An ignorenot rule does not bring back what lies below an
+		// ignored directory.
+		{"tmp/keep.o", true},
+		{"", false},
+	}
+	for _, table := range tables {
+		if got := r.Ignored(table.path); got != table.expected {
+			t.Errorf("Ignored(%q): expecting: %t, got: %t", table.path, table.expected, got)
+		}
+	}
+
+	ignores, ignoreNots := r.IgnoreRules()
+	if len(ignores) != 3 || len(ignoreNots) != 1 || ignoreNots[0].String() != "Name keep.o" {
+		t.Errorf("Unexpected rules: %v, %v", ignores, ignoreNots)
+	}
+}
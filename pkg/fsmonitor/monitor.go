@@ -0,0 +1,189 @@
+package fsmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+// ErrClosed is returned when using a monitor whose Run has returned.
+var ErrClosed = errors.New("Monitor is closed")
+
+// New creates a monitor. Without WithBackend the native backend is used,
+// which only exists on macOS.
+func New(options ...Option) (*Monitor, error) {
+	m := &Monitor{
+		caseFolding:   CaseFoldingAuto,
+		changeLogSize: DefaultChangeLogSize,
+		mutex:         &sync.Mutex{},
+		watches:       make(map[string]*watch),
+		watchedRoots:  set.New(),
+		replicas:      make(map[*Replica]empty),
+		subscriptions: make(map[*Subscription]empty),
+		teardowns:     &sync.WaitGroup{},
+		cookies:       make(map[string]*cookie),
+	}
+
+	for _, option := range options {
+		if err := option(m); err != nil {
+			return nil, fmt.Errorf("Error setting Monitor options: %v", err)
+		}
+	}
+
+	if m.backend == nil {
+		m.backend = DefaultBackend()
+	}
+	if m.backend == nil {
+		return nil, errors.New("No filesystem event backend is available on this platform")
+	}
+
+	return m, nil
+}
+
+// Backend returns the backend the monitor watches with.
+func (m *Monitor) Backend() Backend {
+	return m.backend
+}
+
+// Run keeps the monitor running until ctx is done. It then stops every watch
+// and ends the subscriptions. Replicas can be added both before and while Run
+// runs, but not after it has returned. Run returns nil once it is done, or an
+// error if the monitor is already running or was closed.
+func (m *Monitor) Run(ctx context.Context) error {
+	m.mutex.Lock()
+	switch {
+	case m.closed:
+		m.mutex.Unlock()
+		return ErrClosed
+	case m.running:
+		m.mutex.Unlock()
+		return errors.New("Monitor is already running")
+	}
+	m.running = true
+	m.mutex.Unlock()
+
+	<-ctx.Done()
+	m.close()
+
+	return nil
+}
+
+// close stops every watch once the watches being released have stopped, and
+// ends the subscriptions.
+func (m *Monitor) close() {
+	m.mutex.Lock()
+	m.closed = true
+	m.mutex.Unlock()
+
+	m.teardowns.Wait()
+
+	m.mutex.Lock()
+	watches := m.watches
+	m.watches = make(map[string]*watch)
+	subscriptions := make([]*Subscription, 0, len(m.subscriptions))
+	for s := range m.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	m.mutex.Unlock()
+
+	for _, w := range watches {
+		m.stopWatch(w)
+	}
+	for _, s := range subscriptions {
+		s.Close()
+	}
+}
+
+// AddReplica starts watching the tree at root for the replica called name.
+// Changes are only reported below the given paths, which are relative to
+// root with the empty path standing for root itself; more can be added with
+// AddPath. The name only serves to tell replicas apart in traces.
+func (m *Monitor) AddReplica(name, root string, paths ...string) (*Replica, error) {
+	r := &Replica{
+		name:        name,
+		root:        root,
+		paths:       set.New(),
+		dirs:        set.New(),
+		fold:        m.foldCase(root),
+		spellings:   &sync.Map{},
+		log:         newChangeLog(m.changeLogSize),
+		ignoreMutex: &sync.RWMutex{},
+	}
+	for _, p := range paths {
+		r.AddPath(p)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	w, err := m.acquireWatch(r)
+	if err != nil {
+		return nil, err
+	}
+	r.watch = w
+	m.replicas[r] = empty{}
+
+	return r, nil
+}
+
+// RemoveReplica stops reporting the changes of the replica. Its watch is
+// released in the background once no other replica uses it, so that a slow
+// backend does not hold up the caller. Removing a replica twice is harmless.
+func (m *Monitor) RemoveReplica(r *Replica) {
+	if !atomic.CompareAndSwapInt32(&r.removed, 0, 1) {
+		return
+	}
+
+	m.mutex.Lock()
+	delete(m.replicas, r)
+	for s := range m.subscriptions {
+		s.forget(r)
+	}
+	m.teardowns.Add(1)
+	m.mutex.Unlock()
+
+	go func() {
+		defer m.teardowns.Done()
+		m.releaseWatch(r)
+	}()
+}
+
+// Replicas returns the replicas being watched, ordered by name and root.
+func (m *Monitor) Replicas() []*Replica {
+	m.mutex.Lock()
+	replicas := make([]*Replica, 0, len(m.replicas))
+	for r := range m.replicas {
+		replicas = append(replicas, r)
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(replicas, func(i, j int) bool {
+		if replicas[i].name != replicas[j].name {
+			return replicas[i].name < replicas[j].name
+		}
+		return replicas[i].root < replicas[j].root
+	})
+	return replicas
+}
+
+// foldCase tells whether paths of a replica at root are to be compared
+// without regard to case.
+func (m *Monitor) foldCase(root string) bool {
+	switch m.caseFolding {
+	case CaseFoldingAlways:
+		return true
+	case CaseFoldingNever:
+		return false
+	}
+	return caseInsensitive(filepath.Clean(root))
+}
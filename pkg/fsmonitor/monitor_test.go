@@ -0,0 +1,368 @@
+package fsmonitor_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor"
+	"github.com/patsoffice/mac-unison-fsmonitor/pkg/fsmonitor/fsmonitortest"
+)
+
+// batches collects the batches handed to a handler.
+type batches struct {
+	mutex sync.Mutex
+	list  []fsmonitor.Batch
+}
+
+func (b *batches) handle(batch fsmonitor.Batch) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.list = append(b.list, batch)
+}
+
+func (b *batches) take() []fsmonitor.Batch {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	list := b.list
+	b.list = nil
+	return list
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(fsmonitortest.Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNewWithoutBackend(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("FSEvents is available on macOS")
+	}
+
+	if _, err := fsmonitor.New(); err == nil {
+		t.Errorf("Expected New to fail without a backend")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	var got batches
+	m, stop := fsmonitortest.Run(t, b, fsmonitor.WithHandler(got.handle))
+	defer stop()
+
+	r, err := m.AddReplica("replica", "/r", "a", "b")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/b/y", Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: "/r/a/x", Flags: fsmonitor.EventCreated},
+		fsmonitor.Event{Path: "/r/a", Flags: fsmonitor.EventMetadata | fsmonitor.EventIsDir},
+		fsmonitor.Event{Path: "/r/c/z", Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, "/r")
+
+	// Handlers get every path that changed, but not those outside of the
+	// replica's paths.
+	want := []fsmonitor.Batch{{Replica: r, Paths: []string{"a", "a/x", "b/y"}, Events: fsmonitor.EventCreated | fsmonitor.EventModified | fsmonitor.EventMetadata | fsmonitor.EventIsDir, Cursor: r.Cursor()}}
+	if list := got.take(); !reflect.DeepEqual(list, want) {
+		t.Errorf("Expected batches %v, got %v", want, list)
+	}
+
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r", Flags: fsmonitor.EventRootChanged})
+	b.Sync(t, "/r")
+	want = []fsmonitor.Batch{{Replica: r, Paths: []string{"a", "b"}, Events: fsmonitor.EventRootChanged, Cursor: r.Cursor()}}
+	if list := got.take(); !reflect.DeepEqual(list, want) {
+		t.Errorf("Expected a rescan of every path, got %v", list)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	var got batches
+	var mutex sync.Mutex
+	var ignored, kept []string
+	trace := fsmonitor.Trace{
+		Kept: func(r *fsmonitor.Replica, e fsmonitor.Event, path string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			kept = append(kept, path)
+		},
+		Ignored: func(r *fsmonitor.Replica, e fsmonitor.Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			ignored = append(ignored, e.Path)
+		},
+	}
+	m, stop := fsmonitortest.Run(t, b, fsmonitor.WithHandler(got.handle), fsmonitor.WithTrace(trace))
+	defer stop()
+
+	r, err := m.AddReplica("replica", "/r", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	rule, err := fsmonitor.ParseIgnoreRule("Name *.o")
+	if err != nil {
+		t.Fatalf("Unable to parse the rule: %v", err)
+	}
+	r.AddIgnore(rule)
+
+	b.Inject(t, "/r",
+		fsmonitor.Event{Path: "/r/a.c", Flags: fsmonitor.EventModified},
+		fsmonitor.Event{Path: "/r/a.o", Flags: fsmonitor.EventModified},
+	)
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/b.o", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+
+	want := []fsmonitor.Batch{{Replica: r, Paths: []string{"a.c"}, Events: fsmonitor.EventModified, Cursor: r.Cursor()}}
+	if list := got.take(); !reflect.DeepEqual(list, want) {
+		t.Errorf("Expected batches %v, got %v", want, list)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(ignored, []string{"/r/a.o", "/r/b.o"}) {
+		t.Errorf("Expected the ignored events to be traced, got %v", ignored)
+	}
+	if !reflect.DeepEqual(kept, []string{"a.c"}) {
+		t.Errorf("Expected the kept events to be traced, got %v", kept)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	m, stop := fsmonitortest.Run(t, b)
+
+	r, err := m.AddReplica("replica", "/r", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	s := m.Subscribe()
+
+	// Batches queue up while nobody receives them and come out coalesced.
+	// The subscription may already hold the first one, ready to be sent.
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a/x", Flags: fsmonitor.EventCreated})
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/a", Flags: fsmonitor.EventRemoved | fsmonitor.EventIsDir})
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/b", Flags: fsmonitor.EventModified})
+	b.Sync(t, "/r")
+
+	var (
+		paths  []string
+		events fsmonitor.EventFlags
+		n      int
+		last   fsmonitor.Batch
+	)
+	for len(paths) == 0 || paths[len(paths)-1] != "b" {
+		select {
+		case batch := <-s.C:
+			if batch.Replica != r {
+				t.Fatalf("Expected a batch of the replica, got one of %s", batch.Replica.Name())
+			}
+			paths = append(paths, batch.Paths...)
+			events |= batch.Events
+			n++
+			last = batch
+		case <-time.After(fsmonitortest.Timeout):
+			t.Fatalf("Timed out waiting for a batch, got %v", paths)
+		}
+	}
+	if n > 2 {
+		t.Errorf("Expected the queued batches to be coalesced, got %d batches", n)
+	}
+	if c := r.Cursor(); last.Cursor != c {
+		t.Errorf("Expected the last batch to be at cursor %v, got %v", c, last.Cursor)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(fsmonitor.Coalesce(paths), want) {
+		t.Errorf("Expected paths %v, got %v", want, paths)
+	}
+	if want := fsmonitor.EventCreated | fsmonitor.EventRemoved | fsmonitor.EventIsDir | fsmonitor.EventModified; events != want {
+		t.Errorf("Expected the events %s, got %s", want, events)
+	}
+
+	stop()
+	select {
+	case _, ok := <-s.C:
+		if ok {
+			t.Errorf("Expected no more batches")
+		}
+	case <-time.After(fsmonitortest.Timeout):
+		t.Fatalf("Expected the subscription to end with the monitor")
+	}
+}
+
+func TestSharedWatch(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	var got batches
+	m, stop := fsmonitortest.Run(t, b, fsmonitor.WithHandler(got.handle))
+	defer stop()
+
+	outer, err := m.AddReplica("outer", "/r", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	inner, err := m.AddReplica("inner", "/r/sub", "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	if n := b.Watches(); n != 1 {
+		t.Errorf("Expected the replicas to share a watch, got %d watches", n)
+	}
+	if inner.Watch() != "/r" {
+		t.Errorf("Expected the inner replica to use the watch of /r, got %s", inner.Watch())
+	}
+	if replicas := m.Replicas(); !reflect.DeepEqual(replicas, []*fsmonitor.Replica{inner, outer}) {
+		t.Errorf("Expected both replicas, got %v", replicas)
+	}
+
+	m.RemoveReplica(outer)
+	b.Inject(t, "/r", fsmonitor.Event{Path: "/r/sub/a", Flags: fsmonitor.EventCreated})
+	b.Sync(t, "/r")
+	want := []fsmonitor.Batch{{Replica: inner, Paths: []string{"a"}, Events: fsmonitor.EventCreated, Cursor: inner.Cursor()}}
+	if list := got.take(); !reflect.DeepEqual(list, want) {
+		t.Errorf("Expected batches %v, got %v", want, list)
+	}
+
+	m.RemoveReplica(inner)
+	m.RemoveReplica(inner)
+	waitFor(t, "the watch to stop", func() bool { return b.Active() == 0 })
+}
+
+func TestAddReplicaFailure(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	m, stop := fsmonitortest.Run(t, b)
+	defer stop()
+
+	b.Fail(errors.New("out of watches"))
+	if _, err := m.AddReplica("replica", "/r", ""); err == nil {
+		t.Errorf("Expected AddReplica to fail")
+	}
+	if n := len(m.Replicas()); n != 0 {
+		t.Errorf("Expected no replicas, got %d", n)
+	}
+}
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "fsmonitor")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	b := fsmonitortest.NewBackend()
+	var got batches
+	m, stop := fsmonitortest.Run(t, b, fsmonitor.WithHandler(got.handle))
+	defer stop()
+
+	r, err := m.AddReplica("replica", root, "")
+	if err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+
+	// Play the backend: deliver the event of the cookie once it is written,
+	// along with that of an earlier change.
+	cookie := make(chan string, 1)
+	go func() {
+		for {
+			names, _ := filepath.Glob(filepath.Join(root, fsmonitor.CookiePrefix+"*"))
+			if len(names) > 0 {
+				b.Inject(t, root,
+					fsmonitor.Event{Path: filepath.Join(root, "a.txt"), Flags: fsmonitor.EventCreated},
+					fsmonitor.Event{Path: names[0], Flags: fsmonitor.EventCreated},
+				)
+				cookie <- names[0]
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	if err := m.Sync(r, fsmonitortest.Timeout); err != nil {
+		t.Fatalf("Unable to sync: %v", err)
+	}
+	name := <-cookie
+
+	// The cookie is never reported, not even when it is removed, while a
+	// file of the user with a name like it is.
+	other := filepath.Join(root, fsmonitor.CookiePrefix+"x")
+	b.Inject(t, root,
+		fsmonitor.Event{Path: name, Flags: fsmonitor.EventRemoved},
+		fsmonitor.Event{Path: other, Flags: fsmonitor.EventCreated},
+	)
+	b.Sync(t, root)
+	want := []fsmonitor.Batch{
+		{Replica: r, Paths: []string{"a.txt"}, Events: fsmonitor.EventCreated},
+		{Replica: r, Paths: []string{filepath.Base(other)}, Events: fsmonitor.EventCreated, Cursor: r.Cursor()},
+	}
+	list := got.take()
+	if len(list) == 2 {
+		want[0].Cursor = list[0].Cursor
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("Expected batches %v, got %v", want, list)
+	}
+
+	// Once its removal was seen, the name is no longer dropped.
+	b.Inject(t, root, fsmonitor.Event{Path: name, Flags: fsmonitor.EventCreated})
+	b.Sync(t, root)
+	if list := got.take(); len(list) != 1 || !reflect.DeepEqual(list[0].Paths, []string{filepath.Base(name)}) {
+		t.Errorf("Expected the name of a removed cookie to be reported, got %v", list)
+	}
+
+	if err := m.Sync(r, 10*time.Millisecond); err != fsmonitor.ErrSyncTimeout {
+		t.Errorf("Expected ErrSyncTimeout without the event of the cookie, got %v", err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(root, fsmonitor.CookiePrefix+"*")); len(names) != 0 {
+		t.Errorf("Expected the cookies to be removed, got %v", names)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	t.Parallel()
+
+	b := fsmonitortest.NewBackend()
+	m, stop := fsmonitortest.Run(t, b)
+
+	if _, err := m.AddReplica("replica", "/r", ""); err != nil {
+		t.Fatalf("Unable to add the replica: %v", err)
+	}
+	stop()
+
+	if n := b.Active(); n != 0 {
+		t.Errorf("Expected the watches to be stopped, got %d active", n)
+	}
+	if _, err := m.AddReplica("replica", "/r", ""); err != fsmonitor.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := m.Run(context.Background()); err != fsmonitor.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if _, ok := <-m.Subscribe().C; ok {
+		t.Errorf("Expected the subscription of a closed monitor to be closed")
+	}
+}
@@ -0,0 +1,73 @@
+package fsmonitor
+
+import (
+	"fmt"
+)
+
+// The ways case folding can be chosen with WithCaseFolding.
+const (
+	CaseFoldingAuto   = "auto"
+	CaseFoldingAlways = "always"
+	CaseFoldingNever  = "never"
+)
+
+// Option configures a Monitor.
+type Option func(*Monitor) error
+
+// WithBackend makes the monitor use the given backend instead of the native
+// one.
+func WithBackend(b Backend) Option {
+	return func(m *Monitor) error {
+		m.backend = b
+		return nil
+	}
+}
+
+// WithCaseFolding sets whether paths are matched without regard to case:
+// CaseFoldingAlways, CaseFoldingNever or CaseFoldingAuto, which checks
+// whether the volume of each replica root is case-insensitive. An empty mode
+// leaves the default, CaseFoldingAuto, in place.
+func WithCaseFolding(mode string) Option {
+	return func(m *Monitor) error {
+		switch mode {
+		case "":
+		case CaseFoldingAuto, CaseFoldingAlways, CaseFoldingNever:
+			m.caseFolding = mode
+		default:
+			return fmt.Errorf("Unknown case folding mode: %s", mode)
+		}
+		return nil
+	}
+}
+
+// WithChangeLogSize sets how many changed paths each replica remembers for
+// ChangesSince. The default is DefaultChangeLogSize.
+func WithChangeLogSize(n int) Option {
+	return func(m *Monitor) error {
+		if n < 1 {
+			return fmt.Errorf("Invalid change log size: %d", n)
+		}
+		m.changeLogSize = n
+		return nil
+	}
+}
+
+// WithTrace calls the functions of t as the monitor goes about its work.
+func WithTrace(t Trace) Option {
+	return func(m *Monitor) error {
+		m.trace = t
+		return nil
+	}
+}
+
+// WithHandler calls h with the changes of each batch of events of a replica.
+// Unlike those of a Subscription, the paths are not coalesced, only sorted
+// and without duplicates. h is called from the goroutine of the watch, so the
+// changes have been handled once the watch takes its next batch of events; it
+// must not block.
+func WithHandler(h func(Batch)) Option {
+	return func(m *Monitor) error {
+		m.handlers = append(m.handlers, h)
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package fsmonitor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// pathKey returns the form of a path that is compared when matching events
+// to watched paths. macOS reports paths decomposed (NFD) while most programs,
+// Unison included, have them composed (NFC), so both are compared in NFC. On
+// case-insensitive volumes the case is folded as well.
+func pathKey(p string, fold bool) string {
+	p = norm.NFC.String(p)
+	if fold {
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
+// splitPath splits a path into its components. The empty path and the
+// filesystem root have none.
+func splitPath(p string) []string {
+	p = strings.Trim(filepath.ToSlash(p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// hasPrefixParts tells whether the components of p start with those of
+// prefix, comparing the keys of the components.
+func hasPrefixParts(p, prefix []string, fold bool) bool {
+	if len(p) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if pathKey(p[i], fold) != pathKey(prefix[i], fold) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPath finds the watched path that eventPath lies in and returns the
+// path of the event relative to root. Paths are relative to root, with the
+// empty path standing for root itself. Components are compared by their
+// keys, and the watched path is reported as it was given.
+func matchPath(root string, paths []string, eventPath string, fold bool) (string, bool) {
+	rootParts := splitPath(filepath.Clean(root))
+	eventParts := splitPath(filepath.Clean(eventPath))
+	if !hasPrefixParts(eventParts, rootParts, fold) {
+		return "", false
+	}
+	rel := eventParts[len(rootParts):]
+
+	for _, bp := range paths {
+		bpParts := splitPath(bp)
+		if !hasPrefixParts(rel, bpParts, fold) {
+			continue
+		}
+		return strings.Join(append(splitPath(bp), rel[len(bpParts):]...), "/"), true
+	}
+
+	return "", false
+}
+
+// addSpelling remembers how a path of the replica was spelled, so that
+// changes below it are reported with the same spelling.
+func (r *Replica) addSpelling(p string) {
+	r.spellings.Store(pathKey(p, r.fold), p)
+}
+
+// Respell replaces the longest leading part of p that was announced with
+// AddPath or AddDir by the spelling it was announced with. The rest of p
+// keeps the spelling of the filesystem. Paths are relative to the root.
+func (r *Replica) Respell(p string) string {
+	parts := splitPath(p)
+	for i := len(parts); i > 0; i-- {
+		prefix := strings.Join(parts[:i], "/")
+		if s, ok := r.spellings.Load(pathKey(prefix, r.fold)); ok {
+			return strings.Join(append(splitPath(s.(string)), parts[i:]...), "/")
+		}
+	}
+	return p
+}
+
+// caseInsensitive tells whether the volume holding path ignores case. It
+// looks up the closest component of path that has letters with its case
+// swapped and checks whether that finds the same file.
+func caseInsensitive(path string) bool {
+	for dir := filepath.Clean(path); filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+		base := filepath.Base(dir)
+		swapped := swapCase(base)
+		if swapped == base {
+			continue
+		}
+
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		other, err := os.Lstat(filepath.Join(filepath.Dir(dir), swapped))
+		return err == nil && os.SameFile(fi, other)
+	}
+	return false
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsUpper(r):
+			return unicode.ToLower(r)
+		case unicode.IsLower(r):
+			return unicode.ToUpper(r)
+		}
+		return r
+	}, s)
+}
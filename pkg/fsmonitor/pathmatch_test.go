@@ -0,0 +1,134 @@
+package fsmonitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// The same names, composed (NFC) and decomposed (NFD).
+const (
+	resumeNFC = "R\u00e9sum\u00e9.txt"
+	resumeNFD = "Re\u0301sume\u0301.txt"
+	cafeNFC   = "Caf\u00e9"
+	cafeNFD   = "Cafe\u0301"
+)
+
+func TestMatchPath(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		paths     []string
+		eventPath string
+		expected  string
+		found     bool
+	}{
+		{paths: []string{"foo"}, eventPath: "/r/foo/a.txt", expected: "foo/a.txt", found: true},
+		{paths: []string{"foo"}, eventPath: "/r/foo", expected: "foo", found: true},
+		{paths: []string{"foo"}, eventPath: "/r/foobar/a.txt", found: false},
+		{paths: []string{"foo"}, eventPath: "/r", found: false},
+		{paths: []string{"foo"}, eventPath: "/elsewhere/foo", found: false},
+		{paths: []string{"foo/bar"}, eventPath: "/r/foo/a.txt", found: false},
+		{paths: []string{"bar", "foo"}, eventPath: "/r/foo/x/y", expected: "foo/x/y", found: true},
+		{paths: []string{""}, eventPath: "/r/a.txt", expected: "a.txt", found: true},
+		{paths: []string{""}, eventPath: "/r", expected: "", found: true},
+		{paths: nil, eventPath: "/r/a.txt", found: false},
+	}
+
+	for _, table := range tables {
+		p, found := matchPath("/r", table.paths, table.eventPath, false)
+		if found != table.found || p != table.expected {
+			t.Errorf("matchPath(%v, %s): expecting: %q, %v, got: %q, %v", table.paths, table.eventPath, table.expected, table.found, p, found)
+		}
+	}
+}
+
+func TestMatchPathUnicode(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		root      string
+		paths     []string
+		eventPath string
+		fold      bool
+		expected  string
+		found     bool
+	}{
+		// Unison sends NFC, macOS reports NFD.
+		{root: "/r", paths: []string{cafeNFC}, eventPath: "/r/" + cafeNFD + "/" + resumeNFD, expected: cafeNFC + "/" + resumeNFD, found: true},
+		{root: "/r", paths: []string{cafeNFD}, eventPath: "/r/" + cafeNFC, expected: cafeNFD, found: true},
+		{root: "/" + cafeNFC, paths: []string{""}, eventPath: "/" + cafeNFD + "/a.txt", expected: "a.txt", found: true},
+		{root: "/r", paths: []string{resumeNFC}, eventPath: "/r/" + resumeNFD, expected: resumeNFC, found: true},
+		// Case only matches when folding.
+		{root: "/r", paths: []string{"Foo"}, eventPath: "/r/foo/A.txt", found: false},
+		{root: "/r", paths: []string{"Foo"}, eventPath: "/r/foo/A.txt", fold: true, expected: "Foo/A.txt", found: true},
+		{root: "/R", paths: []string{"foo"}, eventPath: "/r/FOO", fold: true, expected: "foo", found: true},
+		{root: "/r", paths: []string{"café"}, eventPath: "/r/CAFÉ/x", fold: true, expected: "café/x", found: true},
+		{root: "/r", paths: []string{"foo"}, eventPath: "/r/FOOBAR", fold: true, found: false},
+		// The filesystem root.
+		{root: "/", paths: []string{"foo"}, eventPath: "/foo/a.txt", expected: "foo/a.txt", found: true},
+	}
+
+	for _, table := range tables {
+		p, found := matchPath(table.root, table.paths, table.eventPath, table.fold)
+		if found != table.found || p != table.expected {
+			t.Errorf("matchPath(%q, %q, %q, %t): expecting: %q, %v, got: %q, %v", table.root, table.paths, table.eventPath, table.fold, table.expected, table.found, p, found)
+		}
+	}
+}
+
+func TestRespell(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		spellings []string
+		fold      bool
+		path      string
+		expected  string
+	}{
+		{spellings: []string{cafeNFC}, path: cafeNFD + "/" + resumeNFD, expected: cafeNFC + "/" + resumeNFD},
+		{spellings: []string{cafeNFC, cafeNFC + "/" + resumeNFC}, path: cafeNFD + "/" + resumeNFD + "/x", expected: cafeNFC + "/" + resumeNFC + "/x"},
+		{spellings: []string{"Docs"}, path: "docs/a", expected: "docs/a"},
+		{spellings: []string{"Docs"}, fold: true, path: "docs/a", expected: "Docs/a"},
+		{spellings: []string{""}, path: "a/b", expected: "a/b"},
+	}
+
+	for _, table := range tables {
+		r := &Replica{fold: table.fold, spellings: &sync.Map{}}
+		for _, s := range table.spellings {
+			r.addSpelling(s)
+		}
+		if p := r.Respell(table.path); p != table.expected {
+			t.Errorf("Respell(%q) with %q: expecting: %q, got: %q", table.path, table.spellings, table.expected, p)
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "fsmonitor")
+	if err != nil {
+		t.Fatalf("Unable to create tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lower := filepath.Join(dir, "lower")
+	if err := os.Mkdir(lower, 0700); err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+
+	// Whether the volume folds case depends on the machine, so compare with
+	// what the filesystem says about the same name in upper case.
+	_, err = os.Stat(filepath.Join(dir, "LOWER"))
+	expected := err == nil
+	if got := caseInsensitive(lower); got != expected {
+		t.Errorf("Expecting %t for %s, got: %t", expected, lower, got)
+	}
+
+	if caseInsensitive("/nonexistent/path") {
+		t.Errorf("Expecting a path that does not exist to be case-sensitive")
+	}
+}
@@ -0,0 +1,71 @@
+package fsmonitor
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Name returns the name the replica was added with.
+func (r *Replica) Name() string {
+	return r.name
+}
+
+// Root returns the root of the replica's tree.
+func (r *Replica) Root() string {
+	return r.root
+}
+
+// Watch returns the root of the backend watch the replica uses, which is an
+// ancestor of its root when the watch is shared.
+func (r *Replica) Watch() string {
+	return r.watch.root
+}
+
+// Fold tells whether the paths of the replica are matched without regard to
+// case.
+func (r *Replica) Fold() bool {
+	return r.fold
+}
+
+// AddPath reports the changes below path too. The spelling of path is kept
+// for the changes reported below it.
+func (r *Replica) AddPath(path string) {
+	r.paths.Add(path)
+	r.addSpelling(path)
+}
+
+// AddDir announces a directory below one of the paths, so that changes below
+// it are reported with its spelling.
+func (r *Replica) AddDir(dir string) {
+	r.dirs.Add(dir)
+	r.addSpelling(dir)
+}
+
+// Paths returns the paths changes are reported for, in sorted order.
+func (r *Replica) Paths() []string {
+	paths := r.paths.StringSlice()
+	sort.Strings(paths)
+	return paths
+}
+
+// Dirs returns the directories announced with AddDir, in sorted order.
+func (r *Replica) Dirs() []string {
+	dirs := r.dirs.StringSlice()
+	sort.Strings(dirs)
+	return dirs
+}
+
+// LastEvent returns the time of the last batch of events for the replica, or
+// the zero time if there was none.
+func (r *Replica) LastEvent() time.Time {
+	if t := atomic.LoadInt64(&r.lastEvent); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// Removed tells whether the replica was removed from its monitor.
+func (r *Replica) Removed() bool {
+	return atomic.LoadInt32(&r.removed) != 0
+}
@@ -0,0 +1,132 @@
+package fsmonitor
+
+import (
+	"sync"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+// Subscribe returns a subscription to the changes of every replica of the
+// monitor. Its channel is closed by Close, or when Run returns.
+func (m *Monitor) Subscribe() *Subscription {
+	c := make(chan Batch)
+	s := &Subscription{
+		C:       c,
+		c:       c,
+		monitor: m,
+		mutex:   &sync.Mutex{},
+		pending: make(map[*Replica]*set.Set),
+		events:  make(map[*Replica]EventFlags),
+		cursors: make(map[*Replica]Cursor),
+		wake:    make(chan empty, 1),
+		done:    make(chan empty),
+		once:    &sync.Once{},
+	}
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		close(s.done)
+		close(s.c)
+		return s
+	}
+	m.subscriptions[s] = empty{}
+	m.mutex.Unlock()
+
+	go s.pump()
+	return s
+}
+
+// Close ends the subscription and closes its channel. Changes that were not
+// received are dropped.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.monitor.mutex.Lock()
+		delete(s.monitor.subscriptions, s)
+		s.monitor.mutex.Unlock()
+
+		close(s.done)
+	})
+}
+
+// add queues the changes of a batch for delivery. It must not block, as it
+// is called from the goroutines of the watches.
+func (s *Subscription) add(b Batch) {
+	s.mutex.Lock()
+	changes, ok := s.pending[b.Replica]
+	if !ok {
+		changes = set.New()
+		s.pending[b.Replica] = changes
+		s.order = append(s.order, b.Replica)
+	}
+	for _, p := range b.Paths {
+		changes.Add(p)
+	}
+	s.events[b.Replica] |= b.Events
+	s.cursors[b.Replica] = b.Cursor
+	s.mutex.Unlock()
+
+	select {
+	case s.wake <- empty{}:
+	default:
+	}
+}
+
+// forget drops the queued changes of a removed replica.
+func (s *Subscription) forget(r *Replica) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.pending, r)
+	delete(s.events, r)
+	delete(s.cursors, r)
+	for i := range s.order {
+		if s.order[i] == r {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// next takes the queued changes of the replica that has been waiting the
+// longest.
+func (s *Subscription) next() (Batch, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.order) > 0 {
+		r := s.order[0]
+		s.order = s.order[1:]
+		changes, events, cursor := s.pending[r], s.events[r], s.cursors[r]
+		delete(s.pending, r)
+		delete(s.events, r)
+		delete(s.cursors, r)
+
+		// Changes may have been queued just as the replica was removed.
+		if !r.Removed() {
+			return Batch{Replica: r, Paths: Coalesce(changes.StringSlice()), Events: events, Cursor: cursor}, true
+		}
+	}
+	return Batch{}, false
+}
+
+// pump delivers the queued changes until the subscription is closed.
+func (s *Subscription) pump() {
+	defer close(s.c)
+
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+
+		for b, ok := s.next(); ok; b, ok = s.next() {
+			select {
+			case s.c <- b:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
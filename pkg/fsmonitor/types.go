@@ -0,0 +1,188 @@
+package fsmonitor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/patsoffice/mac-unison-fsmonitor/internal/pkg/set"
+)
+
+// DefaultLatency is how long the native backend waits to batch events.
+const DefaultLatency = 500 * time.Millisecond
+
+const defaultEventsChannelSize = 10
+
+type empty struct{}
+
+// EventFlags describe what happened to the path of an event. The flags are
+// independent of the backend that produced the event.
+type EventFlags uint32
+
+const (
+	EventCreated EventFlags = 1 << iota
+	EventRemoved
+	EventModified
+	EventRenamed
+	EventMetadata
+	EventIsDir
+	EventIsSymlink
+	// EventMustScanSubDirs means changes below the path were coalesced by
+	// the backend and the whole subtree has to be rescanned.
+	EventMustScanSubDirs
+	// EventOverflow means the backend dropped events. Nothing is known about
+	// what changed, so everything that is watched has to be rescanned.
+	EventOverflow
+	// EventRootChanged means the watched root itself, or one of the
+	// directories leading up to it, was moved or removed.
+	EventRootChanged
+)
+
+// Event is a single filesystem change reported by a backend. Path is
+// absolute.
+type Event struct {
+	Path  string
+	Flags EventFlags
+}
+
+// Backend is the source of filesystem events. The FSEvents backend is used
+// on macOS; tests can use the in-memory backend of package fsmonitortest.
+type Backend interface {
+	// Name identifies the backend in log messages.
+	Name() string
+	// Watch starts delivering the events for everything below root.
+	Watch(root string) (Watcher, error)
+}
+
+// Watcher delivers the events of a single watched root in batches. Stop
+// releases the resources of the watcher; the events channel is not used
+// after Stop returns.
+type Watcher interface {
+	Events() <-chan []Event
+	Stop()
+}
+
+// Batch is a set of changed paths of a replica. The paths are relative to the
+// root of the replica, with the empty path standing for the root itself.
+type Batch struct {
+	Replica *Replica
+	Paths   []string
+	// Events holds the flags of every event that changed the paths.
+	Events EventFlags
+	// Cursor is the position in the change log of the replica after the
+	// batch.
+	Cursor Cursor
+}
+
+// Trace holds functions that are called as the monitor goes about its work,
+// for logging and metrics. Any of them may be nil. They are called from the
+// goroutines of the watches and must not block.
+type Trace struct {
+	// WatchStarted is called when a backend watch is created for root.
+	// Restarted tells whether root was watched before.
+	WatchStarted func(root string, restarted bool)
+	// WatchShared is called when a replica is added to an existing watch.
+	WatchShared func(root string, r *Replica)
+	// WatchStopped is called once a backend watch has been stopped.
+	WatchStopped func(root string)
+	// Events is called with every batch of events of a watch, before they
+	// are matched against the replicas sharing the watch.
+	Events func(root string, events []Event)
+	// Event is called for each event and each replica it is matched against.
+	Event func(r *Replica, e Event)
+	// Kept is called when an event changes a path of a replica, with the
+	// path relative to the root that is reported for it.
+	Kept func(r *Replica, e Event, path string)
+	// Rescan is called when an event makes every path of a replica change.
+	Rescan func(r *Replica, e Event)
+	// Filtered is called when an event lies outside of the paths of a
+	// replica.
+	Filtered func(r *Replica, e Event)
+	// Ignored is called when the path of an event is ignored by the ignore
+	// rules of a replica.
+	Ignored func(r *Replica, e Event)
+}
+
+// Monitor watches the trees of replicas and reports the paths that change
+// below them. Replicas with the same root, or with a root inside the root of
+// another replica, share a single backend watch.
+type Monitor struct {
+	backend       Backend
+	caseFolding   string
+	changeLogSize int
+	trace         Trace
+	handlers      []func(Batch)
+	// mutex guards the fields below.
+	mutex         *sync.Mutex
+	running       bool
+	closed        bool
+	watches       map[string]*watch
+	watchedRoots  *set.Set
+	replicas      map[*Replica]empty
+	subscriptions map[*Subscription]empty
+	teardowns     *sync.WaitGroup
+	cookies       map[string]*cookie
+	cookieCount   uint64
+}
+
+// Replica is a tree being watched, or rather the paths below its root that
+// changes are reported for.
+type Replica struct {
+	name  string
+	root  string
+	paths *set.Set
+	dirs  *set.Set
+	watch *watch
+	// fold tells whether paths are compared without regard to case.
+	fold bool
+	// spellings maps the keys of the paths and directories that were
+	// announced to their spelling.
+	spellings *sync.Map
+	// removed is set when the replica is removed. It is accessed
+	// atomically.
+	removed int32
+	// lastEvent is the time of the last event batch for the replica in
+	// nanoseconds since the epoch. It is accessed atomically.
+	lastEvent int64
+	log       *changeLog
+	// ignoreMutex guards the ignore rules.
+	ignoreMutex *sync.RWMutex
+	ignores     []IgnoreRule
+	ignoreNots  []IgnoreRule
+}
+
+// Subscription delivers the changes of every replica of a monitor on C. The
+// changes of a replica that pile up while the subscriber is busy are
+// coalesced into a single batch.
+type Subscription struct {
+	C <-chan Batch
+
+	c       chan Batch
+	monitor *Monitor
+	mutex   *sync.Mutex
+	pending map[*Replica]*set.Set
+	events  map[*Replica]EventFlags
+	cursors map[*Replica]Cursor
+	order   []*Replica
+	wake    chan empty
+	done    chan empty
+	once    *sync.Once
+}
+
+// cookie is a file written by Sync whose events are dropped. Its seen
+// channel is closed once the first of them has been handled.
+type cookie struct {
+	watch *watch
+	seen  chan empty
+	// released is set once seen is to be closed. It is guarded by the
+	// mutex of the monitor.
+	released bool
+}
+
+// watch is a backend watch shared by every replica whose root lies at or
+// below the watched root.
+type watch struct {
+	root     string
+	watcher  Watcher
+	replicas map[*Replica]empty
+	stop     chan empty
+}
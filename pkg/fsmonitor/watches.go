@@ -0,0 +1,121 @@
+package fsmonitor
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// acquireWatch subscribes the replica to a watch covering its root, creating
+// one if no existing watch does. It must be called with the mutex held.
+func (m *Monitor) acquireWatch(r *Replica) (*watch, error) {
+	root := filepath.Clean(r.root)
+	w := m.findWatch(root)
+	if w == nil {
+		watcher, err := m.backend.Watch(root)
+		if err != nil {
+			return nil, err
+		}
+		restarted := m.watchedRoots.Has(root)
+		m.watchedRoots.Add(root)
+
+		w = &watch{
+			root:     root,
+			watcher:  watcher,
+			replicas: make(map[*Replica]empty),
+			stop:     make(chan empty),
+		}
+		m.watches[root] = w
+
+		if m.trace.WatchStarted != nil {
+			m.trace.WatchStarted(root, restarted)
+		}
+		go m.eventHandler(w)
+	} else if m.trace.WatchShared != nil {
+		m.trace.WatchShared(w.root, r)
+	}
+
+	w.replicas[r] = empty{}
+	return w, nil
+}
+
+// findWatch returns the watch of root or of the closest directory above it,
+// or nil if there is none. It must be called with the mutex held.
+func (m *Monitor) findWatch(root string) *watch {
+	for dir := root; ; dir = filepath.Dir(dir) {
+		if w, ok := m.watches[dir]; ok {
+			return w
+		}
+		if filepath.Dir(dir) == dir {
+			return nil
+		}
+	}
+}
+
+// releaseWatch unsubscribes the replica from its watch and stops the watch
+// once no replica uses it anymore. Stopping a backend watch can take a while,
+// so it happens outside of the lock.
+func (m *Monitor) releaseWatch(r *Replica) {
+	m.mutex.Lock()
+	w := r.watch
+	delete(w.replicas, r)
+	if len(w.replicas) > 0 || m.watches[w.root] != w {
+		// The watch is still used, or was stopped when the monitor was
+		// closed.
+		m.mutex.Unlock()
+		return
+	}
+	delete(m.watches, w.root)
+	m.mutex.Unlock()
+
+	m.stopWatch(w)
+}
+
+// stopWatch stops the backend watch and its event handler.
+func (m *Monitor) stopWatch(w *watch) {
+	close(w.stop)
+	w.watcher.Stop()
+	if m.trace.WatchStopped != nil {
+		m.trace.WatchStopped(w.root)
+	}
+}
+
+// watchReplicas returns the replicas currently subscribed to the watch.
+func (m *Monitor) watchReplicas(w *watch) []*Replica {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	replicas := make([]*Replica, 0, len(w.replicas))
+	for r := range w.replicas {
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
+// eventHandler hands every batch of events of the watch to each replica
+// subscribed to it until the watch is stopped.
+func (m *Monitor) eventHandler(w *watch) {
+	for {
+		select {
+		case events := <-w.watcher.Events():
+			if m.trace.Events != nil {
+				m.trace.Events(w.root, events)
+			}
+
+			kept, seen := m.takeCookies(w, events)
+			if len(kept) > 0 || len(events) == 0 {
+				now := time.Now().UnixNano()
+				for _, r := range m.watchReplicas(w) {
+					atomic.StoreInt64(&r.lastEvent, now)
+					m.handleEvents(r, kept)
+				}
+			}
+			// The changes made before the cookies are now in the change logs.
+			for _, c := range seen {
+				close(c.seen)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}